@@ -0,0 +1,136 @@
+package rp_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-chi/chi/v5"
+	"github.com/jeremywhuff/rp"
+	"github.com/jeremywhuff/rp/modules/rpchi"
+	"github.com/jeremywhuff/rp/modules/rpecho"
+	"github.com/labstack/echo/v4"
+)
+
+type orderUpdate struct {
+	Quantity int `json:"quantity" binding:"min=1"`
+}
+
+// orderPipe reads a path parameter, the query, a header and the body, passes values through the context,
+// and responds with all of them
+func orderPipe() *rp.Chain {
+	return rp.First(
+		rp.S("Req.Param(\"id\") =>", func(in any, c rp.Context, lgr rp.Logger) (any, error) {
+			id := c.Param("id")
+			if id == "missing" {
+				return nil, errors.New("not found")
+			}
+			c.Set("order.id", id)
+			c.Set("user", c.Request().Header.Get("X-User"))
+			return nil, nil
+		})).Catch(http.StatusNotFound, "Order not found").Then(
+		rp.Bind(&orderUpdate{})).Then(
+		rp.S("respond", func(in any, c rp.Context, lgr rp.Logger) (any, error) {
+			user, _ := c.Get("user")
+			_, missing := c.Get("nope")
+			return &rp.Response{
+				Code:   http.StatusAccepted,
+				Obj:    rp.H{"id": c.MustGet("order.id"), "user": user, "missing": missing, "quantity": in.(*orderUpdate).Quantity, "q": c.Request().URL.Query().Get("q")},
+				Header: http.Header{"X-Order": {c.MustGet("order.id").(string)}},
+			}, nil
+		}))
+}
+
+// TestAdapterParity serves the same route through every adapter and checks that the responses are identical
+func TestAdapterParity(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	route := func() *rp.Route {
+		return &rp.Route{HttpMethod: http.MethodPut, Pipe: orderPipe()}
+	}
+
+	adapters := map[string]http.Handler{}
+
+	ginRoute := route()
+	ginRoute.RelativePath = "/orders/:id"
+	engine := gin.New()
+	rp.AddRoute(engine, ginRoute)
+	adapters["gin"] = engine
+
+	mux := http.NewServeMux()
+	mux.Handle("/orders/", rp.HTTPHandler(orderPipe(), nil, func(r *http.Request, key string) string {
+		if key == "id" {
+			return path.Base(r.URL.Path)
+		}
+		return ""
+	}))
+	adapters["net/http"] = mux
+
+	chiRoute := route()
+	chiRoute.RelativePath = "/orders/{id}"
+	router := chi.NewRouter()
+	rpchi.AddRoute(router, chiRoute)
+	adapters["chi"] = router
+
+	echoRoute := route()
+	echoRoute.RelativePath = "/orders/:id"
+	e := echo.New()
+	rpecho.AddRoute(e, echoRoute)
+	adapters["echo"] = e
+
+	requests := []struct {
+		name string
+		path string
+		body string
+		code int
+	}{
+		{"success", "/orders/A17?q=rush", `{"quantity": 3}`, http.StatusAccepted},
+		{"param error", "/orders/missing", `{"quantity": 3}`, http.StatusNotFound},
+		{"validation error", "/orders/A17", `{"quantity": 0}`, http.StatusBadRequest},
+		{"bad body", "/orders/A17", `{"quantity": "three"}`, http.StatusBadRequest},
+	}
+	for _, tt := range requests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			type result struct {
+				code  int
+				body  string
+				order string
+				ctype string
+			}
+			results := map[string]result{}
+			for name, h := range adapters {
+				req := httptest.NewRequest(http.MethodPut, tt.path, strings.NewReader(tt.body))
+				req.Header.Set("Content-Type", "application/json")
+				req.Header.Set("X-User", "sandra")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				results[name] = result{rec.Code, rec.Body.String(), rec.Header().Get("X-Order"), rec.Header().Get("Content-Type")}
+			}
+
+			want := results["gin"]
+			if want.code != tt.code {
+				t.Errorf("gin = %+v, want status %d", want, tt.code)
+			}
+			for name, got := range results {
+				if got != want {
+					t.Errorf("%s = %+v\ngin = %+v", name, got, want)
+				}
+			}
+		})
+	}
+
+	// The values that the success response is built from
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/orders/A17?q=rush", strings.NewReader(`{"quantity": 3}`))
+	req.Header.Set("X-User", "sandra")
+	engine.ServeHTTP(rec, req)
+	if body := `{"id":"A17","missing":false,"q":"rush","quantity":3,"user":"sandra"}`; rec.Body.String() != body || rec.Header().Get("X-Order") != "A17" {
+		t.Errorf("success = %s, want %s", rec.Body.String(), body)
+	}
+}
@@ -0,0 +1,477 @@
+package rp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Task is a unit of work that an Async stage puts on a WorkQueue.
+type Task struct {
+	ID       string         `json:"id"`
+	Name     string         `json:"name"`     // Name of the registered chain to run
+	Input    any            `json:"input"`    // Input to the chain's first stage
+	Keys     map[string]any `json:"keys"`     // Context values captured when the task was queued
+	Attempts int            `json:"attempts"` // Number of failed attempts so far
+	Queued   time.Time      `json:"queued"`
+}
+
+// TaskStore persists queued tasks so that they survive restarts. A task is saved when it is queued and after
+// every failed attempt, and deleted once it succeeds or runs out of retries. A store that serializes tasks can
+// load the Input and Keys values as json.RawMessage, which the WorkQueue decodes into the TaskTypes registered
+// with the task's chain before running it.
+type TaskStore interface {
+	Save(task *Task) error
+	Delete(id string) error
+	Load() ([]*Task, error)
+}
+
+// FileTaskStore is a TaskStore that keeps each task as a JSON file in Dir. It loads Input and Keys as
+// json.RawMessage, so register the chain with TaskTypes for any values that aren't plain JSON values
+// (map[string]any, []any, string, float64, bool), or they can't be restored to their original types.
+type FileTaskStore struct {
+	Dir string
+}
+
+func (s *FileTaskStore) Save(task *Task) error {
+	if err := os.MkdirAll(s.Dir, 0o755); err != nil {
+		return err
+	}
+	b, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a partial task behind
+	tmp := filepath.Join(s.Dir, task.ID+".tmp")
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(s.Dir, task.ID+".json"))
+}
+
+func (s *FileTaskStore) Delete(id string) error {
+	err := os.Remove(filepath.Join(s.Dir, id+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (s *FileTaskStore) Load() ([]*Task, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tasks := []*Task{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join(s.Dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		stored := &storedTask{}
+		if err := json.Unmarshal(b, stored); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, stored.task())
+	}
+	return tasks, nil
+}
+
+// storedTask is a Task as FileTaskStore reads it, with its values left as JSON until their types are known
+type storedTask struct {
+	Task
+	Input json.RawMessage            `json:"input"`
+	Keys  map[string]json.RawMessage `json:"keys"`
+}
+
+func (s *storedTask) task() *Task {
+	task := s.Task
+	if s.Input != nil {
+		task.Input = s.Input
+	}
+	if s.Keys != nil {
+		task.Keys = make(map[string]any, len(s.Keys))
+		for key, raw := range s.Keys {
+			task.Keys[key] = raw
+		}
+	}
+	return &task
+}
+
+// TaskTypes gives the types that a chain's Input and Keys are decoded into when its tasks are loaded from a
+// TaskStore as JSON. Each one is an example value of the type, like &Order{} or Order{}. Values without a type
+// are decoded as generic JSON values.
+type TaskTypes struct {
+	Input any
+	Keys  map[string]any
+}
+
+// decode replaces the json.RawMessage values of task with values of the types in t
+func (t TaskTypes) decode(task *Task) error {
+	var err error
+	if task.Input, err = decodeTaskValue(task.Input, t.Input); err != nil {
+		return errors.New("input: " + err.Error())
+	}
+	for key, val := range task.Keys {
+		if task.Keys[key], err = decodeTaskValue(val, t.Keys[key]); err != nil {
+			return errors.New("key \"" + key + "\": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func decodeTaskValue(val any, example any) (any, error) {
+	raw, ok := val.(json.RawMessage)
+	if !ok {
+		return val, nil
+	}
+	if example == nil || string(raw) == "null" {
+		var out any
+		err := json.Unmarshal(raw, &out)
+		return out, err
+	}
+	t := reflect.TypeOf(example)
+	if t.Kind() == reflect.Pointer {
+		out := reflect.New(t.Elem())
+		err := json.Unmarshal(raw, out.Interface())
+		return out.Interface(), err
+	}
+	out := reflect.New(t)
+	err := json.Unmarshal(raw, out.Interface())
+	return out.Elem().Interface(), err
+}
+
+var ErrQueueFull = errors.New("work queue is full")
+var ErrQueueStopped = errors.New("work queue is not running")
+
+// WorkQueue runs the chains queued by Async stages on a pool of background workers. Chains are registered
+// by name so that tasks loaded from the Store after a restart can find them. Each chain is run with
+// ExecuteStandalone-style logging, in a StandaloneContext that holds the values captured by the Async stage.
+type WorkQueue struct {
+	Workers    int                      // Number of workers. Default is 4.
+	Size       int                      // Maximum number of waiting tasks. Default is 1000.
+	MaxRetries int                      // Attempts after the first failure. Default is 0.
+	Backoff    time.Duration            // Delay before the first retry, doubled for each one after. Default is 1s.
+	MaxBackoff time.Duration            // Longest delay between retries. Default is 1h.
+	Store      TaskStore                // Optional. Without it, queued work is lost on restart.
+	Logger     Logger                   // Optional
+	OnError    func(*Task, *StageError) // Optional. Called when a task fails for the last time.
+
+	mu      sync.Mutex
+	chains  map[string]*Chain
+	types   map[string]TaskTypes
+	tasks   chan *Task
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running *sync.WaitGroup // The workers of the current Start, replaced on each Start
+}
+
+func NewWorkQueue(store TaskStore, lgr Logger) *WorkQueue {
+	return &WorkQueue{
+		Store:  store,
+		Logger: lgr,
+	}
+}
+
+// Register makes the chain available to Async stages under the given name. With a Store, pass the TaskTypes
+// of the chain's Input and Keys so that tasks loaded after a restart have the same types as when they were
+// queued.
+func (q *WorkQueue) Register(name string, ch *Chain, types ...TaskTypes) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.chains == nil {
+		q.chains = make(map[string]*Chain)
+		q.types = make(map[string]TaskTypes)
+	}
+	q.chains[name] = ch
+	q.types[name] = TaskTypes{}
+	if len(types) > 0 {
+		q.types[name] = types[0]
+	}
+}
+
+// Start loads any tasks left in the Store and starts the workers. Register chains before calling Start.
+// Calling Start on a queue that is already running does nothing, and a stopped queue can be started again.
+func (q *WorkQueue) Start(ctx context.Context) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.ctx != nil {
+		return nil
+	}
+
+	workers := q.Workers
+	if workers <= 0 {
+		workers = 4
+	}
+	size := q.Size
+	if size <= 0 {
+		size = 1000
+	}
+
+	var stored []*Task
+	if q.Store != nil {
+		var err error
+		if stored, err = q.Store.Load(); err != nil {
+			return err
+		}
+	}
+	if len(stored) > size {
+		size = len(stored)
+	}
+
+	q.tasks = make(chan *Task, size)
+	for _, task := range stored {
+		q.tasks <- task
+	}
+
+	q.ctx, q.cancel = context.WithCancel(ctx)
+	q.running = &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		q.running.Add(1)
+		go q.work(q.ctx, q.tasks, q.running)
+	}
+	return nil
+}
+
+// Stop stops the workers and waits for the tasks they are running to finish.
+// Tasks that haven't completed stay in the Store and are picked up by the next Start.
+func (q *WorkQueue) Stop() {
+	q.mu.Lock()
+	running := q.running
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.ctx, q.cancel, q.tasks, q.running = nil, nil, nil, nil
+	q.mu.Unlock()
+
+	if running != nil {
+		running.Wait()
+	}
+}
+
+// Enqueue adds a task for the named chain. It is saved to the Store before it is queued, and removed from it
+// again if the queue is full.
+func (q *WorkQueue) Enqueue(name string, in any, keys map[string]any) error {
+
+	q.mu.Lock()
+	_, ok := q.chains[name]
+	tasks := q.tasks
+	started := q.ctx != nil && q.ctx.Err() == nil
+	q.mu.Unlock()
+
+	if !ok {
+		return errors.New("no chain registered as \"" + name + "\"")
+	}
+	if !started {
+		return ErrQueueStopped
+	}
+
+	task := &Task{
+		ID:     newTaskID(),
+		Name:   name,
+		Input:  in,
+		Keys:   keys,
+		Queued: time.Now(),
+	}
+
+	if q.Store != nil {
+		if err := q.Store.Save(task); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case tasks <- task:
+		return nil
+	default:
+		// The caller is told that the task failed, so it must not run after a restart either
+		q.delete(task)
+		return ErrQueueFull
+	}
+}
+
+// work runs tasks until ctx, the context of the Start that created the worker, is done
+func (q *WorkQueue) work(ctx context.Context, tasks chan *Task, running *sync.WaitGroup) {
+	defer running.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case task := <-tasks:
+			// Both cases can be ready after Stop, and the task is still in the Store for the next Start
+			if ctx.Err() != nil {
+				return
+			}
+			q.run(ctx, tasks, task)
+		}
+	}
+}
+
+func (q *WorkQueue) run(ctx context.Context, tasks chan *Task, task *Task) {
+
+	q.mu.Lock()
+	ch := q.chains[task.Name]
+	types := q.types[task.Name]
+	q.mu.Unlock()
+
+	// Tasks that can never succeed aren't retried
+	var e *StageError
+	retry := false
+	if ch == nil {
+		e = &StageError{
+			Code: ISR,
+			Obj:  H{"error": "No chain registered as \"" + task.Name + "\""},
+		}
+	} else if err := types.decode(task); err != nil {
+		e = &StageError{
+			Code: ISR,
+			Obj:  H{"error": "Invalid stored task \"" + task.Name + "\""},
+			Err:  err,
+		}
+	} else {
+		c := NewStandaloneContext(ctx)
+		for key, val := range task.Keys {
+			c.Set(key, val)
+		}
+		if q.Logger != nil {
+			q.Logger.LogMessage("Running async task \"" + task.Name + "\"...")
+		}
+		e = runTask(ch, task, c, q.Logger)
+		retry = true
+	}
+
+	if e == nil {
+		q.delete(task)
+		return
+	}
+
+	// Shutting down, so keep the task for the next Start
+	if ctx.Err() != nil {
+		return
+	}
+
+	task.Attempts++
+	if !retry || task.Attempts > q.MaxRetries {
+		if q.OnError != nil {
+			q.OnError(task, e)
+		}
+		q.delete(task)
+		return
+	}
+
+	if q.Store != nil {
+		if err := q.Store.Save(task); err != nil && q.Logger != nil {
+			q.Logger.LogMessage("Failed to save async task: " + err.Error())
+		}
+	}
+
+	// A full queue delays the retry until there's room rather than dropping it. If the queue stops first, the
+	// task stays in the Store for the next Start.
+	time.AfterFunc(q.backoff(task.Attempts), func() {
+		select {
+		case tasks <- task:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// backoff returns the delay before the retry that follows the given number of failed attempts
+func (q *WorkQueue) backoff(attempts int) time.Duration {
+	backoff := q.Backoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	max := q.MaxBackoff
+	if max <= 0 {
+		max = time.Hour
+	}
+	for i := 1; i < attempts && backoff < max; i++ {
+		backoff *= 2
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// runTask executes the task's chain. A panic, such as a type assertion on a value restored without its
+// TaskTypes, fails the attempt instead of crashing the process.
+func runTask(ch *Chain, task *Task, c Context, lgr Logger) (e *StageError) {
+	defer func() {
+		if r := recover(); r != nil {
+			e = panicError(r)
+			if lgr != nil {
+				lgr.LogMessage("Async task \"" + task.Name + "\" panicked: " + e.Err.Error())
+			}
+		}
+	}()
+	_, e = execute(ch, task.Input, c, lgr)
+	return e
+}
+
+func (q *WorkQueue) delete(task *Task) {
+	if q.Store == nil {
+		return
+	}
+	if err := q.Store.Delete(task.ID); err != nil && q.Logger != nil {
+		q.Logger.LogMessage("Failed to delete async task: " + err.Error())
+	}
+}
+
+func newTaskID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Async queues the chain registered on q under name and returns immediately, passing in through unchanged.
+// The chain receives in as its first stage's input, and the values of ctxKeys are copied from the request's
+// context into the context the chain runs in. Missing keys are skipped.
+func Async(q *WorkQueue, name string, ctxKeys ...string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Async(\"" + name + "\")" + FuncStr("", ctxKeys...) + " =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			keys := make(map[string]any, len(ctxKeys))
+			for _, key := range ctxKeys {
+				if val, ok := c.Get(key); ok {
+					keys[key] = val
+				}
+			}
+
+			if err := q.Enqueue(name, in, keys); err != nil {
+				return nil, err
+			}
+			return in, nil
+		},
+
+		E: func(err error) *StageError {
+			return &StageError{
+				Code: http.StatusServiceUnavailable,
+				Obj:  H{"error": "Async: " + err.Error()},
+			}
+		},
+	}
+}
@@ -0,0 +1,386 @@
+package rp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+type asyncOrder struct {
+	ID    string   `json:"id"`
+	Items []string `json:"items"`
+}
+
+type asyncUser struct {
+	Email string `json:"email"`
+	Admin bool   `json:"admin"`
+}
+
+// startQueue starts q and stops it when the test ends
+func startQueue(t *testing.T, q *WorkQueue) {
+	t.Helper()
+	if err := q.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(q.Stop)
+}
+
+// receive waits for a value from ch, or fails the test after a few seconds
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for " + what)
+	}
+	var zero T
+	return zero
+}
+
+func TestFileTaskStore(t *testing.T) {
+
+	store := &FileTaskStore{Dir: filepath.Join(t.TempDir(), "tasks")}
+
+	// A missing directory has no tasks
+	tasks, err := store.Load()
+	if err != nil || len(tasks) != 0 {
+		t.Fatalf("Load() = %v, %v", tasks, err)
+	}
+
+	queued := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	for _, task := range []*Task{
+		{ID: "a", Name: "email", Input: "hello", Keys: map[string]any{"n": 1}, Attempts: 2, Queued: queued},
+		{ID: "b", Name: "email", Input: nil, Queued: queued},
+	} {
+		if err := store.Save(task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete("missing"); err != nil {
+		t.Errorf("Delete of a missing task = %v", err)
+	}
+
+	// Files that aren't tasks are skipped
+	os.WriteFile(filepath.Join(store.Dir, "c.tmp"), []byte("{"), 0o644)
+
+	tasks, err = store.Load()
+	if err != nil || len(tasks) != 1 {
+		t.Fatalf("Load() = %v, %v", tasks, err)
+	}
+	got := tasks[0]
+	if got.ID != "a" || got.Name != "email" || got.Attempts != 2 || !got.Queued.Equal(queued) {
+		t.Errorf("loaded %+v", got)
+	}
+	// Values are left as JSON until the queue knows their types
+	if raw, ok := got.Input.(json.RawMessage); !ok || string(raw) != `"hello"` {
+		t.Errorf("Input = %#v", got.Input)
+	}
+	if raw, ok := got.Keys["n"].(json.RawMessage); !ok || string(raw) != `1` {
+		t.Errorf("Keys = %#v", got.Keys)
+	}
+}
+
+func TestTaskTypesDecode(t *testing.T) {
+
+	task := &Task{
+		Input: json.RawMessage(`{"id":"A1","items":["x"]}`),
+		Keys: map[string]any{
+			"user":  json.RawMessage(`{"email":"a@b.c","admin":true}`),
+			"count": json.RawMessage(`3`),
+			"plain": json.RawMessage(`{"k":[1]}`),
+			"none":  json.RawMessage(`null`),
+			"live":  42, // Not from a store, so left alone
+		},
+	}
+	types := TaskTypes{Input: &asyncOrder{}, Keys: map[string]any{"user": asyncUser{}, "count": 0, "none": &asyncUser{}}}
+	if err := types.decode(task); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"user":  asyncUser{Email: "a@b.c", Admin: true},
+		"count": 3,
+		"plain": map[string]any{"k": []any{float64(1)}},
+		"none":  nil,
+		"live":  42,
+	}
+	if !reflect.DeepEqual(task.Input, &asyncOrder{ID: "A1", Items: []string{"x"}}) {
+		t.Errorf("Input = %#v", task.Input)
+	}
+	if !reflect.DeepEqual(task.Keys, want) {
+		t.Errorf("Keys = %#v", task.Keys)
+	}
+
+	bad := &Task{Keys: map[string]any{"count": json.RawMessage(`"three"`)}}
+	if err := types.decode(bad); err == nil {
+		t.Error("decoded a string into an int")
+	}
+}
+
+// TestWorkQueueRestart queues a task with typed values that is still waiting at Stop, then loads it into a new
+// WorkQueue, like after a restart, and runs a chain that asserts the types
+func TestWorkQueueRestart(t *testing.T) {
+
+	store := &FileTaskStore{Dir: t.TempDir()}
+	types := TaskTypes{Input: &asyncOrder{}, Keys: map[string]any{"user": &asyncUser{}}}
+
+	// The first process queues the task behind one that keeps its only worker busy, and stops before running it
+	first := &WorkQueue{Workers: 1, Store: store}
+	first.Register("confirm", First(S("confirm", func(in any, c Context, lgr Logger) (any, error) {
+		t.Error("the task ran before the restart")
+		return nil, nil
+	})), types)
+	first.Register("hold", First(S("hold", func(in any, c Context, lgr Logger) (any, error) {
+		<-c.Context().Done()
+		return nil, c.Context().Err()
+	})))
+	startQueue(t, first)
+	if err := first.Enqueue("hold", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Enqueue("confirm", &asyncOrder{ID: "A1", Items: []string{"x", "y"}}, map[string]any{"user": &asyncUser{Email: "a@b.c"}}); err != nil {
+		t.Fatal(err)
+	}
+	first.Stop()
+
+	// The second process loads it and runs it with the original types
+	type result struct {
+		order *asyncOrder
+		user  *asyncUser
+	}
+	results := make(chan result, 1)
+	second := &WorkQueue{Store: store}
+	second.Register("hold", First(S("hold", func(in any, c Context, lgr Logger) (any, error) {
+		return nil, nil
+	})))
+	second.Register("confirm", First(S("confirm", func(in any, c Context, lgr Logger) (any, error) {
+		results <- result{in.(*asyncOrder), c.MustGet("user").(*asyncUser)}
+		return nil, nil
+	})), types)
+	startQueue(t, second)
+
+	got := receive(t, results, "the restored task")
+	if got.order.ID != "A1" || !reflect.DeepEqual(got.order.Items, []string{"x", "y"}) || got.user.Email != "a@b.c" {
+		t.Errorf("restored %+v, %+v", got.order, got.user)
+	}
+
+	// Both tasks succeeded, so the store is empty
+	waitFor(t, "the tasks to be deleted", func() bool {
+		tasks, _ := store.Load()
+		return len(tasks) == 0
+	})
+}
+
+func TestWorkQueueRetries(t *testing.T) {
+
+	store := &FileTaskStore{Dir: t.TempDir()}
+	attempts := make(chan int, 10)
+	failed := make(chan *Task, 1)
+
+	q := &WorkQueue{Store: store, MaxRetries: 2, Backoff: time.Millisecond, OnError: func(task *Task, e *StageError) {
+		failed <- task
+	}}
+	n := 0
+	q.Register("flaky", First(S("flaky", func(in any, c Context, lgr Logger) (any, error) {
+		n++
+		attempts <- n
+		return nil, errors.New("unavailable")
+	})))
+	startQueue(t, q)
+
+	if err := q.Enqueue("flaky", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	task := receive(t, failed, "the last attempt")
+	if task.Attempts != 3 || len(attempts) != 3 {
+		t.Errorf("%d attempts, %d runs, want 3", task.Attempts, len(attempts))
+	}
+	if tasks, _ := store.Load(); len(tasks) != 0 {
+		t.Errorf("failed task left in the store: %+v", tasks[0])
+	}
+}
+
+func TestWorkQueueBackoff(t *testing.T) {
+
+	q := &WorkQueue{Backoff: time.Second}
+	for attempts, want := range map[int]time.Duration{
+		1:    time.Second,
+		2:    2 * time.Second,
+		4:    8 * time.Second,
+		13:   time.Hour,
+		70:   time.Hour, // Would overflow without the cap
+		1000: time.Hour,
+	} {
+		if got := q.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+
+	q = &WorkQueue{MaxBackoff: 3 * time.Second}
+	if got := q.backoff(3); got != 3*time.Second {
+		t.Errorf("backoff(3) = %v, want the 3s cap", got)
+	}
+}
+
+// TestWorkQueueRetryFullQueue checks that a retry that comes due while the queue is full waits for room
+func TestWorkQueueRetryFullQueue(t *testing.T) {
+
+	failedOnce := make(chan struct{})
+	retried := make(chan struct{})
+	busy := make(chan struct{})
+	release := make(chan struct{})
+
+	q := &WorkQueue{Workers: 1, Size: 1, MaxRetries: 1, Backoff: 20 * time.Millisecond}
+	first := true
+	q.Register("retry", First(S("retry", func(in any, c Context, lgr Logger) (any, error) {
+		if first {
+			first = false
+			close(failedOnce)
+			return nil, errors.New("try again")
+		}
+		close(retried)
+		return nil, nil
+	})))
+	q.Register("busy", First(S("busy", func(in any, c Context, lgr Logger) (any, error) {
+		if in == "block" {
+			close(busy)
+			<-release
+		}
+		return nil, nil
+	})))
+	startQueue(t, q)
+
+	if err := q.Enqueue("retry", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, failedOnce, "the first attempt")
+
+	// Keep the only worker busy and fill the queue before the retry comes due
+	if err := q.Enqueue("busy", "block", nil); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, busy, "the worker to be busy")
+	if err := q.Enqueue("busy", "fill", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue("busy", "overflow", nil); err != ErrQueueFull {
+		t.Fatalf("Enqueue on a full queue = %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+
+	close(release)
+	receive(t, retried, "the retry")
+}
+
+func TestWorkQueueStartStop(t *testing.T) {
+
+	ran := make(chan any, 10)
+	q := NewWorkQueue(nil, nil)
+	q.Register("record", First(S("record", func(in any, c Context, lgr Logger) (any, error) {
+		ran <- in
+		return nil, nil
+	})))
+
+	if err := q.Enqueue("record", 1, nil); err != ErrQueueStopped {
+		t.Errorf("Enqueue before Start = %v", err)
+	}
+	if err := q.Enqueue("missing", 1, nil); err == nil || err.Error() != `no chain registered as "missing"` {
+		t.Errorf("Enqueue of an unregistered chain = %v", err)
+	}
+
+	for i := 1; i <= 2; i++ {
+		if err := q.Start(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := q.Enqueue("record", i, nil); err != nil {
+			t.Fatalf("Enqueue after start %d = %v", i, err)
+		}
+		if got := receive(t, ran, "the task"); got != i {
+			t.Errorf("ran %v, want %d", got, i)
+		}
+		q.Stop()
+		if err := q.Enqueue("record", i, nil); err != ErrQueueStopped {
+			t.Errorf("Enqueue after Stop = %v", err)
+		}
+	}
+}
+
+// TestWorkQueueConcurrent calls Start, Stop and Enqueue from many goroutines at once. Run with -race.
+func TestWorkQueueConcurrent(t *testing.T) {
+
+	q := &WorkQueue{Store: &FileTaskStore{Dir: t.TempDir()}}
+	q.Register("noop", First(S("noop", func(in any, c Context, lgr Logger) (any, error) {
+		return nil, nil
+	})))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			q.Start(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			q.Enqueue("noop", nil, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			q.Stop()
+		}()
+	}
+	wg.Wait()
+	q.Stop()
+}
+
+func TestAsync(t *testing.T) {
+
+	done := make(chan H, 1)
+	q := &WorkQueue{}
+	q.Register("notify", First(S("notify", func(in any, c Context, lgr Logger) (any, error) {
+		user, _ := c.Get("user")
+		_, missing := c.Get("missing")
+		done <- H{"in": in, "user": user, "missing": missing}
+		return nil, nil
+	})))
+
+	ch := First(S("set", func(in any, c Context, lgr Logger) (any, error) {
+		c.Set("user", "sandra")
+		return "order-1", nil
+	})).Then(Async(q, "notify", "user", "missing")).Then(S("respond", func(in any, c Context, lgr Logger) (any, error) {
+		return &Response{Code: http.StatusAccepted, Obj: in}, nil
+	}))
+
+	if p := Async(q, "notify", "user").P(); p != "  => Async(\"notify\")"+FuncStr("", "user")+" =>" {
+		t.Errorf("P() = %q", p)
+	}
+
+	// Before the queue starts, the request fails with a 503
+	rec := httptest.NewRecorder()
+	HTTPHandler(ch, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if body := `{"error":"Async: work queue is not running"}`; rec.Code != http.StatusServiceUnavailable || rec.Body.String() != body {
+		t.Errorf("stopped queue = %d %s", rec.Code, rec.Body.String())
+	}
+
+	startQueue(t, q)
+	rec = httptest.NewRecorder()
+	HTTPHandler(ch, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusAccepted || rec.Body.String() != `"order-1"` {
+		t.Errorf("response = %d %s", rec.Code, rec.Body.String())
+	}
+	if got := receive(t, done, "the async chain"); !reflect.DeepEqual(got, H{"in": "order-1", "user": "sandra", "missing": false}) {
+		t.Errorf("async chain got %v", got)
+	}
+}
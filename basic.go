@@ -1,14 +1,10 @@
 package rp
 
-import (
-	"errors"
-
-	"github.com/gin-gonic/gin"
-)
+import "errors"
 
 // S creates a generic stage that executes the given function.
 // E's default code is http.StatusBadRequest since that is common.
-func S(name string, f func(any, *gin.Context, Logger) (any, error)) *Stage {
+func S(name string, f func(any, Context, Logger) (any, error)) *Stage {
 
 	return &Stage{
 		P: func() string {
@@ -35,7 +31,7 @@ func CtxGet(key string) *Stage {
 			return "[\"" + key + "\"] =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 			val, ok := c.Get(key)
 			if !ok {
 				return nil, ErrNotFound
@@ -59,7 +55,7 @@ func CtxSet(key string) *Stage {
 			return "  => [\"" + key + "\"]"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 			c.Set(key, in)
 			return in, nil
 		},
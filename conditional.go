@@ -1,16 +1,32 @@
 package rp
 
-import "github.com/gin-gonic/gin"
-
 type ChainExecutionError struct {
 	StageError *StageError
 }
 
 func (e ChainExecutionError) Error() string {
-	return "chain execution error"
+	if e.StageError == nil {
+		return "chain execution error"
+	}
+	return "chain execution error: " + e.StageError.Error()
+}
+
+func (e ChainExecutionError) Unwrap() error {
+	if e.StageError == nil {
+		return nil
+	}
+	return e.StageError
 }
 
-func If(cond func(any, *gin.Context) bool, then *Chain, els *Chain) *Stage {
+func If(cond func(any, Context) bool, then *Chain, els *Chain) *Stage {
+
+	var nested []*Chain
+	for _, ch := range []*Chain{then, els} {
+		if ch != nil {
+			nested = append(nested, ch)
+		}
+	}
+
 	return &Stage{
 
 		P: func() string {
@@ -20,7 +36,7 @@ func If(cond func(any, *gin.Context) bool, then *Chain, els *Chain) *Stage {
 			return "If => then/else"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
 			var ch *Chain
 			if cond(in, c) {
@@ -43,5 +59,7 @@ func If(cond func(any, *gin.Context) bool, then *Chain, els *Chain) *Stage {
 		E: func(err error) *StageError {
 			return err.(ChainExecutionError).StageError
 		},
+
+		Nested: nested,
 	}
 }
@@ -0,0 +1,70 @@
+package rp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// Context is the per-request context that is passed into every stage. It abstracts over the router serving
+// the request so that the same chains can be run by gin, net/http, chi, echo, or outside of HTTP entirely.
+// Adapters are GinContext and HTTPContext in this package, and modules/rpchi and modules/rpecho.
+type Context interface {
+	Request() *http.Request      // The HTTP request. nil outside of HTTP.
+	Writer() http.ResponseWriter // The response writer. nil outside of HTTP.
+	Param(key string) string     // Path parameter by name, or "" if there is none
+	Get(key string) (any, bool)  // Key/value store that stages use to share data
+	Set(key string, value any)   //
+	MustGet(key string) any      // Like Get, but panics if the key does not exist
+	Context() context.Context    // Carries cancellation and deadlines for the execution
+}
+
+// Keys is a key/value store that is safe for concurrent use, as required by InParallel.
+// Adapters for routers that don't provide their own store can embed it.
+type Keys struct {
+	mu sync.RWMutex
+	m  map[string]any
+}
+
+func (k *Keys) Get(key string) (any, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	val, ok := k.m[key]
+	return val, ok
+}
+
+func (k *Keys) Set(key string, value any) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.m == nil {
+		k.m = make(map[string]any)
+	}
+	k.m[key] = value
+}
+
+func (k *Keys) MustGet(key string) any {
+	if val, ok := k.Get(key); ok {
+		return val
+	}
+	panic("Key \"" + key + "\" does not exist")
+}
+
+// WithContext returns a Context that is the same as c, including its key/value store, except that its
+// Context() is ctx. Stages that run nested chains use it to change what the nested stages see, such as a
+// database transaction carried in ctx.
+func WithContext(c Context, ctx context.Context) Context {
+	return &withContext{parent: c, ctx: ctx}
+}
+
+type withContext struct {
+	parent Context
+	ctx    context.Context
+}
+
+func (w *withContext) Request() *http.Request      { return w.parent.Request() }
+func (w *withContext) Writer() http.ResponseWriter { return w.parent.Writer() }
+func (w *withContext) Param(key string) string     { return w.parent.Param(key) }
+func (w *withContext) Get(key string) (any, bool)  { return w.parent.Get(key) }
+func (w *withContext) Set(key string, value any)   { w.parent.Set(key, value) }
+func (w *withContext) MustGet(key string) any      { return w.parent.MustGet(key) }
+func (w *withContext) Context() context.Context    { return w.ctx }
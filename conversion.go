@@ -1,13 +1,28 @@
 package rp
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// invalidConversion is the E function of the conversion stages. Their errors are 400s, since the input
+// usually comes from the request.
+func invalidConversion(err error) *StageError {
+	return &StageError{
+		Code: BR,
+		Obj:  H{"error": "Invalid: " + err.Error()},
+	}
+}
+
+// ToObjectID - Converts in to a primitive.ObjectID. in must be a hex string or an ObjectID.
 func ToObjectID() *Stage {
 	return &Stage{
 
@@ -15,16 +30,17 @@ func ToObjectID() *Stage {
 			return "  => .(ObjectID) =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
-			return primitive.ObjectIDFromHex(in.(string))
-		},
-
-		E: func(err error) *StageError {
-			return &StageError{
-				Code: BR,
-				Obj:  H{"error": "Invalid: " + err.Error()},
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			switch v := in.(type) {
+			case primitive.ObjectID:
+				return v, nil
+			case string:
+				return primitive.ObjectIDFromHex(v)
 			}
+			return nil, errors.New("not a string")
 		},
+
+		E: invalidConversion,
 	}
 }
 
@@ -37,7 +53,7 @@ func ToTime(layout string) *Stage {
 			return "  => .(time.Time) =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
 			timeString, ok := in.(string)
 			if !ok {
@@ -47,12 +63,7 @@ func ToTime(layout string) *Stage {
 			return time.Parse(layout, timeString)
 		},
 
-		E: func(err error) *StageError {
-			return &StageError{
-				Code: BR,
-				Obj:  H{"error": "Invalid: " + err.Error()},
-			}
-		},
+		E: invalidConversion,
 	}
 }
 
@@ -65,7 +76,7 @@ func ToTimeInLocation(ctxTimezoneName string, layout string) *Stage {
 			return "  => .(time.Time) =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
 			timeString, ok := in.(string)
 			if !ok {
@@ -86,15 +97,12 @@ func ToTimeInLocation(ctxTimezoneName string, layout string) *Stage {
 			return time.ParseInLocation(layout, timeString, locationTimezone)
 		},
 
-		E: func(err error) *StageError {
-			return &StageError{
-				Code: BR,
-				Obj:  H{"error": "Invalid: " + err.Error()},
-			}
-		},
+		E: invalidConversion,
 	}
 }
 
+// FieldValue - Outputs the value of key if in is a map[string]any, and nil otherwise. Use Path for nested
+// fields, structs, and an error when the field is missing.
 func FieldValue(key string) *Stage {
 	return &Stage{
 
@@ -102,7 +110,7 @@ func FieldValue(key string) *Stage {
 			return "  => Value(\"" + key + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
 			if m, ok := in.(map[string]any); ok {
 				return m[key], nil
@@ -111,3 +119,326 @@ func FieldValue(key string) *Stage {
 		},
 	}
 }
+
+type NumberOptions struct {
+	// Decimal separator. Default is ".". Use "," for locales such as German or French.
+	Decimal string
+	// Optional thousands separator, such as "," in "1,234.5" or "." in "1.234,5". Default is "", which rejects
+	// grouped numbers. When set, groups after the first must have exactly 3 digits.
+	Group string
+}
+
+// ToInt - Converts in to an int. in can be a string, such as a query parameter, any integer type, or a float
+// with no fractional part, such as a number decoded from JSON.
+func ToInt(opts ...NumberOptions) *Stage {
+	opt := numberOptions(opts)
+	return &Stage{
+
+		P: func() string {
+			return "  => .(int) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			switch v := in.(type) {
+			case string:
+				s, err := normalizeNumber(v, opt)
+				if err == nil {
+					if n, err := strconv.Atoi(s); err == nil {
+						return n, nil
+					}
+				}
+			case json.Number:
+				if n, err := strconv.Atoi(v.String()); err == nil {
+					return n, nil
+				}
+			case float32, float64:
+				f := reflect.ValueOf(v).Float()
+				if f == math.Trunc(f) && f >= math.MinInt && f < math.MaxInt {
+					return int(f), nil
+				}
+			default:
+				rv := reflect.ValueOf(in)
+				switch rv.Kind() {
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					if n := rv.Int(); n >= math.MinInt && n <= math.MaxInt {
+						return int(n), nil
+					}
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+					if n := rv.Uint(); n <= math.MaxInt {
+						return int(n), nil
+					}
+				}
+			}
+
+			return nil, errors.New("not an integer")
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToFloat - Converts in to a float64. in can be a string or any number type.
+func ToFloat(opts ...NumberOptions) *Stage {
+	opt := numberOptions(opts)
+	return &Stage{
+
+		P: func() string {
+			return "  => .(float64) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			switch v := in.(type) {
+			case string:
+				s, err := normalizeNumber(v, opt)
+				if err == nil {
+					if f, err := strconv.ParseFloat(s, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+						return f, nil
+					}
+				}
+			case json.Number:
+				if f, err := v.Float64(); err == nil {
+					return f, nil
+				}
+			default:
+				rv := reflect.ValueOf(in)
+				switch rv.Kind() {
+				case reflect.Float32, reflect.Float64:
+					return rv.Float(), nil
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					return float64(rv.Int()), nil
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+					return float64(rv.Uint()), nil
+				}
+			}
+
+			return nil, errors.New("not a number")
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToDecimal - Converts in to a primitive.Decimal128, for amounts that must not lose precision, such as prices.
+// in can be a string, a json.Number or any number type. Floats are converted from their shortest decimal
+// representation.
+func ToDecimal(opts ...NumberOptions) *Stage {
+	opt := numberOptions(opts)
+	return &Stage{
+
+		P: func() string {
+			return "  => .(Decimal128) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			s := ""
+			switch v := in.(type) {
+			case primitive.Decimal128:
+				return v, nil
+			case string:
+				var err error
+				if s, err = normalizeNumber(v, opt); err != nil {
+					return nil, errors.New("not a decimal number")
+				}
+			case json.Number:
+				s = v.String()
+			default:
+				rv := reflect.ValueOf(in)
+				switch rv.Kind() {
+				case reflect.Float32, reflect.Float64:
+					if f := rv.Float(); !math.IsInf(f, 0) && !math.IsNaN(f) {
+						s = strconv.FormatFloat(f, 'f', -1, rv.Type().Bits())
+					}
+				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+					s = strconv.FormatInt(rv.Int(), 10)
+				case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+					s = strconv.FormatUint(rv.Uint(), 10)
+				}
+			}
+
+			d, err := primitive.ParseDecimal128(s)
+			if err != nil || d.IsNaN() || d.IsInf() != 0 { // ParseDecimal128 accepts NaN and Infinity
+				return nil, errors.New("not a decimal number")
+			}
+			return d, nil
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToBool - Converts in to a bool. in can be a bool or a string accepted by strconv.ParseBool, such as "true",
+// "false", "1" or "0".
+func ToBool() *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => .(bool) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			switch v := in.(type) {
+			case bool:
+				return v, nil
+			case string:
+				if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+					return b, nil
+				}
+			}
+
+			return nil, errors.New("not true or false")
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToUUID - Validates that in is a UUID string and outputs it in the canonical lowercase form,
+// like "f47ac10b-58cc-4372-a567-0e02b2c3d479". Hyphens, surrounding braces and a "urn:uuid:" prefix are optional.
+func ToUUID() *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => .(UUID) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			s, ok := in.(string)
+			if !ok {
+				return nil, errors.New("not a string")
+			}
+
+			s = strings.TrimSpace(s)
+			if strings.HasPrefix(s, "{") && strings.HasSuffix(s, "}") {
+				s = s[1 : len(s)-1]
+			} else if len(s) > 9 && strings.EqualFold(s[:9], "urn:uuid:") {
+				s = s[9:]
+			}
+
+			if len(s) == 36 {
+				if s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+					return nil, errors.New("not a UUID")
+				}
+				s = s[:8] + s[9:13] + s[14:18] + s[19:23] + s[24:]
+			}
+
+			b := make([]byte, 16)
+			if len(s) != 32 {
+				return nil, errors.New("not a UUID")
+			}
+			if _, err := hex.Decode(b, []byte(s)); err != nil {
+				return nil, errors.New("not a UUID")
+			}
+
+			h := hex.EncodeToString(b)
+			return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToDuration - Converts in to a time.Duration. in must be a string accepted by time.ParseDuration, such as
+// "90s" or "1h30m", or a time.Duration.
+func ToDuration() *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => .(time.Duration) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			switch v := in.(type) {
+			case time.Duration:
+				return v, nil
+			case string:
+				if d, err := time.ParseDuration(strings.TrimSpace(v)); err == nil {
+					return d, nil
+				}
+				return nil, errors.New("not a duration, such as \"90s\" or \"1h30m\"")
+			}
+
+			return nil, errors.New("not a string")
+		},
+
+		E: invalidConversion,
+	}
+}
+
+// ToEnum - Validates that in is a string equal to one of values, and outputs it unchanged.
+func ToEnum(values ...string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => .(" + strings.Join(values, "|") + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			s, ok := in.(string)
+			if !ok {
+				return nil, errors.New("not a string")
+			}
+			if !contains(values, s) {
+				return nil, errors.New("must be one of " + strings.Join(values, ", "))
+			}
+			return s, nil
+		},
+
+		E: invalidConversion,
+	}
+}
+
+func numberOptions(opts []NumberOptions) NumberOptions {
+	opt := NumberOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Decimal == "" {
+		opt.Decimal = "."
+	}
+	return opt
+}
+
+// normalizeNumber converts a number formatted per opt into the form that strconv understands,
+// like "1.234,5" into "1234.5" for opt = NumberOptions{Decimal: ",", Group: "."}.
+func normalizeNumber(s string, opt NumberOptions) (string, error) {
+
+	s = strings.TrimSpace(s)
+
+	intPart, frac, hasFrac := strings.Cut(s, opt.Decimal)
+	if hasFrac && frac == "" {
+		return "", errors.New("invalid number")
+	}
+
+	if opt.Group != "" && strings.Contains(intPart, opt.Group) {
+		groups := strings.Split(intPart, opt.Group)
+		first := strings.TrimPrefix(strings.TrimPrefix(groups[0], "-"), "+")
+		if first == "" || len(first) > 3 {
+			return "", errors.New("invalid number")
+		}
+		for _, g := range groups[1:] {
+			if len(g) != 3 {
+				return "", errors.New("invalid number")
+			}
+		}
+		intPart = strings.Join(groups, "")
+	}
+
+	// Only plain digits are accepted, so that "." can't be parsed as a decimal point when the locale uses it
+	// for grouping
+	digits := strings.TrimPrefix(strings.TrimPrefix(intPart, "-"), "+") + frac
+	if digits == "" || strings.Trim(digits, "0123456789") != "" {
+		return "", errors.New("invalid number")
+	}
+
+	if hasFrac {
+		return intPart + "." + frac, nil
+	}
+	return intPart, nil
+}
@@ -0,0 +1,131 @@
+package rp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// convert runs the conversion stage s on in
+func convert(s *Stage, in any) (any, *StageError) {
+	return ExecuteStandalone(context.Background(), First(s), in, nil)
+}
+
+func TestConversions(t *testing.T) {
+
+	de := NumberOptions{Decimal: ",", Group: "."}
+	en := NumberOptions{Group: ","}
+	oid, _ := primitive.ObjectIDFromHex("5f1d7f1b9d1e8a0001a1b2c3")
+
+	tests := []struct {
+		name  string
+		stage *Stage
+		in    any
+		want  any // nil for an error
+	}{
+		{"ToInt string", ToInt(), " 42 ", 42},
+		{"ToInt negative", ToInt(), "-7", -7},
+		{"ToInt float", ToInt(), 3.0, 3},
+		{"ToInt fraction", ToInt(), 3.5, nil},
+		{"ToInt json.Number", ToInt(), json.Number("12"), 12},
+		{"ToInt uint8", ToInt(), uint8(200), 200},
+		{"ToInt grouped", ToInt(en), "1,234", 1234},
+		{"ToInt grouped without option", ToInt(), "1,234", nil},
+		{"ToInt bad group", ToInt(en), "1,23", nil},
+		{"ToInt hex", ToInt(), "0x10", nil},
+		{"ToInt bool", ToInt(), true, nil},
+
+		{"ToFloat string", ToFloat(), "1.5", 1.5},
+		{"ToFloat locale", ToFloat(de), "1.234,5", 1234.5},
+		{"ToFloat dot as group", ToFloat(de), "1.5", nil},
+		{"ToFloat int", ToFloat(), 2, 2.0},
+		{"ToFloat NaN", ToFloat(), "NaN", nil},
+		{"ToFloat Inf", ToFloat(), "Inf", nil},
+		{"ToFloat trailing point", ToFloat(), "1.", nil},
+
+		{"ToDecimal string", ToDecimal(), "19.99", "19.99"},
+		{"ToDecimal locale", ToDecimal(de), "1.234,50", "1234.50"},
+		{"ToDecimal float", ToDecimal(), 0.1, "0.1"},
+		{"ToDecimal int", ToDecimal(), int64(-5), "-5"},
+		{"ToDecimal json.Number", ToDecimal(), json.Number("1e3"), "1E+3"},
+		{"ToDecimal json.Number NaN", ToDecimal(), json.Number("NaN"), nil},
+		{"ToDecimal json.Number Infinity", ToDecimal(), json.Number("-Infinity"), nil},
+		{"ToDecimal float NaN", ToDecimal(), math.NaN(), nil},
+		{"ToDecimal float Inf", ToDecimal(), math.Inf(1), nil},
+		{"ToDecimal string NaN", ToDecimal(), "nan", nil},
+		{"ToDecimal bool", ToDecimal(), false, nil},
+
+		{"ToBool string", ToBool(), " true ", true},
+		{"ToBool digit", ToBool(), "0", false},
+		{"ToBool bad", ToBool(), "yes", nil},
+
+		{"ToUUID canonical", ToUUID(), "F47AC10B-58CC-4372-A567-0E02B2C3D479", "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{"ToUUID braces", ToUUID(), "{f47ac10b58cc4372a5670e02b2c3d479}", "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{"ToUUID urn", ToUUID(), "urn:uuid:f47ac10b-58cc-4372-a567-0e02b2c3d479", "f47ac10b-58cc-4372-a567-0e02b2c3d479"},
+		{"ToUUID misplaced hyphen", ToUUID(), "f47ac10b5-8cc-4372-a567-0e02b2c3d479", nil},
+		{"ToUUID short", ToUUID(), "f47ac10b", nil},
+
+		{"ToDuration", ToDuration(), "1h30m", 90 * time.Minute},
+		{"ToDuration bad", ToDuration(), "90", nil},
+
+		{"ToEnum", ToEnum("asc", "desc"), "desc", "desc"},
+		{"ToEnum bad", ToEnum("asc", "desc"), "up", nil},
+
+		{"ToObjectID", ToObjectID(), "5f1d7f1b9d1e8a0001a1b2c3", oid},
+		{"ToObjectID bad", ToObjectID(), "xyz", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			out, e := convert(tt.stage, tt.in)
+
+			if tt.want == nil {
+				if e == nil {
+					t.Fatalf("got %v (%T), want an error", out, out)
+				}
+				if e.Code != BR {
+					t.Errorf("error code = %d, want %d", e.Code, BR)
+				}
+				return
+			}
+			if e != nil {
+				t.Fatalf("error: %v", e.Obj)
+			}
+
+			got := out
+			if d, ok := out.(primitive.Decimal128); ok {
+				got = d.String()
+			}
+			if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", tt.want, tt.want) {
+				t.Errorf("got %T %v, want %T %v", got, got, tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestToTimeInLocation(t *testing.T) {
+
+	s := First(S("set tz", func(in any, c Context, lgr Logger) (any, error) {
+		c.Set("tz", "America/New_York")
+		return in, nil
+	})).Then(ToTimeInLocation("tz", "2006-01-02 15:04"))
+
+	out, e := ExecuteStandalone(context.Background(), s, "2024-07-01 12:00", nil)
+	if e != nil {
+		t.Fatalf("error: %v", e.Obj)
+	}
+	if got := out.(time.Time).UTC().Format(time.RFC3339); got != "2024-07-01T16:00:00Z" {
+		t.Errorf("got %s", got)
+	}
+
+	// Without a timezone, UTC is used
+	out, e = convert(ToTimeInLocation("tz", "2006-01-02 15:04"), "2024-07-01 12:00")
+	if e != nil || out.(time.Time).Location() != time.UTC {
+		t.Errorf("got %v, %v", out, e)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -37,7 +38,7 @@ import (
 // Purchase Route - These variables define the example route
 
 var Method = http.MethodPost
-var Path = "/purchase"
+var PurchasePath = "/purchase"
 
 type PurchaseRequestBody struct {
 	CustomerID string `json:"customer_id"`
@@ -59,13 +60,28 @@ func main() {
 	}
 	defer mongoClient.Disconnect(context.Background())
 
-	// Set up database
+	// Seed the database
 
 	err = setUpDB(mongoClient.Database("rp_test"))
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	// Create the indexes that the rp routes rely on, and report queries that have none
+
+	shopDB := rpmongo.Static(rpmongo.Driver(mongoClient.Database("rp_test")))
+
+	report, err := rpmongo.EnsureIndexes(rpmongo.Driver(mongoClient.Database("rp_test")), PurchaseRouteWithRP(shopDB, true))
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, ix := range report.Created {
+		log.Println("Created index " + ix)
+	}
+	for _, q := range report.Unindexed {
+		log.Println("Query without an index: " + q)
+	}
+
 	// Set up dummy clients
 
 	paymentClient := &PaymentClient{}
@@ -76,16 +92,16 @@ func main() {
 	r := gin.Default()
 
 	// A) Without rp
-	r.POST(Path, PurchaseHandler(mongoClient, paymentClient, shippingClient, emailClient))
+	r.POST(PurchasePath, PurchaseHandler(mongoClient, paymentClient, shippingClient, emailClient))
 
 	// B) Direct migration to rp
-	// r.POST(Path, PurchaseHandlerDirectMigrationToRP(mongoClient, paymentClient, shippingClient, emailClient))
+	// r.POST(PurchasePath, PurchaseHandlerDirectMigrationToRP(mongoClient, paymentClient, shippingClient, emailClient))
 
 	// C) Tidied up implementation in rp
-	// r.POST(Path, MiddlewareForRPHandlers(mongoClient, paymentClient, shippingClient, emailClient), PurchaseHandlerWithRP(mongoClient, paymentClient, shippingClient, emailClient, false))
+	// r.POST(PurchasePath, MiddlewareForRPHandlers(mongoClient, paymentClient, shippingClient, emailClient), PurchaseHandlerWithRP(shopDB, false))
 
 	// D) With concurrency optimizations in rp
-	// r.POST(Path, MiddlewareForRPHandlers(mongoClient, paymentClient, shippingClient, emailClient), PurchaseHandlerWithRP(mongoClient, paymentClient, shippingClient, emailClient, true))
+	// r.POST(PurchasePath, MiddlewareForRPHandlers(mongoClient, paymentClient, shippingClient, emailClient), PurchaseHandlerWithRP(shopDB, true))
 
 	r.Run(":8081")
 }
@@ -127,6 +143,8 @@ type OrderDocumentFields struct {
 
 // Database initialization
 
+// setUpDB replaces the documents of each collection with dummy data. It only seeds, and the indexes that the
+// rp routes need are created by rpmongo.EnsureIndexes.
 func setUpDB(db *mongo.Database) error {
 
 	// Clear all customers, add a bunch of dummy records, and create the test customer
@@ -181,7 +199,7 @@ func setUpDB(db *mongo.Database) error {
 	// Clear all orders
 	db.Collection("orders").DeleteMany(context.Background(), map[string]any{})
 	dummyOrders := make([]any, 200000)
-	for i := range dummyItems {
+	for i := range dummyOrders {
 		dummyOrders[i] = OrderDocument{
 			ID: primitive.NewObjectID(),
 		}
@@ -318,7 +336,6 @@ func MiddlewareForRPHandlers(mongoClient *mongo.Client, paymentClient *PaymentCl
 
 	return func(c *gin.Context) {
 
-		c.Set("mongo.client.database", mongoClient.Database("rp_test"))
 		c.Set("payment.client", paymentClient)
 		c.Set("shipping.client", shippingClient)
 		c.Set("email.client", emailClient)
@@ -332,10 +349,10 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	parse := MakeChain(S(
 		FuncStr("parse")+CtxOutStr("req.body"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			var body PurchaseRequestBody
-			err := c.ShouldBindJSON(&body)
+			err := json.NewDecoder(c.Request().Body).Decode(&body)
 			if err != nil {
 				return nil, err
 			}
@@ -346,7 +363,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	fetchCustomer := MakeChain(S(
 		FuncStr("fetch_customer", "req.body")+CtxOutStr("mongo.document.customer"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
 
@@ -365,7 +382,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	fetchInventory := MakeChain(S(
 		FuncStr("fetch_inventory", "req.body")+CtxOutStr("mongo.document.inventory"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
 
@@ -384,7 +401,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	checkStock := MakeChain(S(
 		FuncStr("check_stock", "mongo.document.inventory", "req.body"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			item := c.MustGet("mongo.document.inventory").(*InventoryDocument)
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
@@ -398,7 +415,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	runPayment := MakeChain(S(
 		FuncStr("run_payment", "req.body", "mongo.document.inventory", "mongo.document.customer")+CtxOutStr("total"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
 			item := c.MustGet("mongo.document.inventory").(*InventoryDocument)
@@ -417,7 +434,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	createShipment := MakeChain(S(
 		FuncStr("create_shipment", "req.body"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
 
@@ -431,7 +448,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	createOrder := MakeChain(S(
 		FuncStr("create_order", "mongo.document.customer", "mongo.document.inventory", "req.body", "total"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			customer := c.MustGet("mongo.document.customer").(*CustomerDocument)
 			item := c.MustGet("mongo.document.inventory").(*InventoryDocument)
@@ -455,7 +472,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	sendEmail := MakeChain(S(
 		FuncStr("send_email", "req.body"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			body := c.MustGet("req.body").(*PurchaseRequestBody)
 
@@ -468,7 +485,7 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 
 	respond := MakeChain(S(
 		FuncStr("respond"),
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 			res := Response{
 				Code: http.StatusOK,
 				Obj:  gin.H{"message": "Purchase successful"},
@@ -493,7 +510,14 @@ func PurchaseHandlerDirectMigrationToRP(mongoClient *mongo.Client, paymentClient
 }
 
 // Tidied up handler in rp, which can be set to run with or without concurrency optimizations
-func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
+func PurchaseHandlerWithRP(db *rpmongo.Provider, withConcurrency bool) gin.HandlerFunc {
+	route := PurchaseRouteWithRP(db, withConcurrency)
+	return MakeGinHandlerFunc(route.Pipe, route.Logger)
+}
+
+// PurchaseRouteWithRP defines the tidied up pipeline as a route, so that rpmongo.EnsureIndexes can find the
+// indexes that its stages declare
+func PurchaseRouteWithRP(db *rpmongo.Provider, withConcurrency bool) *Route {
 
 	// First: Parse request body
 	parse := First(
@@ -504,7 +528,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	fetchCustomer := First(
 
 		S(`fetch_customer_query(["req.body"]) =>`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				customerID := c.MustGet("req.body").(*PurchaseRequestBody).CustomerID
 				query := map[string]any{
@@ -513,8 +537,9 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 
 			})).Then(
 
-		rpmongo.MongoFindOne("mongo.client.database", "customers", rpmongo.MongoFindOneOptions{
-			Result: &CustomerDocument{}})).Then(
+		rpmongo.Indexed(
+			rpmongo.MongoFindOneT[CustomerDocument](db, "customers"),
+			rpmongo.Unique("customer_id"))).Then(
 
 		CtxSet("mongo.document.customer"))
 
@@ -522,7 +547,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	fetchInventory := First(
 
 		S(`fetch_inventory_query(["req.body"]) =>`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				sku := c.MustGet("req.body").(*PurchaseRequestBody).SKU
 				query := map[string]any{
@@ -531,8 +556,9 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 
 			})).Then(
 
-		rpmongo.MongoFindOne("mongo.client.database", "inventory", rpmongo.MongoFindOneOptions{
-			Result: &InventoryDocument{}})).Then(
+		rpmongo.Indexed(
+			rpmongo.MongoFindOneT[InventoryDocument](db, "inventory"),
+			rpmongo.Unique("sku"))).Then(
 
 		CtxSet("mongo.document.inventory"))
 
@@ -540,7 +566,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	checkStock := MakeChain(
 
 		S(`check_inventory_stock(["mongo.document.inventory"], ["req.body"])`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				stock := c.MustGet("mongo.document.inventory").(*InventoryDocument).Stock
 				quantity := c.MustGet("req.body").(*PurchaseRequestBody).Quantity
@@ -558,7 +584,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	calculateTotal := MakeChain(
 
 		S(`calculate_total(["req.body"], ["mongo.document.inventory"]) =>`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				quantity := c.MustGet("req.body").(*PurchaseRequestBody).Quantity
 				price := c.MustGet("mongo.document.inventory").(*InventoryDocument).Price
@@ -573,7 +599,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	runPayment := MakeChain(
 
 		S(`run_payment(["total"], ["mongo.document.customer"])`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				paymentClient := c.MustGet("payment.client").(*PaymentClient)
 
@@ -591,7 +617,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	createShipment := MakeChain(
 
 		S(`create_shipment(["req.body"])`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				shippingClient := c.MustGet("shipping.client").(*ShippingClient)
 
@@ -610,7 +636,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	createOrder := First(
 
 		S(`create_new_order(["mongo.document.customer"], ["mongo.document.inventory"], ["req.body"], ["total"])`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				customerID := c.MustGet("mongo.document.customer").(*CustomerDocument).ID
 				itemID := c.MustGet("mongo.document.inventory").(*InventoryDocument).ID
@@ -626,13 +652,13 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 				return order, nil
 			})).Then(
 
-		rpmongo.MongoInsert("mongo.client.database", "orders"))
+		rpmongo.MongoInsert(db, "orders"))
 
 	// 7) Send email for receipt
 	sendOrderInProgressAlert := MakeChain(
 
 		S(`send_order_in_progress_alert(["req.body"])`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
+			func(in any, c Context, lgr Logger) (any, error) {
 
 				emailClient := c.MustGet("email.client").(*EmailClient)
 
@@ -650,15 +676,7 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 	// Last: Return response
 	successResponse := MakeChain(
 
-		S(`success_response()`,
-			func(in any, c *gin.Context, lgr Logger) (any, error) {
-
-				res := Response{
-					Code: http.StatusOK,
-					Obj:  gin.H{"message": "Purchase successful"},
-				}
-				return &res, nil
-			}))
+		RespondWith(http.StatusOK, H{"message": "Purchase successful"}))
 
 	// Build the full pipeline chain
 	pipeline := &Chain{}
@@ -692,5 +710,10 @@ func PurchaseHandlerWithRP(withConcurrency bool) gin.HandlerFunc {
 		)
 	}
 
-	return MakeGinHandlerFunc(pipeline, DefaultLogger{})
+	return &Route{
+		HttpMethod:   http.MethodPost,
+		RelativePath: PurchasePath,
+		Pipe:         pipeline,
+		Logger:       DefaultLogger{},
+	}
 }
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jeremywhuff/rp/modules/rpmongo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// TestPurchaseWithRP runs the tidied up purchase pipeline end-to-end against an in-memory database, with and
+// without the concurrency optimizations.
+func TestPurchaseWithRP(t *testing.T) {
+
+	for _, withConcurrency := range []bool{false, true} {
+
+		name := "sequential"
+		if withConcurrency {
+			name = "concurrent"
+		}
+
+		t.Run(name, func(t *testing.T) {
+
+			ctx := context.Background()
+			mem := rpmongo.NewMemoryDatabase()
+
+			customerID := primitive.NewObjectID()
+			itemID := primitive.NewObjectID()
+			mem.Collection("customers").InsertOne(ctx, CustomerDocument{
+				ID:         customerID,
+				CustomerID: "C975310",
+				FirstName:  "Sandra",
+				LastName:   "Hernandez",
+				Email:      "sandra.hernandez@example.com",
+				WalletID:   "W246802",
+			})
+			mem.Collection("inventory").InsertOne(ctx, InventoryDocument{
+				ID:    itemID,
+				SKU:   "SKU159260",
+				Name:  "Wonder Widget",
+				Price: 3500,
+				Stock: 5,
+			})
+
+			gin.SetMode(gin.TestMode)
+			r := gin.New()
+			r.POST(PurchasePath,
+				MiddlewareForRPHandlers(nil, &PaymentClient{}, &ShippingClient{}, &EmailClient{}),
+				PurchaseHandlerWithRP(rpmongo.Static(mem), withConcurrency))
+
+			purchase := func(body string) (int, map[string]any) {
+				req := httptest.NewRequest(http.MethodPost, PurchasePath, strings.NewReader(body))
+				req.Header.Set("Content-Type", "application/json")
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				var res map[string]any
+				json.Unmarshal(rec.Body.Bytes(), &res)
+				return rec.Code, res
+			}
+
+			// Success
+			code, res := purchase(`{"customer_id": "C975310", "sku": "SKU159260", "quantity": 2}`)
+			if code != http.StatusOK || res["message"] != "Purchase successful" {
+				t.Fatalf("purchase = %d %v", code, res)
+			}
+
+			var order OrderDocument
+			if err := mem.Collection("orders").FindOne(ctx, bson.M{"customer": customerID}).Decode(&order); err != nil {
+				t.Fatalf("order not inserted: %v", err)
+			}
+			if order.Item != itemID || order.Quantity != 2 || order.Total != 7000 {
+				t.Errorf("order = %+v", order)
+			}
+
+			// Unknown customer
+			if code, res := purchase(`{"customer_id": "C000000", "sku": "SKU159260", "quantity": 1}`); code != http.StatusNotFound {
+				t.Errorf("unknown customer = %d %v", code, res)
+			}
+
+			// Not enough stock
+			if code, res := purchase(`{"customer_id": "C975310", "sku": "SKU159260", "quantity": 6}`); code != http.StatusBadRequest || res["error"] != "Not enough stock" {
+				t.Errorf("not enough stock = %d %v", code, res)
+			}
+
+			if n, _ := mem.Collection("orders").CountDocuments(ctx, bson.M{}); n != 1 {
+				t.Errorf("orders = %d, want 1", n)
+			}
+		})
+	}
+}
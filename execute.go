@@ -1,11 +1,15 @@
 package rp
 
 import (
+	"encoding/json"
+	"fmt"
 	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
 	"time"
 
 	"github.com/fatih/color"
-	"github.com/gin-gonic/gin"
 )
 
 // TODO: Replace the Response and StageError types with this single type
@@ -15,13 +19,34 @@ type JSONResponse struct {
 }
 
 type Response struct {
-	Code int // HTTP status code
-	Obj  any // JSON response data
+	Code   int         // HTTP status code
+	Obj    any         // JSON response data
+	Header http.Header // Optional headers to add to the response
 }
 
+// StageError is returned when a stage fails. Code and Obj define the network response, while Err, Stage and
+// Path record what actually went wrong so that callers can inspect the cause with errors.Is and errors.As.
 type StageError struct {
-	Code int // HTTP status code
-	Obj  any // JSON response data
+	Code  int      // HTTP status code
+	Obj   any      // JSON response data
+	Err   error    // The error returned by the stage's F function
+	Stage string   // P() of the stage that failed
+	Path  []string // P() of each stage from the outermost chain down to the failed stage
+}
+
+func (e *StageError) Error() string {
+	msg := fmt.Sprintf("stage error %d", e.Code)
+	if e.Stage != "" {
+		msg += " at " + strings.TrimSpace(e.Stage)
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
 }
 
 type Logger interface {
@@ -65,18 +90,35 @@ func (l DefaultLogger) LogStageComplete(success bool, elapsed time.Duration, pri
 
 func (l DefaultLogger) LogStageError(e *StageError) {
 	log.Printf("")
-	log.Printf("Error: %s", e.Obj.(H)["error"])
+	if obj, ok := e.Obj.(H); ok {
+		log.Printf("Error: %s", obj["error"])
+	}
+	if e.Err != nil {
+		log.Printf("Cause: %s", e.Err.Error())
+	}
 	log.Printf("")
 }
 
-func Execute(ch *Chain, c *gin.Context, lgr Logger) (any, *StageError) {
+func Execute(ch *Chain, c Context, lgr Logger) (any, *StageError) {
 
 	if lgr != nil {
 		lgr.LogMessage("Starting execution chain...")
 	}
 
+	return execute(ch, nil, c, lgr)
+}
+
+// ExecuteWith is like Execute, but with in as the first stage's input. It is meant for stages defined outside
+// of this package that run nested chains.
+func ExecuteWith(ch *Chain, in any, c Context, lgr Logger) (any, *StageError) {
+	return execute(ch, in, c, lgr)
+}
+
+// execute runs the chain's stages with in as the first stage's input.
+func execute(ch *Chain, in any, c Context, lgr Logger) (any, *StageError) {
+
 	s := ch.First
-	var d any // Data passed between successive stages
+	d := in // Data passed between successive stages
 	var e *StageError
 
 	// Execute all stages
@@ -108,25 +150,85 @@ func Execute(ch *Chain, c *gin.Context, lgr Logger) (any, *StageError) {
 }
 
 // Execute executes the stage by calling the F function followed by the E function if there's an error.
-func (s *Stage) Execute(in any, c *gin.Context, lgr Logger) (any, *StageError) {
+// The returned StageError keeps F's error as its cause. When a stage nests chains (If, InParallel, ...),
+// the inner StageError is passed through, so this stage is prepended to its Path.
+func (s *Stage) Execute(in any, c Context, lgr Logger) (any, *StageError) {
 
 	out, err := s.F(in, c, lgr)
 	if err != nil {
-		return nil, s.E(err)
+		var e *StageError
+		if s.E != nil {
+			e = s.E(err)
+		}
+		if e == nil {
+			e = &StageError{
+				Code: ISR,
+				Obj:  H{"error": err.Error()},
+			}
+		} else {
+			// Annotate a copy, since E may return the same *StageError for every call
+			ce := *e
+			e = &ce
+		}
+		if e.Err == nil {
+			e.Err = err
+		}
+		if e.Stage == "" {
+			e.Stage = s.P()
+		}
+		e.Path = append([]string{s.P()}, e.Path...)
+		return nil, e
 	}
 
 	return out, nil
 }
 
-func MakeGinHandlerFunc(ch *Chain, lgr Logger) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		o, e := Execute(ch, c, lgr)
-		if e != nil {
-			c.JSON(e.Code, e.Obj)
-			return
+// run executes the chain and writes its output, or its StageError, as the network response.
+func run(ch *Chain, c Context, lgr Logger) {
+	o, e := Execute(ch, c, lgr)
+	if e != nil {
+		writeJSON(c.Writer(), e.Code, e.Obj)
+		return
+	}
+
+	writeResponse(c, o, lgr)
+}
+
+// writeResponse sets the network response from the output of a pipeline's last stage.
+func writeResponse(c Context, o any, lgr Logger) {
+	switch res := o.(type) {
+	case *Response:
+		for key, vals := range res.Header {
+			for _, val := range vals {
+				c.Writer().Header().Add(key, val)
+			}
 		}
+		writeJSON(c.Writer(), res.Code, res.Obj)
+	case *StreamResponse:
+		writeStream(c, res, lgr)
+	default:
+		writeJSON(c.Writer(), ISR, H{"error": fmt.Sprintf("pipeline returned %T instead of a response", o)})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, obj any) {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		code = ISR
+		b = []byte(`{"error":"failed to encode response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(b)
+}
 
-		res := o.(*Response)
-		c.JSON(res.Code, res.Obj)
+// panicError turns a value recovered from a panic into a 500 StageError. Runners that execute chains in their
+// own goroutines, like Scheduler and WorkQueue, use it so that a panicking stage fails its run rather than the
+// whole process. Err keeps the stack trace.
+func panicError(r any) *StageError {
+	return &StageError{
+		Code: ISR,
+		Obj:  H{"error": "Internal server error"},
+		Err:  fmt.Errorf("panic: %v\n%s", r, debug.Stack()),
 	}
 }
@@ -0,0 +1,149 @@
+package rp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// notFound is returned by an E function for every call, like a package-level error response
+var notFound = &StageError{Code: http.StatusNotFound, Obj: H{"error": "Not found"}}
+
+// TestStageErrorThroughNestedChains checks that the cause, Stage and Path of a StageError survive If and
+// InParallel, and that annotating it never changes the StageError that E returned.
+func TestStageErrorThroughNestedChains(t *testing.T) {
+
+	find := &Stage{
+		P: func() string { return "find =>" },
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return nil, mongo.ErrNoDocuments
+		},
+		E: func(err error) *StageError { return notFound },
+	}
+	ok := S("ok =>", func(in any, c Context, lgr Logger) (any, error) {
+		return "ok", nil
+	})
+
+	ch := First(S("start =>", func(in any, c Context, lgr Logger) (any, error) {
+		return in, nil
+	})).Then(
+		If(func(in any, c Context) bool { return true },
+			InParallel(First(ok), First(find)),
+			nil))
+
+	for i := 0; i < 2; i++ {
+
+		_, e := ExecuteStandalone(context.Background(), ch, nil, nil)
+		if e == nil {
+			t.Fatal("no error")
+		}
+
+		if e.Code != http.StatusNotFound || e.Obj.(H)["error"] != "Not found" {
+			t.Errorf("response = %d %v", e.Code, e.Obj)
+		}
+		if !errors.Is(e, mongo.ErrNoDocuments) {
+			t.Errorf("errors.Is(e, mongo.ErrNoDocuments) = false for %v", e)
+		}
+		var se *StageError
+		if !errors.As(e, &se) || se != e {
+			t.Errorf("errors.As(e, *StageError) = %v", se)
+		}
+		if e.Stage != "find =>" {
+			t.Errorf("Stage = %q", e.Stage)
+		}
+		if want := []string{"If => then", "InParallel: 2 chains", "find =>"}; !reflect.DeepEqual(e.Path, want) {
+			t.Errorf("Path = %q, want %q", e.Path, want)
+		}
+		if want := "stage error 404 at find =>: mongo: no documents in result"; e.Error() != want {
+			t.Errorf("Error() = %q, want %q", e.Error(), want)
+		}
+
+		// The wrapping errors of If and InParallel unwrap to the same StageError
+		if !errors.Is(ChainExecutionError{StageError: e}, mongo.ErrNoDocuments) {
+			t.Errorf("ChainExecutionError does not unwrap to the cause")
+		}
+		if !errors.Is(parallelError{StageError: e}, mongo.ErrNoDocuments) {
+			t.Errorf("parallelError does not unwrap to the cause")
+		}
+	}
+
+	if notFound.Err != nil || notFound.Stage != "" || notFound.Path != nil {
+		t.Errorf("the StageError returned by E was changed: %+v", notFound)
+	}
+}
+
+// TestStageErrorWithoutE checks the default StageError of a stage that has no E function
+func TestStageErrorWithoutE(t *testing.T) {
+
+	ch := First(&Stage{
+		P: func() string { return "fail =>" },
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return nil, mongo.ErrNoDocuments
+		},
+	})
+
+	_, e := ExecuteStandalone(context.Background(), ch, nil, nil)
+	if e == nil || e.Code != ISR || e.Obj.(H)["error"] != mongo.ErrNoDocuments.Error() {
+		t.Fatalf("error = %v", e)
+	}
+	if !errors.Is(e, mongo.ErrNoDocuments) || e.Stage != "fail =>" || !reflect.DeepEqual(e.Path, []string{"fail =>"}) {
+		t.Errorf("error = %+v", e)
+	}
+}
+
+type loggedStage struct {
+	print   string
+	success bool
+	elapsed time.Duration
+}
+
+// recordLogger records what it logs, so that tests can check which logger a chain used
+type recordLogger struct {
+	mu       sync.Mutex
+	messages []string
+	stages   []string // P() of every stage started
+	complete []loggedStage
+	errors   []*StageError
+}
+
+func (l *recordLogger) LogMessage(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, msg)
+}
+
+func (l *recordLogger) LogStageStart(print string, in any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stages = append(l.stages, print)
+}
+
+func (l *recordLogger) LogStageComplete(success bool, elapsed time.Duration, print string, out any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.complete = append(l.complete, loggedStage{print: print, success: success, elapsed: elapsed})
+}
+
+func (l *recordLogger) LogStageError(e *StageError) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, e)
+}
+
+func (l *recordLogger) completed() []loggedStage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]loggedStage{}, l.complete...)
+}
+
+func (l *recordLogger) started() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.stages...)
+}
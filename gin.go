@@ -0,0 +1,71 @@
+package rp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GinContext adapts a *gin.Context to the Context interface. Values set by gin middleware with c.Set are
+// visible to stages, and vice versa. Stages that need gin itself can get it back with c.(GinContext).Gin.
+type GinContext struct {
+	Gin *gin.Context
+}
+
+func (g GinContext) Request() *http.Request {
+	return g.Gin.Request
+}
+
+func (g GinContext) Writer() http.ResponseWriter {
+	return g.Gin.Writer
+}
+
+func (g GinContext) Param(key string) string {
+	return g.Gin.Param(key)
+}
+
+func (g GinContext) Get(key string) (any, bool) {
+	return g.Gin.Get(key)
+}
+
+func (g GinContext) Set(key string, value any) {
+	g.Gin.Set(key, value)
+}
+
+func (g GinContext) MustGet(key string) any {
+	return g.Gin.MustGet(key)
+}
+
+func (g GinContext) Context() context.Context {
+	if g.Gin.Request == nil {
+		return context.Background()
+	}
+	return g.Gin.Request.Context()
+}
+
+func MakeGinHandlerFunc(ch *Chain, lgr Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		run(ch, GinContext{Gin: c}, lgr)
+	}
+}
+
+func AddRoute(engine *gin.Engine, route *Route) {
+	engine.Handle(route.HttpMethod, route.RelativePath, route.Handler())
+}
+
+func (r *Route) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.Run(GinContext{Gin: c})
+	}
+}
+
+func AddWSRoute(engine *gin.Engine, route *WSRoute) {
+	engine.GET(route.RelativePath, route.Handler())
+}
+
+func (r *WSRoute) Handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		r.Run(GinContext{Gin: c})
+	}
+}
@@ -0,0 +1,101 @@
+package rp
+
+import "github.com/gin-gonic/gin"
+
+// RouteGroup registers routes under a shared base path. Every member route runs the group's Prefix chain, then
+// its own Pipe, then the group's Suffix chain, with each chain's output passed in as the next chain's input.
+// Groups can be nested, in which case the parent's chains wrap the child's:
+//
+//	parent.Prefix => child.Prefix => route.Pipe => child.Suffix => parent.Suffix
+//
+// The chains are run one after another rather than linked together, so the same Prefix and Suffix can be
+// shared by every member route.
+type RouteGroup struct {
+	Router *gin.RouterGroup // The wrapped gin group. gin middleware can be attached with Router.Use.
+	Prefix *Chain           // Optional
+	Suffix *Chain           // Optional
+	Logger Logger           // Used by member routes that don't set their own. Inherited by nested groups.
+	parent *RouteGroup
+}
+
+// NewRouteGroup creates a top-level group on the engine.
+func NewRouteGroup(engine *gin.Engine, basePath string, prefix *Chain, suffix *Chain, lgr Logger) *RouteGroup {
+	return &RouteGroup{
+		Router: engine.Group(basePath),
+		Prefix: prefix,
+		Suffix: suffix,
+		Logger: lgr,
+	}
+}
+
+// Group creates a nested group whose base path is relative to g's.
+func (g *RouteGroup) Group(relativePath string, prefix *Chain, suffix *Chain, lgr Logger) *RouteGroup {
+	return &RouteGroup{
+		Router: g.Router.Group(relativePath),
+		Prefix: prefix,
+		Suffix: suffix,
+		Logger: lgr,
+		parent: g,
+	}
+}
+
+// BasePath returns the full path that member routes are relative to.
+func (g *RouteGroup) BasePath() string {
+	return g.Router.BasePath()
+}
+
+// AddRoute registers the route with its RelativePath relative to the group's base path.
+func (g *RouteGroup) AddRoute(route *Route) {
+	chains := g.chains(route.Pipe)
+	lgr := route.Logger
+	if lgr == nil {
+		lgr = g.logger()
+	}
+
+	g.Router.Handle(route.HttpMethod, route.RelativePath, func(c *gin.Context) {
+
+		if lgr != nil {
+			lgr.LogMessage("Starting execution chain...")
+		}
+
+		ctx := GinContext{Gin: c}
+
+		var o any
+		var e *StageError
+		for _, ch := range chains {
+			o, e = execute(ch, o, ctx, lgr)
+			if e != nil {
+				writeJSON(ctx.Writer(), e.Code, e.Obj)
+				return
+			}
+		}
+
+		writeResponse(ctx, o, lgr)
+	})
+}
+
+// chains returns the sequence of chains to run for a member route's pipe, outermost group first.
+func (g *RouteGroup) chains(pipe *Chain) []*Chain {
+	chains := []*Chain{}
+	if pipe != nil {
+		chains = append(chains, pipe)
+	}
+	for grp := g; grp != nil; grp = grp.parent {
+		if grp.Prefix != nil {
+			chains = append([]*Chain{grp.Prefix}, chains...)
+		}
+		if grp.Suffix != nil {
+			chains = append(chains, grp.Suffix)
+		}
+	}
+	return chains
+}
+
+func (g *RouteGroup) logger() Logger {
+	for grp := g; grp != nil; grp = grp.parent {
+		if grp.Logger != nil {
+			return grp.Logger
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package rp
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// trace is a chain that appends name to the []string passed in
+func trace(name string) *Chain {
+	return First(S(name, func(in any, c Context, lgr Logger) (any, error) {
+		list, _ := in.([]string)
+		return append(list, name), nil
+	}))
+}
+
+// respondTrace is a chain that appends name and responds with the []string
+func respondTrace(name string) *Chain {
+	return trace(name).Then(S("respond", func(in any, c Context, lgr Logger) (any, error) {
+		return &Response{Code: http.StatusOK, Obj: in}, nil
+	}))
+}
+
+func TestRouteGroup(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+
+	get := func(engine *gin.Engine, path string) (int, []string, string) {
+		rec := httptest.NewRecorder()
+		engine.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var got []string
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		return rec.Code, got, rec.Body.String()
+	}
+
+	t.Run("order", func(t *testing.T) {
+
+		engine := gin.New()
+		outer := NewRouteGroup(engine, "/api", trace("prefix-outer"), respondTrace("suffix-outer"), nil)
+		inner := outer.Group("/v1", trace("prefix-inner"), trace("suffix-inner"), nil)
+		inner.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/items", Pipe: trace("pipe")})
+		outer.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/status", Pipe: trace("pipe")})
+
+		if inner.BasePath() != "/api/v1" {
+			t.Errorf("BasePath = %q", inner.BasePath())
+		}
+
+		code, got, body := get(engine, "/api/v1/items")
+		want := []string{"prefix-outer", "prefix-inner", "pipe", "suffix-inner", "suffix-outer"}
+		if code != http.StatusOK || !reflect.DeepEqual(got, want) {
+			t.Errorf("nested route = %d %s, want %v", code, body, want)
+		}
+
+		code, got, body = get(engine, "/api/status")
+		want = []string{"prefix-outer", "pipe", "suffix-outer"}
+		if code != http.StatusOK || !reflect.DeepEqual(got, want) {
+			t.Errorf("outer route = %d %s, want %v", code, body, want)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+
+		engine := gin.New()
+		outer := NewRouteGroup(engine, "/api", trace("prefix-outer"), respondTrace("suffix-outer"), nil)
+		inner := outer.Group("/v1", First(S("auth", func(in any, c Context, lgr Logger) (any, error) {
+			return nil, errors.New("unauthorized")
+		})).Catch(http.StatusUnauthorized, "Unauthorized"), nil, nil)
+		inner.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/items", Pipe: First(S("pipe", func(in any, c Context, lgr Logger) (any, error) {
+			t.Error("pipe ran after a failed prefix")
+			return in, nil
+		}))})
+
+		code, _, body := get(engine, "/api/v1/items")
+		if code != http.StatusUnauthorized || body != `{"error":"Unauthorized"}` {
+			t.Errorf("response = %d %s", code, body)
+		}
+	})
+
+	t.Run("logger", func(t *testing.T) {
+
+		engine := gin.New()
+		outerLgr, innerLgr, routeLgr := &recordLogger{}, &recordLogger{}, &recordLogger{}
+
+		outer := NewRouteGroup(engine, "/api", trace("prefix-outer"), respondTrace("suffix-outer"), outerLgr)
+		inherits := outer.Group("/a", trace("prefix-inner"), nil, nil)
+		overrides := outer.Group("/b", trace("prefix-inner"), nil, innerLgr)
+
+		inherits.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/inherited", Pipe: trace("inherited")})
+		overrides.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/group", Pipe: trace("group")})
+		overrides.AddRoute(&Route{HttpMethod: http.MethodGet, RelativePath: "/route", Pipe: trace("route"), Logger: routeLgr})
+
+		for _, path := range []string{"/api/a/inherited", "/api/b/group", "/api/b/route"} {
+			if code, _, body := get(engine, path); code != http.StatusOK {
+				t.Fatalf("%s = %d %s", path, code, body)
+			}
+		}
+
+		// Every chain of a route, the group's included, is logged by the route's logger
+		for _, tt := range []struct {
+			name string
+			lgr  *recordLogger
+			want []string
+		}{
+			{"outer group's", outerLgr, []string{"prefix-outer", "prefix-inner", "inherited", "suffix-outer", "respond"}},
+			{"inner group's", innerLgr, []string{"prefix-outer", "prefix-inner", "group", "suffix-outer", "respond"}},
+			{"route's", routeLgr, []string{"prefix-outer", "prefix-inner", "route", "suffix-outer", "respond"}},
+		} {
+			if got := tt.lgr.started(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("%s logger logged %v, want %v", tt.name, got, tt.want)
+			}
+			if len(tt.lgr.messages) != 1 || tt.lgr.messages[0] != "Starting execution chain..." {
+				t.Errorf("%s logger messages = %v", tt.name, tt.lgr.messages)
+			}
+		}
+	})
+}
@@ -0,0 +1,63 @@
+package rp
+
+import (
+	"context"
+	"net/http"
+)
+
+// ParamFunc looks up a path parameter of r by name. chi.URLParam is one.
+type ParamFunc func(r *http.Request, key string) string
+
+// HTTPContext adapts a plain net/http request to the Context interface, with its own key/value store.
+type HTTPContext struct {
+	Keys
+	w      http.ResponseWriter
+	r      *http.Request
+	params ParamFunc
+}
+
+// NewHTTPContext creates a Context for the request. params is optional and is used by Param.
+func NewHTTPContext(w http.ResponseWriter, r *http.Request, params ParamFunc) *HTTPContext {
+	return &HTTPContext{
+		w:      w,
+		r:      r,
+		params: params,
+	}
+}
+
+func (h *HTTPContext) Request() *http.Request {
+	return h.r
+}
+
+func (h *HTTPContext) Writer() http.ResponseWriter {
+	return h.w
+}
+
+func (h *HTTPContext) Param(key string) string {
+	if h.params == nil {
+		return ""
+	}
+	return h.params(h.r, key)
+}
+
+func (h *HTTPContext) Context() context.Context {
+	return h.r.Context()
+}
+
+// HTTPHandler creates an http.Handler that runs the chain and writes its response.
+// params is optional and is used to look up path parameters.
+func HTTPHandler(ch *Chain, lgr Logger, params ParamFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		run(ch, NewHTTPContext(w, r, params), lgr)
+	})
+}
+
+// ServeHTTP lets a Route be used directly as an http.Handler. Param always returns "" since net/http
+// has no path parameters of its own. Use HTTPHandler to supply them.
+func (r *Route) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Run(NewHTTPContext(w, req, nil))
+}
+
+func (r *WSRoute) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.Run(NewHTTPContext(w, req, nil))
+}
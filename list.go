@@ -0,0 +1,272 @@
+package rp
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FilterType is the type that a list filter's query parameter is parsed into.
+type FilterType int
+
+const (
+	FilterString FilterType = iota
+	FilterInt
+	FilterFloat
+	FilterBool
+	FilterTime
+)
+
+// ListSpec defines the query parameters that a list endpoint accepts. See ParseListQuery.
+type ListSpec struct {
+	DefaultLimit int                   // Default is 20
+	MaxLimit     int                   // Default is 100
+	SortFields   []string              // Fields that can be sorted on. Sorting on anything else is an error.
+	DefaultSort  string                // Used when there's no sort parameter, in the same format, like "-created_at"
+	Filters      map[string]FilterType // Fields that can be filtered on, and their types
+	SortTypes    map[string]FilterType // Types of sort fields that aren't in Filters, for parsing cursors
+	TimeLayout   string                // Layout of FilterTime values. Default is time.RFC3339.
+	Cursor       bool                  // If true, use cursor pagination instead of page numbers
+}
+
+// CursorTimeLayout is the layout of FilterTime cursors, whatever the ListSpec's TimeLayout, so that the
+// cursors that list stages like rpmongo.MongoList emit can be parsed back.
+const CursorTimeLayout = time.RFC3339Nano
+
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// QueryFilter is one condition on a field. Value has the Go type of the field's FilterType: string, int, float64,
+// bool or time.Time. For the "in" operator, Value is a []any of them.
+type QueryFilter struct {
+	Field string
+	Op    string // "eq", "ne", "gt", "gte", "lt", "lte" or "in"
+	Value any
+}
+
+// ListQuery is the normalized form of a list endpoint's query parameters.
+type ListQuery struct {
+	Limit   int
+	Page    int // Starts at 1. Always 0 with cursor pagination.
+	Offset  int // Number of items before the page, (Page - 1) * Limit. Always 0 with cursor pagination.
+	Cursor  any // Value of the first sort field of the previous page's last item. nil for the first page.
+	Sort    []SortField
+	Filters []QueryFilter
+}
+
+var filterOps = []string{"eq", "ne", "gt", "gte", "lt", "lte", "in"}
+
+// ParseListQuery parses the query parameters of a list endpoint into a *ListQuery. It accepts:
+//
+//	?limit=20               Page size, up to spec.MaxLimit
+//	?page=2                 Page number, for offset pagination
+//	?cursor=...             Value of the sort field of the previous page's last item, for cursor pagination
+//	?sort=-created_at,name  Comma-separated fields from spec.SortFields. A leading "-" sorts descending.
+//	?status=shipped         Equality filter on a field from spec.Filters. Comma-separated values match any of them.
+//	?price[gte]=100         Filter with an operator: ne, gt, gte, lt, lte or in
+//
+// With cursor pagination, only one sort field is allowed, and it should be unique, such as _id. The cursor is
+// parsed into the sort field's type from Filters or SortTypes, so it compares correctly with the stored values,
+// and ParseListQuery panics if a sort field other than _id has no type. Invalid parameters are 400 errors that
+// name the parameter.
+func ParseListQuery(spec ListSpec) *Stage {
+
+	if spec.Cursor {
+		fields := append([]string{}, spec.SortFields...)
+		if spec.DefaultSort != "" {
+			fields = append(fields, strings.TrimPrefix(spec.DefaultSort, "-"))
+		}
+		for _, field := range fields {
+			if _, ok := sortType(spec, field); !ok && field != "_id" {
+				panic("rp.ParseListQuery: cursor pagination needs the type of sort field " + field + " in Filters or SortTypes")
+			}
+		}
+	}
+
+	if spec.DefaultLimit <= 0 {
+		spec.DefaultLimit = 20
+	}
+	if spec.MaxLimit <= 0 {
+		spec.MaxLimit = 100
+	}
+	if spec.TimeLayout == "" {
+		spec.TimeLayout = time.RFC3339
+	}
+
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query.(ListQuery) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			if c.Request() == nil {
+				return nil, ErrNoRequest
+			}
+			values := c.Request().URL.Query()
+
+			q := &ListQuery{
+				Limit: spec.DefaultLimit,
+			}
+
+			if val := values.Get("limit"); val != "" {
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 1 || n > spec.MaxLimit {
+					return nil, ParamError{Param: "limit", Reason: "must be an integer from 1 to " + strconv.Itoa(spec.MaxLimit)}
+				}
+				q.Limit = n
+			}
+
+			sortParam := values.Get("sort")
+			if sortParam == "" {
+				sortParam = spec.DefaultSort
+			}
+			for _, field := range strings.Split(sortParam, ",") {
+				field = strings.TrimSpace(field)
+				if field == "" {
+					continue
+				}
+				sf := SortField{Field: strings.TrimPrefix(field, "-"), Desc: strings.HasPrefix(field, "-")}
+				if !contains(spec.SortFields, sf.Field) && sortParam != spec.DefaultSort {
+					return nil, ParamError{Param: "sort", Reason: "cannot sort by " + sf.Field}
+				}
+				q.Sort = append(q.Sort, sf)
+			}
+
+			if spec.Cursor {
+				if len(q.Sort) > 1 {
+					return nil, ParamError{Param: "sort", Reason: "must be a single field"}
+				}
+				if len(q.Sort) == 0 {
+					q.Sort = []SortField{{Field: "_id"}}
+				}
+				if val := values.Get("cursor"); val != "" {
+					q.Cursor = val
+					if t, ok := sortType(spec, q.Sort[0].Field); ok {
+						cursor, err := parseFilterValue(val, t, CursorTimeLayout)
+						if err != nil {
+							return nil, ParamError{Param: "cursor", Reason: err.Error()}
+						}
+						q.Cursor = cursor
+					}
+				}
+			} else {
+				q.Page = 1
+				if val := values.Get("page"); val != "" {
+					n, err := strconv.Atoi(val)
+					if err != nil || n < 1 {
+						return nil, ParamError{Param: "page", Reason: "must be a positive integer"}
+					}
+					q.Page = n
+				}
+				q.Offset = (q.Page - 1) * q.Limit
+			}
+
+			// In a stable order, so that the same query always gives the same Filters
+			params := make([]string, 0, len(values))
+			for param := range values {
+				params = append(params, param)
+			}
+			sort.Strings(params)
+
+			for _, param := range params {
+				vals := values[param]
+
+				field, op := param, "eq"
+				if i := strings.Index(param, "["); i > 0 && strings.HasSuffix(param, "]") {
+					field, op = param[:i], param[i+1:len(param)-1]
+				}
+
+				t, ok := spec.Filters[field]
+				if !ok {
+					continue
+				}
+				if !contains(filterOps, op) {
+					return nil, ParamError{Param: param, Reason: "unknown operator " + op}
+				}
+
+				for _, val := range vals {
+					f := QueryFilter{Field: field, Op: op}
+					if op == "eq" && strings.Contains(val, ",") {
+						f.Op = "in"
+					}
+					if f.Op == "in" {
+						list := []any{}
+						for _, item := range strings.Split(val, ",") {
+							v, err := parseFilterValue(strings.TrimSpace(item), t, spec.TimeLayout)
+							if err != nil {
+								return nil, ParamError{Param: param, Reason: err.Error()}
+							}
+							list = append(list, v)
+						}
+						f.Value = list
+					} else {
+						v, err := parseFilterValue(val, t, spec.TimeLayout)
+						if err != nil {
+							return nil, ParamError{Param: param, Reason: err.Error()}
+						}
+						f.Value = v
+					}
+					q.Filters = append(q.Filters, f)
+				}
+			}
+
+			return q, nil
+		},
+
+		E: paramError,
+	}
+}
+
+// sortType returns the type of a sort field, from Filters or SortTypes
+func sortType(spec ListSpec, field string) (FilterType, bool) {
+	if t, ok := spec.Filters[field]; ok {
+		return t, true
+	}
+	t, ok := spec.SortTypes[field]
+	return t, ok
+}
+
+func parseFilterValue(val string, t FilterType, timeLayout string) (any, error) {
+	switch t {
+	case FilterInt:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, errors.New("must be an integer")
+		}
+		return n, nil
+	case FilterFloat:
+		f, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return nil, errors.New("must be a number")
+		}
+		return f, nil
+	case FilterBool:
+		b, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, errors.New("must be true or false")
+		}
+		return b, nil
+	case FilterTime:
+		tm, err := time.Parse(timeLayout, val)
+		if err != nil {
+			return nil, errors.New("must be a time formatted as " + timeLayout)
+		}
+		return tm, nil
+	}
+	return val, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
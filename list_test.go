@@ -0,0 +1,169 @@
+package rp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listQuery runs ParseListQuery(spec) on a request with the given query string
+func listQuery(spec ListSpec, query string) (*ListQuery, *StageError) {
+	req := httptest.NewRequest(http.MethodGet, "/list?"+query, nil)
+	out, e := Execute(First(ParseListQuery(spec)), NewHTTPContext(httptest.NewRecorder(), req, nil), nil)
+	if e != nil {
+		return nil, e
+	}
+	return out.(*ListQuery), nil
+}
+
+func TestParseListQuery(t *testing.T) {
+
+	spec := ListSpec{
+		DefaultLimit: 10,
+		MaxLimit:     50,
+		SortFields:   []string{"created_at", "price"},
+		DefaultSort:  "-created_at",
+		Filters: map[string]FilterType{
+			"status":     FilterString,
+			"quantity":   FilterInt,
+			"price":      FilterFloat,
+			"paid":       FilterBool,
+			"created_at": FilterTime,
+		},
+	}
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		query string
+		want  ListQuery
+	}{
+		{"defaults", "",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"created_at", true}}}},
+		{"page and limit", "page=3&limit=50",
+			ListQuery{Limit: 50, Page: 3, Offset: 100, Sort: []SortField{{"created_at", true}}}},
+		{"sort", "sort=price,-created_at",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"price", false}, {"created_at", true}}}},
+		{"typed filters", "status=shipped&quantity[gte]=2&price[lt]=9.5&paid=true&created_at[gt]=2024-05-01T00:00:00Z",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"created_at", true}}, Filters: []QueryFilter{
+				{"created_at", "gt", day},
+				{"paid", "eq", true},
+				{"price", "lt", 9.5},
+				{"quantity", "gte", 2},
+				{"status", "eq", "shipped"},
+			}}},
+		{"in", "status=shipped,%20paid&quantity[in]=1,2",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"created_at", true}}, Filters: []QueryFilter{
+				{"quantity", "in", []any{1, 2}},
+				{"status", "in", []any{"shipped", "paid"}},
+			}}},
+		{"repeated filter", "quantity[gt]=1&quantity[lt]=5",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"created_at", true}}, Filters: []QueryFilter{
+				{"quantity", "gt", 1},
+				{"quantity", "lt", 5},
+			}}},
+		{"unknown parameters are ignored", "color=red&debug[x]=1",
+			ListQuery{Limit: 10, Page: 1, Sort: []SortField{{"created_at", true}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, e := listQuery(spec, tt.query)
+			if e != nil {
+				t.Fatalf("error: %v", e.Obj)
+			}
+			if !reflect.DeepEqual(*q, tt.want) {
+				t.Errorf("got  %+v\nwant %+v", *q, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseListQueryErrors(t *testing.T) {
+
+	spec := ListSpec{
+		MaxLimit:   50,
+		SortFields: []string{"price"},
+		Filters:    map[string]FilterType{"quantity": FilterInt, "paid": FilterBool, "created_at": FilterTime},
+		TimeLayout: "2006-01-02",
+	}
+
+	tests := []struct {
+		query  string
+		param  string
+		reason string
+	}{
+		{"limit=0", "limit", "must be an integer from 1 to 50"},
+		{"limit=51", "limit", "must be an integer from 1 to 50"},
+		{"limit=ten", "limit", "must be an integer from 1 to 50"},
+		{"page=0", "page", "must be a positive integer"},
+		{"sort=name", "sort", "cannot sort by name"},
+		{"sort=price,-secret", "sort", "cannot sort by secret"},
+		{"quantity=two", "quantity", "must be an integer"},
+		{"quantity[in]=1,x", "quantity[in]", "must be an integer"},
+		{"quantity[like]=1", "quantity[like]", "unknown operator like"},
+		{"paid=maybe", "paid", "must be true or false"},
+		{"created_at[gt]=2024-05-01T00:00:00Z", "created_at[gt]", "must be a time formatted as 2006-01-02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, e := listQuery(spec, tt.query)
+			if e == nil {
+				t.Fatal("no error")
+			}
+			want := "Invalid query parameter \"" + tt.param + "\": " + tt.reason
+			if obj := e.Obj.(H); e.Code != BR || obj["param"] != tt.param || obj["error"] != want {
+				t.Errorf("got %d %v, want %q", e.Code, obj, want)
+			}
+		})
+	}
+}
+
+func TestParseListQueryCursor(t *testing.T) {
+
+	spec := ListSpec{
+		SortFields: []string{"created_at", "seq", "_id"},
+		Filters:    map[string]FilterType{"seq": FilterInt},
+		SortTypes:  map[string]FilterType{"created_at": FilterTime},
+		TimeLayout: "2006-01-02", // Cursors use CursorTimeLayout regardless
+		Cursor:     true,
+	}
+
+	q, e := listQuery(spec, "")
+	if e != nil || q.Page != 0 || q.Offset != 0 || q.Cursor != nil || !reflect.DeepEqual(q.Sort, []SortField{{Field: "_id"}}) {
+		t.Errorf("first page = %+v, %v", q, e)
+	}
+
+	q, e = listQuery(spec, "sort=-created_at&cursor=2024-05-01T10:20:30.123456789Z&page=4")
+	want := time.Date(2024, 5, 1, 10, 20, 30, 123456789, time.UTC)
+	if e != nil || q.Cursor != want || q.Page != 0 {
+		t.Errorf("time cursor = %+v, %v", q, e)
+	}
+
+	q, e = listQuery(spec, "sort=seq&cursor=42")
+	if e != nil || q.Cursor != 42 {
+		t.Errorf("int cursor = %+v, %v", q, e)
+	}
+
+	q, e = listQuery(spec, "cursor=5f1d7f1b9d1e8a0001a1b2c3")
+	if e != nil || q.Cursor != "5f1d7f1b9d1e8a0001a1b2c3" {
+		t.Errorf("_id cursor = %+v, %v", q, e)
+	}
+
+	if _, e = listQuery(spec, "sort=seq,created_at"); e == nil || e.Obj.(H)["param"] != "sort" {
+		t.Errorf("two sort fields = %v", e)
+	}
+	if _, e = listQuery(spec, "sort=seq&cursor=x"); e == nil || e.Obj.(H)["error"] != "Invalid query parameter \"cursor\": must be an integer" {
+		t.Errorf("bad cursor = %v", e)
+	}
+
+	// Cursor pagination can't work without the sort field's type
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "sort field name") {
+			t.Errorf("panic = %v", r)
+		}
+	}()
+	ParseListQuery(ListSpec{SortFields: []string{"name"}, Cursor: true})
+}
@@ -330,7 +330,7 @@ func wrapSubsection(src string) string {
 //
 //	fetchCustomer := MakeChain(S(
 //		FuncStr("fetch_customer", "req.body")+CtxOutStr("mongo.document.customer"),
-//		func(in any, c *gin.Context, lgr Logger) (any, error) {
+//		func(in any, c Context, lgr Logger) (any, error) {
 //
 //			body := c.MustGet("req.body").(*PurchaseRequestBody)
 //
@@ -355,7 +355,7 @@ func MigrateToRP(src string, ctxDependencies []string, ctxOutputs []string, ctxO
 	// Define a template for the migration
 	tmpl := `{{.StageName}} := MakeChain(S(
 		{{.FuncStr}}+{{.CtxOutStr}},
-		func(in any, c *gin.Context, lgr Logger) (any, error) {
+		func(in any, c Context, lgr Logger) (any, error) {
 
 			{{.Body}}
 
@@ -0,0 +1,21 @@
+package rpchi
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jeremywhuff/rp"
+)
+
+// chi routes plain net/http handlers, so the only thing it adds over rp.HTTPHandler is its path parameters.
+// Note that chi writes path parameters as "/orders/{id}" rather than gin's "/orders/:id".
+
+// AddRoute registers the route on the chi router.
+func AddRoute(router chi.Router, route *rp.Route) {
+	router.Method(route.HttpMethod, route.RelativePath, Handler(route))
+}
+
+// Handler creates an http.Handler that runs the route with chi's URL parameters available to Param.
+func Handler(route *rp.Route) http.Handler {
+	return rp.HTTPHandler(route.Pipe, route.Logger, chi.URLParam)
+}
@@ -0,0 +1,62 @@
+package rpecho
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jeremywhuff/rp"
+	"github.com/labstack/echo/v4"
+)
+
+// EchoContext adapts an echo.Context to the rp.Context interface. Values set by echo middleware with c.Set
+// are visible to stages, and vice versa. Since echo's store has no "exists" flag, a key set to nil is
+// reported as missing.
+type EchoContext struct {
+	Echo echo.Context
+}
+
+func (e EchoContext) Request() *http.Request {
+	return e.Echo.Request()
+}
+
+func (e EchoContext) Writer() http.ResponseWriter {
+	return e.Echo.Response()
+}
+
+func (e EchoContext) Param(key string) string {
+	return e.Echo.Param(key)
+}
+
+func (e EchoContext) Get(key string) (any, bool) {
+	val := e.Echo.Get(key)
+	return val, val != nil
+}
+
+func (e EchoContext) Set(key string, value any) {
+	e.Echo.Set(key, value)
+}
+
+func (e EchoContext) MustGet(key string) any {
+	if val, ok := e.Get(key); ok {
+		return val
+	}
+	panic("Key \"" + key + "\" does not exist")
+}
+
+func (e EchoContext) Context() context.Context {
+	return e.Echo.Request().Context()
+}
+
+// AddRoute registers the route on the echo instance.
+func AddRoute(e *echo.Echo, route *rp.Route) {
+	e.Add(route.HttpMethod, route.RelativePath, Handler(route))
+}
+
+// Handler creates an echo.HandlerFunc that runs the route. The response is always written by rp,
+// including StageErrors, so the returned error is always nil.
+func Handler(route *rp.Route) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		route.Run(EchoContext{Echo: c})
+		return nil
+	}
+}
@@ -0,0 +1,281 @@
+package rpmongo
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoBulkOptions struct {
+	// If true, the remaining writes are attempted after one fails, in any order. Default is false, which
+	// stops at the first failure like the driver does.
+	Unordered bool
+}
+
+// BulkResult is the output of MongoInsertMany and MongoBulkWrite.
+type BulkResult struct {
+	Inserted int64            `json:"inserted"`
+	Matched  int64            `json:"matched"`
+	Modified int64            `json:"modified"`
+	Deleted  int64            `json:"deleted"`
+	Upserted int64            `json:"upserted"`
+	Items    []BulkItemResult `json:"items"` // One per document or write model, in the input's order
+}
+
+// BulkItemResult is the outcome of one write in a bulk operation. Like the responses of a 207 Multi-Status,
+// each one has its own HTTP status code: 201 for inserts and upserts, 200 for other successful writes,
+// 409, 400 or 500 for failures, and 424 for writes that weren't attempted because an earlier one failed in an
+// ordered operation.
+type BulkItemResult struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	ID     any    `json:"id,omitempty"` // _id of the inserted or upserted document
+	Error  string `json:"error,omitempty"`
+}
+
+// PartialWriteError is returned by MongoInsertMany and MongoBulkWrite when some of the writes fail. It becomes
+// a 207 response with the BulkResult, like {"error": "...", "result": {"inserted": 8, "items": [...]}}.
+type PartialWriteError struct {
+	Result *BulkResult
+	Err    error // The driver's mongo.BulkWriteException
+}
+
+func (e PartialWriteError) Error() string {
+	return e.Err.Error()
+}
+
+func (e PartialWriteError) Unwrap() error {
+	return e.Err
+}
+
+// bulkError is the E function of the bulk stages
+func bulkError(name string) func(error) *StageError {
+	return func(err error) *StageError {
+		var pe PartialWriteError
+		if errors.As(err, &pe) {
+			failed := 0
+			for _, item := range pe.Result.Items {
+				if item.Status >= 300 && item.Status != http.StatusFailedDependency {
+					failed++
+				}
+			}
+			return &StageError{
+				Code: http.StatusMultiStatus,
+				Obj: H{
+					"error":  fmt.Sprintf("%s: %d of %d writes failed", name, failed, len(pe.Result.Items)),
+					"result": pe.Result,
+				},
+			}
+		}
+		return mongoError(name)(err)
+	}
+}
+
+// writeErrorStatus maps a write error's server code to an HTTP status, like mongoError does
+func writeErrorStatus(code int) int {
+	switch code {
+	case 11000, 11001, 12582:
+		return http.StatusConflict
+	case documentValidationFailure:
+		return BR
+	}
+	return ISR
+}
+
+// toSlice returns the items of in, which must be a slice
+func toSlice(in any) ([]any, error) {
+	if list, ok := in.([]any); ok {
+		return list, nil
+	}
+	rv := reflect.ValueOf(in)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected a slice, got %T", in)
+	}
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, nil
+}
+
+// bulkItems creates the per-write results from the driver's error. okStatus gives the status of each write
+// that succeeded.
+func bulkItems(n int, err error, ordered bool, okStatus func(i int) int) ([]BulkItemResult, error) {
+
+	items := make([]BulkItemResult, n)
+	for i := range items {
+		items[i] = BulkItemResult{Index: i, Status: okStatus(i)}
+	}
+	if err == nil {
+		return items, nil
+	}
+
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) == 0 {
+		return nil, err
+	}
+
+	firstFailed := n
+	for _, we := range bwe.WriteErrors {
+		if we.Index < 0 || we.Index >= n {
+			continue
+		}
+		items[we.Index].Status = writeErrorStatus(we.Code)
+		items[we.Index].Error = we.Message
+		items[we.Index].ID = nil
+		if we.Index < firstFailed {
+			firstFailed = we.Index
+		}
+	}
+	if ordered {
+		for i := firstFailed + 1; i < n; i++ {
+			items[i] = BulkItemResult{Index: i, Status: http.StatusFailedDependency, Error: "Not attempted"}
+		}
+	}
+	return items, nil
+}
+
+// MongoInsertMany inserts the documents of in, which must be a slice, and outputs a *BulkResult with the _id
+// of each one. If some of them fail, it is a PartialWriteError, which becomes a 207 response with the result
+// of each document.
+func MongoInsertMany(db *Provider, collectionName string, opts ...MongoBulkOptions) *Stage {
+
+	opt := MongoBulkOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoInsertMany(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			docs, err := toSlice(in)
+			if err != nil {
+				return nil, err
+			}
+			if len(docs) == 0 {
+				return &BulkResult{Items: []BulkItemResult{}}, nil
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			res, err := coll.InsertMany(c.Context(), docs, options.InsertMany().SetOrdered(!opt.Unordered))
+			if res == nil {
+				return nil, err
+			}
+
+			items, itemsErr := bulkItems(len(docs), err, !opt.Unordered, func(i int) int { return http.StatusCreated })
+			if itemsErr != nil {
+				return nil, itemsErr
+			}
+
+			result := &BulkResult{Items: items}
+			for i := range items {
+				if items[i].Status == http.StatusCreated {
+					if i < len(res.InsertedIDs) {
+						items[i].ID = res.InsertedIDs[i]
+					}
+					result.Inserted++
+				}
+			}
+
+			if err != nil {
+				return nil, PartialWriteError{Result: result, Err: err}
+			}
+			return result, nil
+		},
+
+		E: bulkError("MongoInsertMany"),
+	}, collectionName, false)
+}
+
+// MongoBulkWrite runs the write models of in, which must be a slice of mongo.WriteModel such as
+// *mongo.InsertOneModel and *mongo.UpdateOneModel, and outputs a *BulkResult. If some of them fail, it is a
+// PartialWriteError, which becomes a 207 response with the result of each write.
+func MongoBulkWrite(db *Provider, collectionName string, opts ...MongoBulkOptions) *Stage {
+
+	opt := MongoBulkOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoBulkWrite(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			list, err := toSlice(in)
+			if err != nil {
+				return nil, err
+			}
+			models := make([]mongo.WriteModel, len(list))
+			for i, item := range list {
+				m, ok := item.(mongo.WriteModel)
+				if !ok {
+					return nil, fmt.Errorf("item %d: expected a mongo.WriteModel, got %T", i, item)
+				}
+				models[i] = m
+			}
+			if len(models) == 0 {
+				return &BulkResult{Items: []BulkItemResult{}}, nil
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			res, err := coll.BulkWrite(c.Context(), models, options.BulkWrite().SetOrdered(!opt.Unordered))
+			if res == nil {
+				return nil, err
+			}
+
+			items, itemsErr := bulkItems(len(models), err, !opt.Unordered, func(i int) int {
+				if _, ok := models[i].(*mongo.InsertOneModel); ok {
+					return http.StatusCreated
+				}
+				if _, ok := res.UpsertedIDs[int64(i)]; ok {
+					return http.StatusCreated
+				}
+				return http.StatusOK
+			})
+			if itemsErr != nil {
+				return nil, itemsErr
+			}
+			for i := range items {
+				if id, ok := res.UpsertedIDs[int64(i)]; ok && items[i].Status == http.StatusCreated {
+					items[i].ID = id
+				}
+			}
+
+			result := &BulkResult{
+				Inserted: res.InsertedCount,
+				Matched:  res.MatchedCount,
+				Modified: res.ModifiedCount,
+				Deleted:  res.DeletedCount,
+				Upserted: res.UpsertedCount,
+				Items:    items,
+			}
+
+			if err != nil {
+				return nil, PartialWriteError{Result: result, Err: err}
+			}
+			return result, nil
+		},
+
+		E: bulkError("MongoBulkWrite"),
+	}, collectionName, false)
+}
@@ -0,0 +1,361 @@
+package rpmongo
+
+import (
+	"errors"
+	"net/http"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoUpdate is the input of MongoUpdateOne, MongoUpdateMany and MongoUpsert.
+type MongoUpdate struct {
+	Filter any
+	Update any // Update document, like bson.M{"$set": ...}, or an update pipeline
+}
+
+// MongoReplace is the input of MongoReplaceOne.
+type MongoReplace struct {
+	Filter      any
+	Replacement any
+}
+
+// documentValidationFailure is the server error code for a write that fails the collection's schema validation
+const documentValidationFailure = 121
+
+// mongoError is the E function of the rpmongo stages. It maps driver errors to responses consistently:
+// mongo.ErrNoDocuments is a 404, a duplicate key is a 409, a document that fails schema validation is a 400,
+// and anything else is a 500.
+func mongoError(name string) func(error) *StageError {
+	return func(err error) *StageError {
+
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return &StageError{
+				Code: http.StatusNotFound,
+				Obj:  H{"error": name + ": Document not found"},
+			}
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return &StageError{
+				Code: http.StatusConflict,
+				Obj:  H{"error": name + ": Duplicate key"},
+			}
+		}
+		var se mongo.ServerError
+		if errors.As(err, &se) && se.HasErrorCode(documentValidationFailure) {
+			return &StageError{
+				Code: BR,
+				Obj:  H{"error": name + ": Document failed validation"},
+			}
+		}
+
+		return &StageError{
+			Code: ISR,
+			Obj:  H{"error": name + ": " + err.Error()},
+		}
+	}
+}
+
+// readFilter returns in as a filter for reads, where nil matches every document
+func readFilter(in any) any {
+	if in == nil {
+		return bson.D{}
+	}
+	return in
+}
+
+func updateInput(in any) (*MongoUpdate, error) {
+	switch u := in.(type) {
+	case MongoUpdate:
+		return &u, nil
+	case *MongoUpdate:
+		return u, nil
+	}
+	return nil, errors.New("expected rpmongo.MongoUpdate as input")
+}
+
+// MongoUpdateOne updates the first document that matches in.Filter with in.Update, where in must be a
+// MongoUpdate, and outputs the *mongo.UpdateResult. It is a 404 error if no document matches.
+func MongoUpdateOne(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoUpdateOne(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			u, err := updateInput(in)
+			if err != nil {
+				return nil, err
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			result, err := coll.UpdateOne(c.Context(), u.Filter, u.Update)
+			if err != nil {
+				return nil, err
+			}
+			if result.MatchedCount == 0 {
+				return nil, mongo.ErrNoDocuments
+			}
+			return result, nil
+		},
+
+		E: mongoError("MongoUpdateOne"),
+	}, collectionName, true)
+}
+
+// MongoUpdateMany updates every document that matches in.Filter with in.Update, where in must be a
+// MongoUpdate, and outputs the *mongo.UpdateResult.
+func MongoUpdateMany(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoUpdateMany(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			u, err := updateInput(in)
+			if err != nil {
+				return nil, err
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			return coll.UpdateMany(c.Context(), u.Filter, u.Update)
+		},
+
+		E: mongoError("MongoUpdateMany"),
+	}, collectionName, true)
+}
+
+// MongoUpsert updates the first document that matches in.Filter with in.Update, or inserts one if none
+// matches, where in must be a MongoUpdate. It outputs the *mongo.UpdateResult, whose UpsertedID is set if a
+// document was inserted.
+func MongoUpsert(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoUpsert(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			u, err := updateInput(in)
+			if err != nil {
+				return nil, err
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			return coll.UpdateOne(c.Context(), u.Filter, u.Update, options.Update().SetUpsert(true))
+		},
+
+		E: mongoError("MongoUpsert"),
+	}, collectionName, true)
+}
+
+// MongoReplaceOne replaces the first document that matches in.Filter with in.Replacement, where in must be a
+// MongoReplace, and outputs the *mongo.UpdateResult. It is a 404 error if no document matches.
+func MongoReplaceOne(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoReplaceOne(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			var r MongoReplace
+			switch v := in.(type) {
+			case MongoReplace:
+				r = v
+			case *MongoReplace:
+				r = *v
+			default:
+				return nil, errors.New("expected rpmongo.MongoReplace as input")
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			result, err := coll.ReplaceOne(c.Context(), r.Filter, r.Replacement)
+			if err != nil {
+				return nil, err
+			}
+			if result.MatchedCount == 0 {
+				return nil, mongo.ErrNoDocuments
+			}
+			return result, nil
+		},
+
+		E: mongoError("MongoReplaceOne"),
+	}, collectionName, true)
+}
+
+// MongoDeleteOne deletes the first document that matches the filter passed in as in, and outputs the
+// *mongo.DeleteResult. It is a 404 error if no document matches.
+func MongoDeleteOne(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoDeleteOne(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			result, err := coll.DeleteOne(c.Context(), in)
+			if err != nil {
+				return nil, err
+			}
+			if result.DeletedCount == 0 {
+				return nil, mongo.ErrNoDocuments
+			}
+			return result, nil
+		},
+
+		E: mongoError("MongoDeleteOne"),
+	}, collectionName, true)
+}
+
+// MongoDeleteMany deletes every document that matches the filter passed in as in, and outputs the
+// *mongo.DeleteResult. A nil filter is an error rather than deleting the whole collection; use bson.D{} for that.
+func MongoDeleteMany(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoDeleteMany(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			if in == nil {
+				return nil, errors.New("filter is nil")
+			}
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			return coll.DeleteMany(c.Context(), in)
+		},
+
+		E: mongoError("MongoDeleteMany"),
+	}, collectionName, true)
+}
+
+type MongoFindOptions struct {
+	// Sort order, like bson.D{{"created_at", -1}}. Default is nil, the natural order.
+	Sort any
+	// Maximum number of documents. Default is 0, which means no limit.
+	Limit int64
+	// Number of documents to skip. Default is 0.
+	Skip int64
+	// If non-nil, only these fields are returned, like bson.M{"name": 1}. Default is nil.
+	Projection any
+}
+
+// MongoFind outputs every document that matches the filter passed in as in, as a []map[string]any.
+// A nil filter matches every document.
+func MongoFind(db *Provider, collectionName string, opts ...MongoFindOptions) *Stage {
+
+	findOpts := options.Find()
+	if len(opts) > 0 {
+		if opts[0].Sort != nil {
+			findOpts.SetSort(opts[0].Sort)
+		}
+		if opts[0].Limit > 0 {
+			findOpts.SetLimit(opts[0].Limit)
+		}
+		if opts[0].Skip > 0 {
+			findOpts.SetSkip(opts[0].Skip)
+		}
+		if opts[0].Projection != nil {
+			findOpts.SetProjection(opts[0].Projection)
+		}
+	}
+
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoFind(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			cur, err := coll.Find(c.Context(), readFilter(in), findOpts)
+			if err != nil {
+				return nil, err
+			}
+			defer cur.Close(c.Context())
+
+			results := make([]map[string]any, 0)
+			if err = cur.All(c.Context(), &results); err != nil {
+				return nil, err
+			}
+			return results, nil
+		},
+
+		E: mongoError("MongoFind"),
+	}, collectionName, true)
+}
+
+// MongoCount outputs the number of documents that match the filter passed in as in, as an int64.
+// A nil filter counts every document.
+func MongoCount(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoCount(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			return coll.CountDocuments(c.Context(), readFilter(in))
+		},
+
+		E: mongoError("MongoCount"),
+	}, collectionName, true)
+}
+
+// MongoDistinct outputs the distinct values of field among the documents that match the filter passed in as
+// in, as a []any. A nil filter matches every document.
+func MongoDistinct(db *Provider, collectionName string, field string) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoDistinct(\"" + collectionName + "\", \"" + field + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+			return coll.Distinct(c.Context(), field, readFilter(in))
+		},
+
+		E: mongoError("MongoDistinct"),
+	}, collectionName, true)
+}
@@ -0,0 +1,174 @@
+package rpmongo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// Index is an index that a stage's queries rely on, declared with Indexed.
+type Index struct {
+	Keys   bson.D // Like bson.D{{"customer_id", 1}}
+	Unique bool
+}
+
+// Ascending is an Index on fields in ascending order, like Ascending("customer_id").
+func Ascending(fields ...string) Index {
+	keys := bson.D{}
+	for _, f := range fields {
+		keys = append(keys, bson.E{Key: f, Value: 1})
+	}
+	return Index{Keys: keys}
+}
+
+// Unique is a unique Index on fields in ascending order, like Unique("sku").
+func Unique(fields ...string) Index {
+	ix := Ascending(fields...)
+	ix.Unique = true
+	return ix
+}
+
+// name returns the index's default name in MongoDB, like "customer_id_1"
+func (ix Index) name() string {
+	parts := make([]string, 0, len(ix.Keys)*2)
+	for _, k := range ix.Keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// StageInfo is the Info of every rpmongo stage, which EnsureIndexes reads.
+type StageInfo struct {
+	Collection string
+	Queries    bool    // Whether the stage queries by a filter, so that it needs an index
+	Indexes    []Index // Declared with Indexed
+}
+
+// declare sets s's Info for collectionName and returns s. queries is false for stages that don't filter, like
+// inserts, or that only filter by _id.
+func declare(s *Stage, collectionName string, queries bool) *Stage {
+	s.Info = &StageInfo{Collection: collectionName, Queries: queries}
+	return s
+}
+
+// Indexed declares the indexes that s relies on and returns s, where s is an rpmongo stage, like
+// Indexed(MongoFindOne(db, "customers"), Ascending("customer_id")). EnsureIndexes creates them on the stage's
+// collection. It panics if s is not an rpmongo stage.
+func Indexed(s *Stage, indexes ...Index) *Stage {
+	si, ok := s.Info.(*StageInfo)
+	if !ok {
+		panic("rpmongo.Indexed: " + strings.TrimSpace(s.P()) + " is not an rpmongo stage")
+	}
+	s.Info = &StageInfo{
+		Collection: si.Collection,
+		Queries:    si.Queries,
+		Indexes:    append(append([]Index{}, si.Indexes...), indexes...),
+	}
+	return s
+}
+
+// IndexReport is the output of EnsureIndexes.
+type IndexReport struct {
+	Created   []string // Indexes that were missing and created, like "customers.customer_id_1"
+	Unindexed []string // Stages that query without a declared index, like `POST /purchase: MongoFind("orders")`
+}
+
+// IndexDatabase is a Database that can list and create the indexes of its collections, which EnsureIndexes
+// needs. Databases adapted with Driver implement it, as does MemoryDatabase.
+type IndexDatabase interface {
+	Database
+	ListIndexes(ctx context.Context, collectionName string) ([]Index, error)
+	CreateIndexes(ctx context.Context, collectionName string, indexes []Index) error
+}
+
+// EnsureIndexes walks the pipelines of routes, including nested chains such as those of InParallel, If and
+// MongoTransaction, and creates the indexes that their rpmongo stages declare with Indexed in db, if they
+// don't exist yet. Run it at startup, like EnsureIndexes(Driver(client.Database("shop")), routes...). The
+// report lists what was created and the stages whose queries have no declared index, which scan their
+// collection unless an index was created elsewhere. db must be an IndexDatabase.
+func EnsureIndexes(db Database, routes ...*Route) (*IndexReport, error) {
+
+	idb, ok := db.(IndexDatabase)
+	if !ok {
+		return nil, fmt.Errorf("rpmongo.EnsureIndexes: %T can't list or create indexes", db)
+	}
+
+	ctx := context.Background()
+	report := &IndexReport{Created: []string{}, Unindexed: []string{}}
+
+	// Collect the declared indexes by collection, in the order that they are found
+	wanted := map[string][]Index{}
+	collections := []string{}
+	for _, r := range routes {
+		if r == nil {
+			continue
+		}
+		Walk(r.Pipe, func(s *Stage) {
+			si, ok := s.Info.(*StageInfo)
+			if !ok {
+				return
+			}
+			if si.Queries && len(si.Indexes) == 0 {
+				report.Unindexed = append(report.Unindexed, routeName(r)+strings.Trim(s.P(), " =>"))
+			}
+			if _, ok := wanted[si.Collection]; !ok && len(si.Indexes) > 0 {
+				collections = append(collections, si.Collection)
+			}
+			for _, ix := range si.Indexes {
+				if !hasIndex(wanted[si.Collection], ix) {
+					wanted[si.Collection] = append(wanted[si.Collection], ix)
+				}
+			}
+		})
+	}
+
+	// Create the ones that are missing
+	for _, name := range collections {
+
+		existing, err := idb.ListIndexes(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("rpmongo.EnsureIndexes: %s: %w", name, err)
+		}
+
+		missing := []Index{}
+		for _, ix := range wanted[name] {
+			if !hasIndex(existing, ix) {
+				missing = append(missing, ix)
+			}
+		}
+		if len(missing) == 0 {
+			continue
+		}
+		if err := idb.CreateIndexes(ctx, name, missing); err != nil {
+			return nil, fmt.Errorf("rpmongo.EnsureIndexes: %s: %w", name, err)
+		}
+		for _, ix := range missing {
+			report.Created = append(report.Created, name+"."+ix.name())
+		}
+	}
+
+	return report, nil
+}
+
+// routeName returns the route's method and path as a prefix for the report, like "POST /purchase: "
+func routeName(r *Route) string {
+	name := strings.TrimSpace(r.HttpMethod + " " + r.RelativePath)
+	if name == "" {
+		return ""
+	}
+	return name + ": "
+}
+
+// hasIndex reports whether indexes has one with the same keys as ix. An index also supports queries on a
+// prefix of its keys, but only exact matches are counted, so that the declared index is always created.
+func hasIndex(indexes []Index, ix Index) bool {
+	for _, other := range indexes {
+		if other.name() == ix.name() {
+			return true
+		}
+	}
+	return false
+}
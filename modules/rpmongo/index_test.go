@@ -0,0 +1,133 @@
+package rpmongo
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// purchaseRoutes are two routes whose stages declare overlapping indexes, some of them in nested chains, and
+// query without an index in two places
+func purchaseRoutes(db *Provider) []*Route {
+
+	noop := First(S("noop", func(in any, c Context, lgr Logger) (any, error) {
+		return in, nil
+	}))
+
+	purchase := InSequence(
+		First(Indexed(MongoFindOne(db, "customers"), Unique("customer_id"))),
+		InParallel(
+			First(Indexed(MongoFindOne(db, "inventory"), Unique("sku"))),
+			First(MongoCount(db, "orders")),
+		),
+		First(MongoTransaction(db, First(
+			Indexed(MongoUpdateOne(db, "inventory"), Unique("sku"))).Then(
+			MongoInsert(db, "orders")))).Then(
+			If(func(in any, c Context) bool { return true },
+				First(Indexed(MongoFind(db, "orders"), Ascending("customer", "created_at"))),
+				noop)))
+
+	history := First(
+		Indexed(MongoFind(db, "orders"), Ascending("customer", "created_at"), Ascending("item"))).Then(
+		MongoFindOne(db, "customers"))
+
+	return []*Route{
+		{HttpMethod: http.MethodPost, RelativePath: "/purchase", Pipe: purchase},
+		nil,
+		{HttpMethod: http.MethodGet, RelativePath: "/history", Pipe: history},
+	}
+}
+
+func TestEnsureIndexes(t *testing.T) {
+
+	ctx := context.Background()
+	mem := NewMemoryDatabase()
+	routes := purchaseRoutes(Static(mem))
+
+	// An index that already exists isn't created again
+	if err := mem.CreateIndexes(ctx, "customers", []Index{Unique("customer_id")}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := EnsureIndexes(mem, routes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCreated := []string{"inventory.sku_1", "orders.customer_1_created_at_1", "orders.item_1"}
+	wantUnindexed := []string{
+		`POST /purchase: MongoCount("orders")`,
+		`GET /history: MongoFindOne("customers")`,
+	}
+	if !reflect.DeepEqual(report.Created, wantCreated) {
+		t.Errorf("Created = %q, want %q", report.Created, wantCreated)
+	}
+	if !reflect.DeepEqual(report.Unindexed, wantUnindexed) {
+		t.Errorf("Unindexed = %q, want %q", report.Unindexed, wantUnindexed)
+	}
+
+	// The indexes are on the collections, with their options
+	indexes, _ := mem.ListIndexes(ctx, "orders")
+	wantIndexes := []Index{Ascending("_id"), Ascending("customer", "created_at"), Ascending("item")}
+	if !reflect.DeepEqual(indexes, wantIndexes) {
+		t.Errorf("orders indexes = %v, want %v", indexes, wantIndexes)
+	}
+	indexes, _ = mem.ListIndexes(ctx, "inventory")
+	if len(indexes) != 2 || !indexes[1].Unique {
+		t.Errorf("inventory indexes = %v", indexes)
+	}
+
+	// Running it again creates nothing and reports the same queries
+	report, err = EnsureIndexes(mem, routes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Created) != 0 || !reflect.DeepEqual(report.Unindexed, wantUnindexed) {
+		t.Errorf("second run = %+v", report)
+	}
+}
+
+// plainDatabase is a Database that can't manage indexes
+type plainDatabase struct {
+	Database
+}
+
+func TestEnsureIndexesWithoutIndexDatabase(t *testing.T) {
+
+	db := plainDatabase{NewMemoryDatabase()}
+	_, err := EnsureIndexes(db, purchaseRoutes(Static(db))...)
+	if err == nil || !strings.Contains(err.Error(), "can't list or create indexes") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestIndexed(t *testing.T) {
+
+	db := Static(NewMemoryDatabase())
+	s := MongoFind(db, "orders")
+	Indexed(s, Ascending("customer"))
+	Indexed(s, Ascending("item"), Unique("number"))
+
+	want := &StageInfo{Collection: "orders", Queries: true, Indexes: []Index{
+		Ascending("customer"),
+		Ascending("item"),
+		{Keys: bson.D{{Key: "number", Value: 1}}, Unique: true},
+	}}
+	if !reflect.DeepEqual(s.Info, want) {
+		t.Errorf("Info = %+v, want %+v", s.Info, want)
+	}
+	if name := Ascending("customer", "created_at").name(); name != "customer_1_created_at_1" {
+		t.Errorf("name = %q", name)
+	}
+
+	defer func() {
+		if r := recover(); r == nil || !strings.Contains(r.(string), "is not an rpmongo stage") {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	Indexed(S("plain", func(in any, c Context, lgr Logger) (any, error) { return in, nil }), Ascending("x"))
+}
@@ -0,0 +1,154 @@
+package rpmongo
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ListResult is the output of MongoList.
+type ListResult struct {
+	Items      []map[string]any `json:"items"`
+	Total      int64            `json:"total"`                 // Number of documents that match the filters, across all pages
+	NextCursor string           `json:"next_cursor,omitempty"` // For cursor pagination. Empty on the last page.
+}
+
+type MongoListOptions struct {
+	// If non-nil, it is added to the aggregation as a $project stage. Default is nil.
+	Projection map[string]any
+}
+
+// MongoList runs the *ListQuery passed in as in, typically from rp.ParseListQuery, on the given collection.
+// The filters become a $match stage, followed by $sort, $skip and $limit, and the total is counted with the same
+// filters. With cursor pagination, _id cursors that are valid ObjectID hex strings are compared as ObjectIDs.
+func MongoList(db *Provider, collectionName string, opts ...MongoListOptions) *Stage {
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoList(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			q, ok := in.(*ListQuery)
+			if !ok {
+				return nil, fmt.Errorf("expected *rp.ListQuery, got %T", in)
+			}
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+
+			filter := ListFilter(q)
+			total, err := coll.CountDocuments(c.Context(), filter)
+			if err != nil {
+				return nil, err
+			}
+
+			match := filter
+			if q.Cursor != nil && len(q.Sort) > 0 {
+				match = bson.M{"$and": bson.A{filter, cursorFilter(q)}}
+			}
+
+			pipeline := bson.A{bson.M{"$match": match}}
+			if len(q.Sort) > 0 {
+				sort := bson.D{}
+				for _, sf := range q.Sort {
+					dir := 1
+					if sf.Desc {
+						dir = -1
+					}
+					sort = append(sort, bson.E{Key: sf.Field, Value: dir})
+				}
+				pipeline = append(pipeline, bson.M{"$sort": sort})
+			}
+			if q.Offset > 0 {
+				pipeline = append(pipeline, bson.M{"$skip": q.Offset})
+			}
+			pipeline = append(pipeline, bson.M{"$limit": q.Limit})
+			if len(opts) > 0 && opts[0].Projection != nil {
+				pipeline = append(pipeline, bson.M{"$project": opts[0].Projection})
+			}
+
+			cur, err := coll.Aggregate(c.Context(), pipeline)
+			if err != nil {
+				return nil, err
+			}
+			defer cur.Close(c.Context())
+
+			items := make([]map[string]any, 0)
+			if err = cur.All(c.Context(), &items); err != nil {
+				return nil, err
+			}
+
+			result := &ListResult{
+				Items: items,
+				Total: total,
+			}
+			if q.Page == 0 && len(items) == q.Limit && len(q.Sort) > 0 {
+				result.NextCursor = cursorString(items[len(items)-1][q.Sort[0].Field])
+			}
+			return result, nil
+		},
+
+		E: mongoError("MongoList"),
+	}, collectionName, true)
+}
+
+// ListFilter converts the filters of q into a MongoDB query document.
+func ListFilter(q *ListQuery) bson.M {
+	filter := bson.M{}
+	for _, f := range q.Filters {
+		cond, ok := filter[f.Field].(bson.M)
+		if f.Op == "eq" {
+			if ok {
+				cond["$eq"] = f.Value
+			} else {
+				filter[f.Field] = f.Value
+			}
+			continue
+		}
+		if !ok {
+			cond = bson.M{}
+			if eq, exists := filter[f.Field]; exists {
+				cond["$eq"] = eq
+			}
+			filter[f.Field] = cond
+		}
+		cond["$"+f.Op] = f.Value
+	}
+	return filter
+}
+
+func cursorFilter(q *ListQuery) bson.M {
+	sf := q.Sort[0]
+	cursor := q.Cursor
+	if s, ok := cursor.(string); ok && sf.Field == "_id" {
+		if id, err := primitive.ObjectIDFromHex(s); err == nil {
+			cursor = id
+		}
+	}
+	op := "$gt"
+	if sf.Desc {
+		op = "$lt"
+	}
+	return bson.M{sf.Field: bson.M{op: cursor}}
+}
+
+func cursorString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case primitive.ObjectID:
+		return v.Hex()
+	case primitive.DateTime:
+		return v.Time().UTC().Format(CursorTimeLayout)
+	case time.Time:
+		return v.UTC().Format(CursorTimeLayout)
+	}
+	return fmt.Sprint(v)
+}
@@ -0,0 +1,129 @@
+package rpmongo
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// listPage runs ParseListQuery(spec) and MongoList on a request with the given query parameters
+func listPage(t *testing.T, spec ListSpec, db *Provider, params url.Values) *ListResult {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/events?"+params.Encode(), nil)
+	ch := First(ParseListQuery(spec)).Then(MongoList(db, "events"))
+	out, e := Execute(ch, NewHTTPContext(httptest.NewRecorder(), req, nil), nil)
+	if e != nil {
+		t.Fatalf("%s: %v", params.Encode(), e.Obj)
+	}
+	return out.(*ListResult)
+}
+
+// TestMongoListCursorRoundTrip pages through a collection by following NextCursor, for each type of sort
+// field, and checks that every matching document is listed once, in order
+func TestMongoListCursorRoundTrip(t *testing.T) {
+
+	ctx := context.Background()
+	mem := NewMemoryDatabase()
+	db := Static(mem)
+
+	// Times with sub-second precision, so that a cursor in any coarser layout would skip or repeat documents
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	docs := []any{}
+	for i := 0; i < 11; i++ {
+		docs = append(docs, bson.M{
+			"_id":        primitive.NewObjectIDFromTimestamp(start.Add(time.Duration(i) * time.Second)),
+			"seq":        i,
+			"name":       fmt.Sprintf("event-%02d", i),
+			"created_at": start.Add(time.Duration(i) * 1500 * time.Millisecond),
+			"even":       i%2 == 0,
+		})
+	}
+	if _, err := mem.Collection("events").InsertMany(ctx, docs); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := ListSpec{
+		DefaultLimit: 3,
+		SortFields:   []string{"_id", "seq", "created_at", "name"},
+		Filters:      map[string]FilterType{"seq": FilterInt, "even": FilterBool},
+		SortTypes:    map[string]FilterType{"created_at": FilterTime, "name": FilterString},
+		Cursor:       true,
+	}
+
+	tests := []struct {
+		sort   string
+		filter url.Values
+		want   []int // seq of the documents, in order
+	}{
+		{"", nil, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"-_id", nil, []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{"seq", url.Values{"seq[gte]": {"4"}}, []int{4, 5, 6, 7, 8, 9, 10}},
+		{"-created_at", nil, []int{10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}},
+		{"created_at", nil, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10}},
+		{"created_at", url.Values{"even": {"false"}}, []int{1, 3, 5, 7, 9}},
+		{"-name", url.Values{"seq[lt]": {"6"}}, []int{5, 4, 3, 2, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sort+tt.filter.Encode(), func(t *testing.T) {
+
+			got := []int{}
+			params := url.Values{}
+			for k, v := range tt.filter {
+				params[k] = v
+			}
+			if tt.sort != "" {
+				params.Set("sort", tt.sort)
+			}
+
+			for pages := 0; ; pages++ {
+				if pages > len(tt.want) {
+					t.Fatalf("too many pages, got %v so far", got)
+				}
+				res := listPage(t, spec, db, params)
+				if res.Total != int64(len(tt.want)) {
+					t.Errorf("total = %d, want %d", res.Total, len(tt.want))
+				}
+				for _, item := range res.Items {
+					got = append(got, int(item["seq"].(int32)))
+				}
+				if res.NextCursor == "" {
+					break
+				}
+				params.Set("cursor", res.NextCursor)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMongoListPages(t *testing.T) {
+
+	mem := NewMemoryDatabase()
+	for i := 1; i <= 5; i++ {
+		mem.Collection("events").InsertOne(context.Background(), bson.M{"_id": i, "seq": i})
+	}
+	spec := ListSpec{SortFields: []string{"seq"}, DefaultSort: "-seq", DefaultLimit: 2}
+
+	for page, want := range map[string][]int{"1": {5, 4}, "2": {3, 2}, "3": {1}, "4": {}} {
+		res := listPage(t, spec, Static(mem), url.Values{"page": {page}})
+		got := []int{}
+		for _, item := range res.Items {
+			got = append(got, int(item["seq"].(int32)))
+		}
+		if !reflect.DeepEqual(got, want) || res.Total != 5 || res.NextCursor != "" {
+			t.Errorf("page %s = %v, total %d, cursor %q, want %v", page, got, res.Total, res.NextCursor, want)
+		}
+	}
+}
@@ -0,0 +1,1116 @@
+package rpmongo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MemoryDatabase is an in-memory Database for testing pipelines without a MongoDB server. Give it to the
+// rpmongo stages with a Provider:
+//
+//	mem := rpmongo.NewMemoryDatabase()
+//	mem.Collection("customers").InsertOne(ctx, bson.M{"customer_id": "c1", "name": "Ada"})
+//	db := rpmongo.Static(mem)
+//	stage := rpmongo.MongoFindOne(db, "customers")
+//
+// Its collections support the common query operators ($eq, $ne, $gt, $gte, $lt, $lte, $in, $nin, $exists,
+// $not, $and, $or and $nor), the update operators $set, $unset, $inc, $push and $setOnInsert, top-level
+// projections, and aggregations made of $match, $project, $sort, $skip and $limit stages. Anything else is an
+// error rather than a silently wrong result. Indexes can be listed and created, for EnsureIndexes, but they
+// don't change query results and only _id is unique. Sessions and transactions are ignored.
+type MemoryDatabase struct {
+	mu          sync.Mutex
+	collections map[string]*MemoryCollection
+}
+
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		collections: make(map[string]*MemoryCollection),
+	}
+}
+
+// Collection returns the named *MemoryCollection, creating it on first use.
+func (db *MemoryDatabase) Collection(name string) Collection {
+	return db.collection(name)
+}
+
+func (db *MemoryDatabase) collection(name string) *MemoryCollection {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	coll, ok := db.collections[name]
+	if !ok {
+		coll = &MemoryCollection{name: name}
+		db.collections[name] = coll
+	}
+	return coll
+}
+
+// ListIndexes returns the collection's index on _id followed by the ones created with CreateIndexes.
+func (db *MemoryDatabase) ListIndexes(ctx context.Context, collectionName string) ([]Index, error) {
+	coll := db.collection(collectionName)
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	return append([]Index{Ascending("_id")}, coll.indexes...), nil
+}
+
+// CreateIndexes adds the indexes that the collection doesn't have yet. Only their keys and options are kept.
+func (db *MemoryDatabase) CreateIndexes(ctx context.Context, collectionName string, indexes []Index) error {
+	coll := db.collection(collectionName)
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	for _, ix := range indexes {
+		if len(ix.Keys) == 0 {
+			return errors.New("index has no keys")
+		}
+		if ix.name() != "_id_1" && !hasIndex(coll.indexes, ix) {
+			coll.indexes = append(coll.indexes, ix)
+		}
+	}
+	return nil
+}
+
+// MemoryCollection is an in-memory Collection. See MemoryDatabase.
+type MemoryCollection struct {
+	name    string
+	mu      sync.Mutex
+	docs    []bson.D
+	indexes []Index // Created with MemoryDatabase.CreateIndexes
+}
+
+// toD normalizes a document of any type that the driver accepts into a bson.D, with the same value types
+// that a server would return, such as int32 for small ints and primitive.DateTime for times.
+func toD(v any) (bson.D, error) {
+	if v == nil {
+		return nil, mongo.ErrNilDocument
+	}
+	b, err := bson.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	d := bson.D{}
+	if err := bson.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// toPipeline normalizes an aggregation pipeline, such as a mongo.Pipeline or a []bson.M, into its stages
+func toPipeline(v any) ([]bson.D, error) {
+	b, err := bson.Marshal(bson.M{"pipeline": v})
+	if err != nil {
+		return nil, err
+	}
+	var p struct {
+		Pipeline []bson.D `bson:"pipeline"`
+	}
+	if err := bson.Unmarshal(b, &p); err != nil {
+		return nil, err
+	}
+	return p.Pipeline, nil
+}
+
+func cursor(docs []bson.D) (*mongo.Cursor, error) {
+	list := make([]any, len(docs))
+	for i, d := range docs {
+		list[i] = d
+	}
+	return mongo.NewCursorFromDocuments(list, nil, nil)
+}
+
+func unsupported(kind string, name string) error {
+	return errors.New("rpmongo: MemoryCollection does not support the " + kind + " " + name)
+}
+
+// Values and comparisons
+
+// lookup returns the values at a dotted path. Like MongoDB, a path through an array applies the rest of the
+// path to each of its items, unless the next segment is an index.
+func lookup(v any, segs []string) []any {
+	if len(segs) == 0 {
+		return []any{v}
+	}
+	switch t := v.(type) {
+	case primitive.D:
+		for _, e := range t {
+			if e.Key == segs[0] {
+				return lookup(e.Value, segs[1:])
+			}
+		}
+	case primitive.A:
+		if n, err := strconv.Atoi(segs[0]); err == nil {
+			if n >= 0 && n < len(t) {
+				return lookup(t[n], segs[1:])
+			}
+			return nil
+		}
+		found := []any{}
+		for _, item := range t {
+			found = append(found, lookup(item, segs)...)
+		}
+		return found
+	}
+	return nil
+}
+
+// candidates returns the values that a query condition on path is matched against: the values at the path,
+// and the items of those that are arrays.
+func candidates(doc bson.D, path string) []any {
+	vals := lookup(doc, strings.Split(path, "."))
+	out := make([]any, 0, len(vals))
+	for _, v := range vals {
+		out = append(out, v)
+		if a, ok := v.(primitive.A); ok {
+			out = append(out, a...)
+		}
+	}
+	return out
+}
+
+func number(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// compare orders two values of the same kind. ok is false if they can't be compared.
+func compare(a, b any) (c int, ok bool) {
+	if x, ok := number(a); ok {
+		if y, ok := number(b); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case nil:
+		if b == nil {
+			return 0, true
+		}
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case bool:
+		if y, ok := b.(bool); ok {
+			switch {
+			case x == y:
+				return 0, true
+			case !x:
+				return -1, true
+			}
+			return 1, true
+		}
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			switch {
+			case x < y:
+				return -1, true
+			case x > y:
+				return 1, true
+			}
+			return 0, true
+		}
+	case primitive.ObjectID:
+		if y, ok := b.(primitive.ObjectID); ok {
+			return bytes.Compare(x[:], y[:]), true
+		}
+	}
+	return 0, false
+}
+
+func equal(a, b any) bool {
+	if c, ok := compare(a, b); ok {
+		return c == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// typeRank is MongoDB's order of values of different types when sorting
+func typeRank(v any) int {
+	if _, ok := number(v); ok {
+		return 2
+	}
+	switch v.(type) {
+	case nil:
+		return 1
+	case string:
+		return 3
+	case primitive.D:
+		return 4
+	case primitive.A:
+		return 5
+	case primitive.Binary:
+		return 6
+	case primitive.ObjectID:
+		return 7
+	case bool:
+		return 8
+	case primitive.DateTime:
+		return 9
+	}
+	return 10
+}
+
+func sortCompare(a, b any) int {
+	if ra, rb := typeRank(a), typeRank(b); ra != rb {
+		return ra - rb
+	}
+	c, _ := compare(a, b)
+	return c
+}
+
+// truthy interprets a projection or $exists value
+func truthy(v any) (bool, bool) {
+	if b, ok := v.(bool); ok {
+		return b, true
+	}
+	if n, ok := number(v); ok {
+		return n != 0, true
+	}
+	return false, false
+}
+
+// Queries
+
+func matches(doc bson.D, filter bson.D) (bool, error) {
+	for _, e := range filter {
+		ok, err := matchElement(doc, e)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchElement(doc bson.D, e primitive.E) (bool, error) {
+
+	switch e.Key {
+	case "$and", "$or", "$nor":
+		clauses, ok := e.Value.(primitive.A)
+		if !ok {
+			return false, errors.New("rpmongo: " + e.Key + " must be an array")
+		}
+		for _, clause := range clauses {
+			f, ok := clause.(primitive.D)
+			if !ok {
+				return false, errors.New("rpmongo: " + e.Key + " must be an array of documents")
+			}
+			m, err := matches(doc, f)
+			if err != nil {
+				return false, err
+			}
+			if e.Key == "$and" && !m {
+				return false, nil
+			}
+			if e.Key != "$and" && m {
+				return e.Key == "$or", nil
+			}
+		}
+		return e.Key != "$or", nil
+	}
+	if strings.HasPrefix(e.Key, "$") {
+		return false, unsupported("query operator", e.Key)
+	}
+
+	return matchField(doc, e.Key, e.Value)
+}
+
+func isOperatorDoc(v any) (primitive.D, bool) {
+	d, ok := v.(primitive.D)
+	return d, ok && len(d) > 0 && strings.HasPrefix(d[0].Key, "$")
+}
+
+func matchField(doc bson.D, path string, cond any) (bool, error) {
+	ops, ok := isOperatorDoc(cond)
+	if !ok {
+		return matchEq(doc, path, cond), nil
+	}
+	for _, op := range ops {
+		m, err := matchOp(doc, path, op.Key, op.Value)
+		if err != nil || !m {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchEq(doc bson.D, path string, val any) bool {
+	cands := candidates(doc, path)
+	if val == nil && len(cands) == 0 {
+		return true // {field: null} also matches documents without the field
+	}
+	for _, c := range cands {
+		if equal(c, val) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchOp(doc bson.D, path string, op string, val any) (bool, error) {
+	switch op {
+
+	case "$eq":
+		return matchEq(doc, path, val), nil
+
+	case "$ne":
+		return !matchEq(doc, path, val), nil
+
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, c := range candidates(doc, path) {
+			r, ok := compare(c, val)
+			if !ok {
+				continue
+			}
+			if (op == "$gt" && r > 0) || (op == "$gte" && r >= 0) || (op == "$lt" && r < 0) || (op == "$lte" && r <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "$in", "$nin":
+		list, ok := val.(primitive.A)
+		if !ok {
+			return false, errors.New("rpmongo: " + op + " needs an array")
+		}
+		found := false
+		for _, item := range list {
+			if matchEq(doc, path, item) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+
+	case "$exists":
+		want, ok := truthy(val)
+		if !ok {
+			return false, errors.New("rpmongo: $exists needs a bool")
+		}
+		return (len(lookup(doc, strings.Split(path, "."))) > 0) == want, nil
+
+	case "$not":
+		m, err := matchField(doc, path, val)
+		return !m, err
+	}
+
+	return false, unsupported("query operator", op)
+}
+
+func (coll *MemoryCollection) filter(filter any) ([]bson.D, error) {
+	f, err := toD(filter)
+	if err != nil {
+		return nil, err
+	}
+	found := []bson.D{}
+	for _, doc := range coll.docs {
+		m, err := matches(doc, f)
+		if err != nil {
+			return nil, err
+		}
+		if m {
+			found = append(found, doc)
+		}
+	}
+	return found, nil
+}
+
+// indexOf returns the position in coll.docs of the document with the same _id as doc
+func (coll *MemoryCollection) indexOf(doc bson.D) int {
+	id := lookup(doc, []string{"_id"})
+	for i, d := range coll.docs {
+		if other := lookup(d, []string{"_id"}); len(id) > 0 && len(other) > 0 && equal(id[0], other[0]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Cursor stages
+
+func sortDocs(docs []bson.D, spec any) ([]bson.D, error) {
+	s, err := toD(spec)
+	if err != nil {
+		return nil, err
+	}
+	out := append([]bson.D{}, docs...)
+	sort.SliceStable(out, func(i, j int) bool {
+		for _, e := range s {
+			dir, _ := number(e.Value)
+			var a, b any
+			if v := lookup(out[i], strings.Split(e.Key, ".")); len(v) > 0 {
+				a = v[0]
+			}
+			if v := lookup(out[j], strings.Split(e.Key, ".")); len(v) > 0 {
+				b = v[0]
+			}
+			if c := sortCompare(a, b); c != 0 {
+				return (c < 0) == (dir >= 0)
+			}
+		}
+		return false
+	})
+	return out, nil
+}
+
+func skipLimit(docs []bson.D, skip int64, limit int64) []bson.D {
+	if skip > 0 {
+		if skip >= int64(len(docs)) {
+			return []bson.D{}
+		}
+		docs = docs[skip:]
+	}
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < int64(len(docs)) {
+		docs = docs[:limit]
+	}
+	return docs
+}
+
+func project(docs []bson.D, spec any) ([]bson.D, error) {
+
+	p, err := toD(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]bool{}
+	include, withID := false, true
+	for _, e := range p {
+		on, ok := truthy(e.Value)
+		if !ok {
+			return nil, unsupported("projection of", e.Key)
+		}
+		if strings.Contains(e.Key, ".") {
+			return nil, unsupported("projection of nested field", e.Key)
+		}
+		if e.Key == "_id" {
+			withID = on
+			continue
+		}
+		fields[e.Key] = on
+		include = include || on
+	}
+
+	out := make([]bson.D, len(docs))
+	for i, doc := range docs {
+		d := bson.D{}
+		for _, e := range doc {
+			keep := !include
+			if e.Key == "_id" {
+				keep = withID
+			} else if on, ok := fields[e.Key]; ok {
+				keep = on
+			}
+			if keep {
+				d = append(d, e)
+			}
+		}
+		out[i] = d
+	}
+	return out, nil
+}
+
+// Updates
+
+func setPath(d primitive.D, segs []string, v any) (primitive.D, error) {
+	for i, e := range d {
+		if e.Key != segs[0] {
+			continue
+		}
+		if len(segs) == 1 {
+			d[i].Value = v
+			return d, nil
+		}
+		child, ok := e.Value.(primitive.D)
+		if !ok {
+			return nil, errors.New("rpmongo: cannot set a field inside " + segs[0] + ", which is not a document")
+		}
+		child, err := setPath(child, segs[1:], v)
+		if err != nil {
+			return nil, err
+		}
+		d[i].Value = child
+		return d, nil
+	}
+	if len(segs) == 1 {
+		return append(d, primitive.E{Key: segs[0], Value: v}), nil
+	}
+	child, err := setPath(primitive.D{}, segs[1:], v)
+	if err != nil {
+		return nil, err
+	}
+	return append(d, primitive.E{Key: segs[0], Value: child}), nil
+}
+
+func unsetPath(d primitive.D, segs []string) primitive.D {
+	for i, e := range d {
+		if e.Key != segs[0] {
+			continue
+		}
+		if len(segs) == 1 {
+			return append(d[:i:i], d[i+1:]...)
+		}
+		if child, ok := e.Value.(primitive.D); ok {
+			d[i].Value = unsetPath(child, segs[1:])
+		}
+		return d
+	}
+	return d
+}
+
+func add(a, b any) (any, error) {
+	x, okA := number(a)
+	y, okB := number(b)
+	if !okA || !okB {
+		return nil, errors.New("rpmongo: $inc needs numbers")
+	}
+	_, floatA := a.(float64)
+	_, floatB := b.(float64)
+	if floatA || floatB {
+		return x + y, nil
+	}
+	_, int32A := a.(int32)
+	_, int32B := b.(int32)
+	sum := int64(x) + int64(y)
+	if int32A && int32B && sum == int64(int32(sum)) {
+		return int32(sum), nil
+	}
+	return sum, nil
+}
+
+func applyUpdate(doc bson.D, update bson.D, inserting bool) (bson.D, error) {
+
+	if len(update) == 0 || !strings.HasPrefix(update[0].Key, "$") {
+		return nil, errors.New("rpmongo: update document must contain update operators, like $set")
+	}
+
+	var err error
+	for _, op := range update {
+		fields, ok := op.Value.(primitive.D)
+		if !ok {
+			return nil, errors.New("rpmongo: " + op.Key + " needs a document")
+		}
+		for _, f := range fields {
+			segs := strings.Split(f.Key, ".")
+			switch op.Key {
+			case "$set":
+				doc, err = setPath(doc, segs, f.Value)
+			case "$setOnInsert":
+				if inserting {
+					doc, err = setPath(doc, segs, f.Value)
+				}
+			case "$unset":
+				doc = unsetPath(doc, segs)
+			case "$inc":
+				sum := f.Value
+				if cur := lookup(doc, segs); len(cur) > 0 {
+					if sum, err = add(cur[0], f.Value); err != nil {
+						return nil, err
+					}
+				}
+				doc, err = setPath(doc, segs, sum)
+			case "$push":
+				list := primitive.A{}
+				if cur := lookup(doc, segs); len(cur) > 0 {
+					a, ok := cur[0].(primitive.A)
+					if !ok {
+						return nil, errors.New("rpmongo: $push needs an array at " + f.Key)
+					}
+					list = append(list, a...)
+				}
+				doc, err = setPath(doc, segs, append(list, f.Value))
+			default:
+				return nil, unsupported("update operator", op.Key)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return doc, nil
+}
+
+// Writes. The functions below expect the caller to hold coll.mu.
+
+func (coll *MemoryCollection) duplicateKey(index int, id any) mongo.WriteError {
+	return mongo.WriteError{
+		Index:   index,
+		Code:    11000,
+		Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { _id: %v }", coll.name, id),
+	}
+}
+
+// prepare normalizes doc and gives it an _id if it doesn't have one
+func prepare(document any) (bson.D, any, error) {
+	doc, err := toD(document)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id := lookup(doc, []string{"_id"}); len(id) > 0 {
+		return doc, id[0], nil
+	}
+	id := primitive.NewObjectID()
+	return append(bson.D{{Key: "_id", Value: id}}, doc...), id, nil
+}
+
+func (coll *MemoryCollection) insert(doc bson.D, id any, index int) *mongo.WriteError {
+	if coll.indexOf(doc) >= 0 {
+		we := coll.duplicateKey(index, id)
+		return &we
+	}
+	coll.docs = append(coll.docs, doc)
+	return nil
+}
+
+func (coll *MemoryCollection) update(filter any, update any, many bool, replace bool, upsert bool, index int) (*mongo.UpdateResult, *mongo.WriteError, error) {
+
+	found, err := coll.filter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := toD(update)
+	if err != nil {
+		return nil, nil, err
+	}
+	if replace && len(u) > 0 && strings.HasPrefix(u[0].Key, "$") {
+		return nil, nil, errors.New("rpmongo: replacement document must not contain update operators")
+	}
+
+	result := &mongo.UpdateResult{}
+
+	if len(found) == 0 {
+		if !upsert {
+			return result, nil, nil
+		}
+
+		// The new document starts with the filter's equality conditions
+		f, _ := toD(filter)
+		doc := bson.D{}
+		for _, e := range f {
+			if _, isOp := isOperatorDoc(e.Value); !isOp && !strings.HasPrefix(e.Key, "$") {
+				if doc, err = setPath(doc, strings.Split(e.Key, "."), e.Value); err != nil {
+					return nil, nil, err
+				}
+			}
+		}
+		if replace {
+			id := lookup(doc, []string{"_id"})
+			doc = u
+			if len(id) > 0 && len(lookup(doc, []string{"_id"})) == 0 {
+				doc = append(bson.D{{Key: "_id", Value: id[0]}}, doc...)
+			}
+		} else if doc, err = applyUpdate(doc, u, true); err != nil {
+			return nil, nil, err
+		}
+
+		doc, id, err := prepare(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if we := coll.insert(doc, id, index); we != nil {
+			return nil, we, nil
+		}
+		result.UpsertedCount = 1
+		result.UpsertedID = id
+		return result, nil, nil
+	}
+
+	if !many {
+		found = found[:1]
+	}
+	for _, doc := range found {
+		i := coll.indexOf(doc)
+		id := lookup(doc, []string{"_id"})
+
+		var updated bson.D
+		if replace {
+			updated = bson.D{{Key: "_id", Value: id[0]}}
+			for _, e := range u {
+				if e.Key != "_id" {
+					updated = append(updated, e)
+				}
+			}
+		} else {
+			// Work on a copy, so that a failed update leaves the document as it was
+			clone, err := toD(doc)
+			if err != nil {
+				return nil, nil, err
+			}
+			if updated, err = applyUpdate(clone, u, false); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		result.MatchedCount++
+		if !reflect.DeepEqual(updated, doc) {
+			result.ModifiedCount++
+		}
+		coll.docs[i] = updated
+	}
+	return result, nil, nil
+}
+
+func (coll *MemoryCollection) delete(filter any, many bool) (*mongo.DeleteResult, error) {
+	found, err := coll.filter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if !many && len(found) > 1 {
+		found = found[:1]
+	}
+	for _, doc := range found {
+		i := coll.indexOf(doc)
+		coll.docs = append(coll.docs[:i], coll.docs[i+1:]...)
+	}
+	return &mongo.DeleteResult{DeletedCount: int64(len(found))}, nil
+}
+
+// Collection methods
+
+func (coll *MemoryCollection) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+	o := options.MergeFindOneOptions(opts...)
+	fo := options.Find().SetLimit(1)
+	fo.Sort, fo.Projection = o.Sort, o.Projection
+	if o.Skip != nil {
+		fo.SetSkip(*o.Skip)
+	}
+	docs, err := coll.find(ctx, filter, fo)
+	if err != nil {
+		return mongo.NewSingleResultFromDocument(bson.D{}, err, nil)
+	}
+	if len(docs) == 0 {
+		return mongo.NewSingleResultFromDocument(bson.D{}, mongo.ErrNoDocuments, nil)
+	}
+	return mongo.NewSingleResultFromDocument(docs[0], nil, nil)
+}
+
+func (coll *MemoryCollection) find(ctx context.Context, filter any, o *options.FindOptions) ([]bson.D, error) {
+
+	if ctx != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	coll.mu.Lock()
+	docs, err := coll.filter(filter)
+	coll.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	if o.Sort != nil {
+		if docs, err = sortDocs(docs, o.Sort); err != nil {
+			return nil, err
+		}
+	}
+	var skip, limit int64
+	if o.Skip != nil {
+		skip = *o.Skip
+	}
+	if o.Limit != nil {
+		limit = *o.Limit
+	}
+	docs = skipLimit(docs, skip, limit)
+	if o.Projection != nil {
+		if docs, err = project(docs, o.Projection); err != nil {
+			return nil, err
+		}
+	}
+	return docs, nil
+}
+
+func (coll *MemoryCollection) Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+	docs, err := coll.find(ctx, filter, options.MergeFindOptions(opts...))
+	if err != nil {
+		return nil, err
+	}
+	return cursor(docs)
+}
+
+func (coll *MemoryCollection) Aggregate(ctx context.Context, pipeline any, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+
+	if ctx != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	stages, err := toPipeline(pipeline)
+	if err != nil {
+		return nil, err
+	}
+
+	coll.mu.Lock()
+	docs := append([]bson.D{}, coll.docs...)
+	coll.mu.Unlock()
+
+	for _, stage := range stages {
+		if len(stage) != 1 {
+			return nil, errors.New("rpmongo: each aggregation stage must have exactly one field")
+		}
+		op, arg := stage[0].Key, stage[0].Value
+
+		switch op {
+		case "$match":
+			f, ok := arg.(primitive.D)
+			if !ok {
+				return nil, errors.New("rpmongo: $match needs a document")
+			}
+			matched := []bson.D{}
+			for _, doc := range docs {
+				m, err := matches(doc, f)
+				if err != nil {
+					return nil, err
+				}
+				if m {
+					matched = append(matched, doc)
+				}
+			}
+			docs = matched
+		case "$project":
+			docs, err = project(docs, arg)
+		case "$sort":
+			docs, err = sortDocs(docs, arg)
+		case "$skip", "$limit":
+			n, ok := number(arg)
+			if !ok || n < 0 {
+				return nil, errors.New("rpmongo: " + op + " needs a non-negative number")
+			}
+			if op == "$skip" {
+				docs = skipLimit(docs, int64(n), 0)
+			} else {
+				docs = skipLimit(docs, 0, int64(n))
+			}
+		default:
+			return nil, unsupported("aggregation stage", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return cursor(docs)
+}
+
+func (coll *MemoryCollection) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+	o := options.MergeCountOptions(opts...)
+	fo := options.Find()
+	fo.Skip, fo.Limit = o.Skip, o.Limit
+	docs, err := coll.find(ctx, filter, fo)
+	return int64(len(docs)), err
+}
+
+func (coll *MemoryCollection) Distinct(ctx context.Context, fieldName string, filter any, opts ...*options.DistinctOptions) ([]any, error) {
+	docs, err := coll.find(ctx, filter, options.Find())
+	if err != nil {
+		return nil, err
+	}
+	values := []any{}
+	for _, doc := range docs {
+		for _, v := range lookup(doc, strings.Split(fieldName, ".")) {
+			items := []any{v}
+			if a, ok := v.(primitive.A); ok {
+				items = a
+			}
+			for _, item := range items {
+				seen := false
+				for _, other := range values {
+					if equal(item, other) {
+						seen = true
+						break
+					}
+				}
+				if !seen {
+					values = append(values, item)
+				}
+			}
+		}
+	}
+	return values, nil
+}
+
+func (coll *MemoryCollection) InsertOne(ctx context.Context, document any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+	doc, id, err := prepare(document)
+	if err != nil {
+		return nil, err
+	}
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	if we := coll.insert(doc, id, 0); we != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*we}}
+	}
+	return &mongo.InsertOneResult{InsertedID: id}, nil
+}
+
+func (coll *MemoryCollection) InsertMany(ctx context.Context, documents []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+
+	if len(documents) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	o := options.MergeInsertManyOptions(opts...)
+	ordered := o.Ordered == nil || *o.Ordered
+
+	// Like the driver, every document gets an _id before any of them are inserted
+	docs := make([]bson.D, len(documents))
+	ids := make([]any, len(documents))
+	for i, document := range documents {
+		var err error
+		if docs[i], ids[i], err = prepare(document); err != nil {
+			return nil, err
+		}
+	}
+
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	errs := []mongo.BulkWriteError{}
+	for i := range docs {
+		if we := coll.insert(docs[i], ids[i], i); we != nil {
+			errs = append(errs, mongo.BulkWriteError{WriteError: *we})
+			if ordered {
+				break
+			}
+		}
+	}
+
+	result := &mongo.InsertManyResult{InsertedIDs: ids}
+	if len(errs) > 0 {
+		return result, mongo.BulkWriteException{WriteErrors: errs}
+	}
+	return result, nil
+}
+
+func (coll *MemoryCollection) UpdateOne(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return coll.updateWithOptions(filter, update, false, false, options.MergeUpdateOptions(opts...).Upsert)
+}
+
+func (coll *MemoryCollection) UpdateMany(ctx context.Context, filter any, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	return coll.updateWithOptions(filter, update, true, false, options.MergeUpdateOptions(opts...).Upsert)
+}
+
+func (coll *MemoryCollection) ReplaceOne(ctx context.Context, filter any, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+	return coll.updateWithOptions(filter, replacement, false, true, options.MergeReplaceOptions(opts...).Upsert)
+}
+
+func (coll *MemoryCollection) updateWithOptions(filter any, update any, many bool, replace bool, upsert *bool) (*mongo.UpdateResult, error) {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	result, we, err := coll.update(filter, update, many, replace, upsert != nil && *upsert, 0)
+	if err != nil {
+		return nil, err
+	}
+	if we != nil {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{*we}}
+	}
+	return result, nil
+}
+
+func (coll *MemoryCollection) DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	return coll.delete(filter, false)
+}
+
+func (coll *MemoryCollection) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+	return coll.delete(filter, true)
+}
+
+func (coll *MemoryCollection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+
+	if len(models) == 0 {
+		return nil, mongo.ErrEmptySlice
+	}
+	o := options.MergeBulkWriteOptions(opts...)
+	ordered := o.Ordered == nil || *o.Ordered
+
+	coll.mu.Lock()
+	defer coll.mu.Unlock()
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: map[int64]any{}}
+	errs := []mongo.BulkWriteError{}
+
+	for i, model := range models {
+
+		var we *mongo.WriteError
+		var ur *mongo.UpdateResult
+		var err error
+
+		switch m := model.(type) {
+		case *mongo.InsertOneModel:
+			doc, id, prepErr := prepare(m.Document)
+			if err = prepErr; err == nil {
+				if we = coll.insert(doc, id, i); we == nil {
+					result.InsertedCount++
+				}
+			}
+		case *mongo.UpdateOneModel:
+			ur, we, err = coll.update(m.Filter, m.Update, false, false, m.Upsert != nil && *m.Upsert, i)
+		case *mongo.UpdateManyModel:
+			ur, we, err = coll.update(m.Filter, m.Update, true, false, m.Upsert != nil && *m.Upsert, i)
+		case *mongo.ReplaceOneModel:
+			ur, we, err = coll.update(m.Filter, m.Replacement, false, true, m.Upsert != nil && *m.Upsert, i)
+		case *mongo.DeleteOneModel:
+			var dr *mongo.DeleteResult
+			if dr, err = coll.delete(m.Filter, false); err == nil {
+				result.DeletedCount += dr.DeletedCount
+			}
+		case *mongo.DeleteManyModel:
+			var dr *mongo.DeleteResult
+			if dr, err = coll.delete(m.Filter, true); err == nil {
+				result.DeletedCount += dr.DeletedCount
+			}
+		default:
+			err = unsupported("write model", fmt.Sprintf("%T", model))
+		}
+
+		if err != nil {
+			return result, err
+		}
+		if ur != nil {
+			result.MatchedCount += ur.MatchedCount
+			result.ModifiedCount += ur.ModifiedCount
+			result.UpsertedCount += ur.UpsertedCount
+			if ur.UpsertedID != nil {
+				result.UpsertedIDs[int64(i)] = ur.UpsertedID
+			}
+		}
+		if we != nil {
+			errs = append(errs, mongo.BulkWriteError{WriteError: *we, Request: model})
+			if ordered {
+				break
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return result, mongo.BulkWriteException{WriteErrors: errs}
+	}
+	return result, nil
+}
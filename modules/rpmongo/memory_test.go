@@ -0,0 +1,455 @@
+package rpmongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// seedItems returns a collection with five documents whose _ids are 1 to 5
+func seedItems(t *testing.T) Collection {
+	t.Helper()
+	coll := NewMemoryDatabase().Collection("items")
+	docs := []any{
+		bson.M{"_id": 1, "name": "apple", "n": 10, "tags": bson.A{"fruit", "red"}, "meta": bson.M{"color": "red"}},
+		bson.M{"_id": 2, "name": "banana", "n": 20, "tags": bson.A{"fruit"}, "meta": bson.M{"color": "yellow"}},
+		bson.M{"_id": 3, "name": "carrot", "n": 30, "tags": bson.A{"vegetable"}},
+		bson.M{"_id": 4, "name": "date", "n": 40, "discontinued": true},
+		bson.M{"_id": 5, "name": "eggplant", "n": 50, "tags": bson.A{"vegetable", "purple"}, "meta": nil},
+	}
+	if _, err := coll.InsertMany(context.Background(), docs); err != nil {
+		t.Fatal(err)
+	}
+	return coll
+}
+
+// ids returns the _ids of the documents that filter matches, in insertion order
+func ids(t *testing.T, coll Collection, filter any, opts ...*options.FindOptions) []int {
+	t.Helper()
+	ctx := context.Background()
+	cur, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		t.Fatalf("Find(%v): %v", filter, err)
+	}
+	var docs []struct {
+		ID int `bson:"_id"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		t.Fatal(err)
+	}
+	out := []int{}
+	for _, d := range docs {
+		out = append(out, d.ID)
+	}
+	return out
+}
+
+func TestMemoryQueryOperators(t *testing.T) {
+
+	coll := seedItems(t)
+
+	tests := []struct {
+		name   string
+		filter any
+		want   []int
+	}{
+		{"empty", bson.M{}, []int{1, 2, 3, 4, 5}},
+		{"implicit eq", bson.M{"name": "banana"}, []int{2}},
+		{"eq", bson.M{"n": bson.M{"$eq": 30}}, []int{3}},
+		{"eq across numeric types", bson.M{"n": int64(30)}, []int{3}},
+		{"eq on array item", bson.M{"tags": "fruit"}, []int{1, 2}},
+		{"eq on nested field", bson.M{"meta.color": "red"}, []int{1}},
+		{"eq null matches missing", bson.M{"meta": nil}, []int{3, 4, 5}},
+		{"ne", bson.M{"tags": bson.M{"$ne": "fruit"}}, []int{3, 4, 5}},
+		{"gt", bson.M{"n": bson.M{"$gt": 30}}, []int{4, 5}},
+		{"gte", bson.M{"n": bson.M{"$gte": 30}}, []int{3, 4, 5}},
+		{"lt", bson.M{"n": bson.M{"$lt": 30}}, []int{1, 2}},
+		{"lte", bson.M{"n": bson.M{"$lte": 30}}, []int{1, 2, 3}},
+		{"range", bson.M{"n": bson.M{"$gt": 10, "$lt": 40}}, []int{2, 3}},
+		{"gt ignores other types", bson.M{"name": bson.M{"$gt": 0}}, []int{}},
+		{"in", bson.M{"name": bson.M{"$in": bson.A{"apple", "date", "fig"}}}, []int{1, 4}},
+		{"in on array", bson.M{"tags": bson.M{"$in": bson.A{"red", "purple"}}}, []int{1, 5}},
+		{"nin", bson.M{"name": bson.M{"$nin": bson.A{"apple", "date"}}}, []int{2, 3, 5}},
+		{"exists", bson.M{"discontinued": bson.M{"$exists": true}}, []int{4}},
+		{"not exists", bson.M{"tags": bson.M{"$exists": false}}, []int{4}},
+		{"not", bson.M{"n": bson.M{"$not": bson.M{"$gt": 20}}}, []int{1, 2}},
+		{"and", bson.M{"$and": bson.A{bson.M{"n": bson.M{"$gt": 10}}, bson.M{"tags": "vegetable"}}}, []int{3, 5}},
+		{"or", bson.M{"$or": bson.A{bson.M{"name": "apple"}, bson.M{"n": 50}}}, []int{1, 5}},
+		{"nor", bson.M{"$nor": bson.A{bson.M{"name": "apple"}, bson.M{"tags": "vegetable"}}}, []int{2, 4}},
+		{"bson.D filter", bson.D{{Key: "n", Value: bson.D{{Key: "$gte", Value: 40}}}}, []int{4, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ids(t, coll, tt.filter); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Operators that aren't implemented are errors rather than wrong results
+	if _, err := coll.Find(context.Background(), bson.M{"name": bson.M{"$regex": "^a"}}); err == nil {
+		t.Error("$regex: expected an error")
+	}
+	if _, err := coll.Find(context.Background(), bson.M{"$where": "true"}); err == nil {
+		t.Error("$where: expected an error")
+	}
+}
+
+func TestMemoryFindOneCountDistinct(t *testing.T) {
+
+	ctx := context.Background()
+	coll := seedItems(t)
+
+	var doc bson.M
+	if err := coll.FindOne(ctx, bson.M{"n": bson.M{"$gt": 15}}, options.FindOne().SetSort(bson.M{"n": -1})).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["name"] != "eggplant" {
+		t.Errorf("FindOne sorted = %v", doc["name"])
+	}
+	if err := coll.FindOne(ctx, bson.M{"name": "fig"}).Err(); !errors.Is(err, mongo.ErrNoDocuments) {
+		t.Errorf("FindOne no match = %v, want ErrNoDocuments", err)
+	}
+
+	n, err := coll.CountDocuments(ctx, bson.M{"tags": "vegetable"})
+	if err != nil || n != 2 {
+		t.Errorf("CountDocuments = %d, %v", n, err)
+	}
+
+	vals, err := coll.Distinct(ctx, "tags", bson.M{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []any{"fruit", "red", "vegetable", "purple"}; !reflect.DeepEqual(vals, want) {
+		t.Errorf("Distinct = %v, want %v", vals, want)
+	}
+}
+
+func TestMemorySortSkipLimit(t *testing.T) {
+
+	ctx := context.Background()
+	coll := seedItems(t)
+
+	got := ids(t, coll, bson.M{}, options.Find().SetSort(bson.D{{Key: "n", Value: -1}}).SetSkip(1).SetLimit(2))
+	if want := []int{4, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find sort/skip/limit = %v, want %v", got, want)
+	}
+
+	// Missing fields sort first, like null in MongoDB
+	got = ids(t, coll, bson.M{}, options.Find().SetSort(bson.D{{Key: "discontinued", Value: -1}, {Key: "n", Value: 1}}))
+	if want := []int{4, 1, 2, 3, 5}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Find multi-key sort = %v, want %v", got, want)
+	}
+
+	got = ids(t, coll, bson.M{}, options.Find().SetSkip(10))
+	if len(got) != 0 {
+		t.Errorf("Find skip past end = %v", got)
+	}
+
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"n": bson.M{"$gte": 20}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "name", Value: -1}}}},
+		{{Key: "$skip", Value: 1}},
+		{{Key: "$limit", Value: 2}},
+		{{Key: "$project", Value: bson.M{"name": 1, "_id": 0}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var docs []bson.M
+	if err := cur.All(ctx, &docs); err != nil {
+		t.Fatal(err)
+	}
+	if want := []bson.M{{"name": "date"}, {"name": "carrot"}}; !reflect.DeepEqual(docs, want) {
+		t.Errorf("Aggregate = %v, want %v", docs, want)
+	}
+
+	if _, err := coll.Aggregate(ctx, mongo.Pipeline{{{Key: "$group", Value: bson.M{"_id": "$name"}}}}); err == nil {
+		t.Error("$group: expected an error")
+	}
+}
+
+func TestMemoryProjection(t *testing.T) {
+
+	ctx := context.Background()
+	coll := seedItems(t)
+
+	var doc bson.M
+	if err := coll.FindOne(ctx, bson.M{"_id": 1}, options.FindOne().SetProjection(bson.M{"name": 1})).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"_id": int32(1), "name": "apple"}); !reflect.DeepEqual(doc, want) {
+		t.Errorf("inclusion = %v, want %v", doc, want)
+	}
+
+	doc = nil
+	if err := coll.FindOne(ctx, bson.M{"_id": 4}, options.FindOne().SetProjection(bson.M{"n": 0, "_id": 0})).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if want := (bson.M{"name": "date", "discontinued": true}); !reflect.DeepEqual(doc, want) {
+		t.Errorf("exclusion = %v, want %v", doc, want)
+	}
+}
+
+func TestMemoryUpdateOperators(t *testing.T) {
+
+	ctx := context.Background()
+	coll := seedItems(t)
+
+	res, err := coll.UpdateOne(ctx, bson.M{"_id": 1}, bson.M{
+		"$set":         bson.M{"name": "green apple", "meta.size": "big"},
+		"$unset":       bson.M{"tags": ""},
+		"$inc":         bson.M{"n": 5, "sold": 2},
+		"$push":        bson.M{"history": "renamed"},
+		"$setOnInsert": bson.M{"created": true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MatchedCount != 1 || res.ModifiedCount != 1 {
+		t.Errorf("UpdateOne result = %+v", res)
+	}
+
+	var doc bson.M
+	if err := coll.FindOne(ctx, bson.M{"_id": 1}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	want := bson.M{
+		"_id":     int32(1),
+		"name":    "green apple",
+		"n":       int32(15),
+		"meta":    bson.M{"color": "red", "size": "big"},
+		"sold":    int32(2),
+		"history": bson.A{"renamed"},
+	}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("updated document = %v, want %v", doc, want)
+	}
+
+	// $push appends to an existing array
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": 1}, bson.M{"$push": bson.M{"history": "again"}}); err != nil {
+		t.Fatal(err)
+	}
+	doc = nil
+	coll.FindOne(ctx, bson.M{"_id": 1}).Decode(&doc)
+	if !reflect.DeepEqual(doc["history"], bson.A{"renamed", "again"}) {
+		t.Errorf("history = %v", doc["history"])
+	}
+
+	// UpdateMany and ModifiedCount of documents that don't change
+	res, err = coll.UpdateMany(ctx, bson.M{"tags": "vegetable"}, bson.M{"$set": bson.M{"n": 50}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.MatchedCount != 2 || res.ModifiedCount != 1 {
+		t.Errorf("UpdateMany result = %+v", res)
+	}
+
+	// No match is not an error
+	res, err = coll.UpdateOne(ctx, bson.M{"_id": 99}, bson.M{"$set": bson.M{"n": 1}})
+	if err != nil || res.MatchedCount != 0 {
+		t.Errorf("UpdateOne no match = %+v, %v", res, err)
+	}
+
+	// Failed updates leave the document unchanged
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": 2}, bson.M{"name": "plain"}); err == nil {
+		t.Error("update without operators: expected an error")
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": 2}, bson.M{"$set": bson.M{"n": 0}, "$inc": bson.M{"name": 1}}); err == nil {
+		t.Error("$inc on a string: expected an error")
+	}
+	if _, err := coll.UpdateOne(ctx, bson.M{"_id": 2}, bson.M{"$rename": bson.M{"n": "m"}}); err == nil {
+		t.Error("$rename: expected an error")
+	}
+	doc = nil
+	coll.FindOne(ctx, bson.M{"_id": 2}).Decode(&doc)
+	if doc["n"] != int32(20) || doc["name"] != "banana" {
+		t.Errorf("document after failed updates = %v", doc)
+	}
+
+	// Replace keeps the _id
+	if _, err := coll.ReplaceOne(ctx, bson.M{"_id": 3}, bson.M{"name": "parsnip"}); err != nil {
+		t.Fatal(err)
+	}
+	doc = nil
+	coll.FindOne(ctx, bson.M{"_id": 3}).Decode(&doc)
+	if want := (bson.M{"_id": int32(3), "name": "parsnip"}); !reflect.DeepEqual(doc, want) {
+		t.Errorf("replaced document = %v, want %v", doc, want)
+	}
+	if _, err := coll.ReplaceOne(ctx, bson.M{"_id": 3}, bson.M{"$set": bson.M{"n": 1}}); err == nil {
+		t.Error("replacement with operators: expected an error")
+	}
+}
+
+func TestMemoryUpsert(t *testing.T) {
+
+	ctx := context.Background()
+	coll := NewMemoryDatabase().Collection("counters")
+	upsert := options.Update().SetUpsert(true)
+
+	update := bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"created": true}}
+
+	res, err := coll.UpdateOne(ctx, bson.M{"key": "a", "n": bson.M{"$gt": 0}}, update, upsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpsertedCount != 1 || res.UpsertedID == nil || res.MatchedCount != 0 {
+		t.Fatalf("first upsert = %+v", res)
+	}
+
+	// The inserted document has the filter's equality fields, but not its operator conditions
+	var doc bson.M
+	if err := coll.FindOne(ctx, bson.M{"_id": res.UpsertedID}).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	delete(doc, "_id")
+	if want := (bson.M{"key": "a", "count": int32(1), "created": true}); !reflect.DeepEqual(doc, want) {
+		t.Errorf("upserted document = %v, want %v", doc, want)
+	}
+
+	// The second one matches, so $setOnInsert doesn't apply
+	res, err = coll.UpdateOne(ctx, bson.M{"key": "a"}, bson.M{"$inc": bson.M{"count": 1}, "$setOnInsert": bson.M{"created": false}}, upsert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.UpsertedCount != 0 || res.MatchedCount != 1 {
+		t.Errorf("second upsert = %+v", res)
+	}
+	doc = nil
+	coll.FindOne(ctx, bson.M{"key": "a"}).Decode(&doc)
+	if doc["count"] != int32(2) || doc["created"] != true {
+		t.Errorf("document after second upsert = %v", doc)
+	}
+
+	// Replace with upsert keeps the filter's _id
+	rres, err := coll.ReplaceOne(ctx, bson.M{"_id": "b"}, bson.M{"key": "b"}, options.Replace().SetUpsert(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rres.UpsertedID != "b" {
+		t.Errorf("replace upsert _id = %v", rres.UpsertedID)
+	}
+	if n, _ := coll.CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Errorf("count = %d, want 2", n)
+	}
+}
+
+func TestMemoryDuplicateID(t *testing.T) {
+
+	ctx := context.Background()
+	coll := NewMemoryDatabase().Collection("items")
+
+	if _, err := coll.InsertOne(ctx, bson.M{"_id": 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// InsertOne is a WriteException
+	_, err := coll.InsertOne(ctx, bson.M{"_id": 1, "again": true})
+	var we mongo.WriteException
+	if !errors.As(err, &we) || len(we.WriteErrors) != 1 || we.WriteErrors[0].Code != 11000 {
+		t.Fatalf("InsertOne duplicate = %#v", err)
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Error("InsertOne duplicate is not a duplicate key error")
+	}
+
+	// Ordered InsertMany stops at the first duplicate
+	res, err := coll.InsertMany(ctx, []any{bson.M{"_id": 2}, bson.M{"_id": 1}, bson.M{"_id": 3}})
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) != 1 || bwe.WriteErrors[0].Index != 1 || bwe.WriteErrors[0].Code != 11000 {
+		t.Fatalf("ordered InsertMany = %#v", err)
+	}
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Error("InsertMany duplicate is not a duplicate key error")
+	}
+	if len(res.InsertedIDs) != 3 {
+		t.Errorf("InsertedIDs = %v", res.InsertedIDs)
+	}
+	if got := ids(t, coll, bson.M{}); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Errorf("after ordered InsertMany = %v", got)
+	}
+
+	// Unordered InsertMany carries on
+	_, err = coll.InsertMany(ctx, []any{bson.M{"_id": 1}, bson.M{"_id": 4}, bson.M{"_id": 2}}, options.InsertMany().SetOrdered(false))
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) != 2 || bwe.WriteErrors[0].Index != 0 || bwe.WriteErrors[1].Index != 2 {
+		t.Fatalf("unordered InsertMany = %#v", err)
+	}
+	if got := ids(t, coll, bson.M{}); !reflect.DeepEqual(got, []int{1, 2, 4}) {
+		t.Errorf("after unordered InsertMany = %v", got)
+	}
+
+	// An upsert that would insert a duplicate _id
+	_, err = coll.UpdateOne(ctx, bson.M{"_id": 1, "missing": true}, bson.M{"$set": bson.M{"x": 1}}, options.Update().SetUpsert(true))
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("duplicate upsert = %v", err)
+	}
+
+	// BulkWrite
+	bres, err := coll.BulkWrite(ctx, []mongo.WriteModel{
+		mongo.NewInsertOneModel().SetDocument(bson.M{"_id": 5}),
+		mongo.NewInsertOneModel().SetDocument(bson.M{"_id": 5}),
+		mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": 6}).SetUpdate(bson.M{"$set": bson.M{"x": 1}}).SetUpsert(true),
+		mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": 4}),
+	}, options.BulkWrite().SetOrdered(false))
+	if !errors.As(err, &bwe) || len(bwe.WriteErrors) != 1 || bwe.WriteErrors[0].Index != 1 {
+		t.Fatalf("BulkWrite = %#v", err)
+	}
+	if bres.InsertedCount != 1 || bres.UpsertedCount != 1 || bres.DeletedCount != 1 || bres.UpsertedIDs[2] != int32(6) {
+		t.Errorf("BulkWrite result = %+v", bres)
+	}
+}
+
+func TestMemoryDelete(t *testing.T) {
+
+	ctx := context.Background()
+	coll := seedItems(t)
+
+	res, err := coll.DeleteOne(ctx, bson.M{"tags": "fruit"})
+	if err != nil || res.DeletedCount != 1 {
+		t.Fatalf("DeleteOne = %+v, %v", res, err)
+	}
+	res, err = coll.DeleteMany(ctx, bson.M{"n": bson.M{"$gte": 30}})
+	if err != nil || res.DeletedCount != 3 {
+		t.Fatalf("DeleteMany = %+v, %v", res, err)
+	}
+	if got := ids(t, coll, bson.M{}); !reflect.DeepEqual(got, []int{2}) {
+		t.Errorf("after deletes = %v", got)
+	}
+}
+
+// TestMemoryConcurrentWrites checks that collections are safe for concurrent use. Run with -race.
+func TestMemoryConcurrentWrites(t *testing.T) {
+
+	ctx := context.Background()
+	coll := NewMemoryDatabase().Collection("counters")
+	coll.InsertOne(ctx, bson.M{"_id": "c", "n": 0})
+
+	done := make(chan error)
+	for i := 0; i < 20; i++ {
+		go func(i int) {
+			_, err := coll.UpdateOne(ctx, bson.M{"_id": "c"}, bson.M{"$inc": bson.M{"n": 1}})
+			if err == nil {
+				_, err = coll.InsertOne(ctx, bson.M{"i": i})
+			}
+			done <- err
+		}(i)
+	}
+	for i := 0; i < 20; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var doc bson.M
+	coll.FindOne(ctx, bson.M{"_id": "c"}).Decode(&doc)
+	if fmt.Sprint(doc["n"]) != "20" {
+		t.Errorf("n = %v, want 20", doc["n"])
+	}
+}
@@ -0,0 +1,144 @@
+package rpmongo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrNoDatabase is returned by a Provider that can't resolve a database for the execution. The stage fails
+// with a 500 error.
+var ErrNoDatabase = errors.New("no database")
+
+// Provider resolves the database that rpmongo stages run on, for each execution. Create one at startup with
+// Static, Tenant or FromContext and pass it to every stage, like MongoFindOne(db, "customers").
+type Provider struct {
+	resolve func(c Context) (Database, error)
+}
+
+// Static provides the same database for every execution, like Static(Driver(client.Database("shop"))).
+func Static(db Database) *Provider {
+	if db == nil {
+		panic("rpmongo.Static: db is nil")
+	}
+	return &Provider{
+		resolve: func(c Context) (Database, error) {
+			return db, nil
+		},
+	}
+}
+
+// Tenant calls resolve for each execution, so that the database can depend on the request, such as one
+// database per tenant picked by a header or path parameter. An error from resolve fails the stage.
+func Tenant(resolve func(c Context) (Database, error)) *Provider {
+	return &Provider{resolve: resolve}
+}
+
+// FromContext provides the database in the context at ctxKey, which must be a *mongo.Database or a Database.
+// This is how the stages found their database before Provider, with a middleware setting it for each request.
+func FromContext(ctxKey string) *Provider {
+	return &Provider{
+		resolve: func(c Context) (Database, error) {
+			v, ok := c.Get(ctxKey)
+			if !ok {
+				return nil, fmt.Errorf("%w at context key %q", ErrNoDatabase, ctxKey)
+			}
+			switch db := v.(type) {
+			case *mongo.Database:
+				return Driver(db), nil
+			case Database:
+				return db, nil
+			}
+			return nil, fmt.Errorf("%w at context key %q: expected a *mongo.Database or rpmongo.Database, got %T", ErrNoDatabase, ctxKey, v)
+		},
+	}
+}
+
+// Database resolves the database for the execution.
+func (p *Provider) Database(c Context) (Database, error) {
+	if p == nil || p.resolve == nil {
+		return nil, fmt.Errorf("%w: provider is nil", ErrNoDatabase)
+	}
+	db, err := p.resolve(c)
+	if err != nil {
+		return nil, err
+	}
+	if db == nil {
+		return nil, ErrNoDatabase
+	}
+	return db, nil
+}
+
+// collection resolves the database for the execution and returns its named collection
+func (p *Provider) collection(c Context, collectionName string) (Collection, error) {
+	db, err := p.Database(c)
+	if err != nil {
+		return nil, err
+	}
+	return db.Collection(collectionName), nil
+}
+
+// Driver adapts a *mongo.Database to the Database interface.
+func Driver(db *mongo.Database) Database {
+	if db == nil {
+		panic("rpmongo.Driver: db is nil")
+	}
+	return driverDatabase{db}
+}
+
+type driverDatabase struct {
+	db *mongo.Database
+}
+
+func (d driverDatabase) Collection(name string) Collection {
+	return d.db.Collection(name)
+}
+
+func (d driverDatabase) ListIndexes(ctx context.Context, collectionName string) ([]Index, error) {
+
+	cur, err := d.db.Collection(collectionName).Indexes().List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+
+	var specs []struct {
+		Key    bson.D `bson:"key"`
+		Unique bool   `bson:"unique"`
+	}
+	if err := cur.All(ctx, &specs); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]Index, len(specs))
+	for i, spec := range specs {
+		indexes[i] = Index{Keys: spec.Key, Unique: spec.Unique}
+	}
+	return indexes, nil
+}
+
+func (d driverDatabase) CreateIndexes(ctx context.Context, collectionName string, indexes []Index) error {
+	models := make([]mongo.IndexModel, len(indexes))
+	for i, ix := range indexes {
+		models[i] = mongo.IndexModel{
+			Keys:    ix.Keys,
+			Options: options.Index().SetUnique(ix.Unique),
+		}
+	}
+	_, err := d.db.Collection(collectionName).Indexes().CreateMany(ctx, models)
+	return err
+}
+
+// client returns the *mongo.Client of db if it is a driver database, which MongoTransaction needs to start a
+// session
+func client(db Database) *mongo.Client {
+	if d, ok := db.(driverDatabase); ok {
+		return d.db.Client()
+	}
+	return nil
+}
@@ -1,43 +1,61 @@
 package rpmongo
 
 import (
-	"context"
-	"errors"
-	"net/http"
+	"fmt"
+	"reflect"
 
-	"github.com/gin-gonic/gin"
 	. "github.com/jeremywhuff/rp"
-	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type MongoFindOneOptions struct {
-	// If non-nil, the result will be unmarshalled into this object. Default is nil.
-	// If nil, the result will be unmarshalled into an object of type map[string]any.
+	// If non-nil, the result will be unmarshalled into a new object of this type for each execution, which
+	// must be a pointer, like &CustomerDocument{}. Default is nil.
+	// If nil, the result will be unmarshalled into an object of type *map[string]any.
 	// It is sent to the mongo.SingleResult.Decode() method.
 	Result any
 }
 
-func MongoFindOne(ctxDatabaseName string, collectionName string, opts ...MongoFindOneOptions) *Stage {
-	return &Stage{
+// newResult returns a function that allocates a new value of the type that obj points to, or of type def if
+// obj is nil. It panics if obj is not a pointer, so that mistakes show up when the stage is created.
+func newResult(name string, obj any, def func() any) func() any {
+	if obj == nil {
+		return def
+	}
+	t := reflect.TypeOf(obj)
+	if t.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("rpmongo.%s: result must be a pointer, got %T", name, obj))
+	}
+	return func() any {
+		return reflect.New(t.Elem()).Interface()
+	}
+}
+
+// MongoFindOne outputs the first document that matches the filter passed in as in. It is a 404 error if no
+// document matches.
+func MongoFindOne(db *Provider, collectionName string, opts ...MongoFindOneOptions) *Stage {
+
+	var obj any
+	if len(opts) > 0 {
+		obj = opts[0].Result
+	}
+	alloc := newResult("MongoFindOne", obj, func() any { return &map[string]any{} })
+
+	return declare(&Stage{
 
 		P: func() string {
 			return `  => MongoFindOne("` + collectionName + `") =>`
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
-			db := c.MustGet(ctxDatabaseName).(*mongo.Database)
-			coll := db.Collection(collectionName)
-
-			var result any
-			if len(opts) > 0 && opts[0].Result != nil {
-				result = opts[0].Result
-			} else {
-				result = &map[string]any{}
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
 			}
 
-			err := coll.FindOne(context.Background(), in).Decode(result)
+			result := alloc()
+			err = coll.FindOne(c.Context(), in).Decode(result)
 			if err != nil {
 				return nil, err
 			}
@@ -45,47 +63,38 @@ func MongoFindOne(ctxDatabaseName string, collectionName string, opts ...MongoFi
 			return result, nil
 		},
 
-		E: func(err error) *StageError {
-			if err == mongo.ErrNoDocuments {
-				return &StageError{
-					Code: http.StatusNotFound,
-					Obj:  H{"error": "MongoFindOne: Document not found"},
-				}
-			}
-			return &StageError{
-				Code: ISR,
-				Obj:  H{"error": "MongoFindOne: " + err.Error()},
-			}
-		},
-	}
+		E: mongoError("MongoFindOne"),
+	}, collectionName, true)
 }
 
-func MongoFetch(ctxDatabaseName string, collectionName string, projection map[string]any) *Stage {
-	return &Stage{
+func MongoFetch(db *Provider, collectionName string, projection map[string]any) *Stage {
+	return declare(&Stage{
 
 		P: func() string {
 			return "  => MongoFetch(\"" + collectionName + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
-			db := c.MustGet(ctxDatabaseName).(*mongo.Database)
-			coll := db.Collection(collectionName)
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
 
 			pipeline := []H{{
 				"$match": H{
-					"_id": in.(primitive.ObjectID)}}, {
+					"_id": in}}, {
 				"$project": projection},
 			}
 
 			results := make([]map[string]any, 0)
-			cur, err := coll.Aggregate(context.Background(), pipeline)
+			cur, err := coll.Aggregate(c.Context(), pipeline)
 			if err != nil {
 				return nil, err
 			}
-			defer cur.Close(context.Background())
+			defer cur.Close(c.Context())
 
-			if err = cur.All(context.Background(), &results); err != nil {
+			if err = cur.All(c.Context(), &results); err != nil {
 				return nil, err
 			}
 
@@ -95,102 +104,132 @@ func MongoFetch(ctxDatabaseName string, collectionName string, projection map[st
 			return nil, mongo.ErrNoDocuments
 		},
 
-		E: func(err error) *StageError {
-			if err == mongo.ErrNoDocuments {
-				return &StageError{
-					Code: http.StatusNotFound,
-					Obj:  H{"error": "MongoFetch: Document not found"},
-				}
-			}
-			return &StageError{
-				Code: ISR,
-				Obj:  H{"error": err.Error()},
-			}
-		},
-	}
+		E: mongoError("MongoFetch"),
+	}, collectionName, false)
 }
 
 type MongoPipeOptions struct {
-	// If non-nil, the results will be unmarshalled into this object. Default is nil.
-	// It must be a pointer to a slice. It is sent to the mongo.Cursor.All() method.
+	// If non-nil, the results will be unmarshalled into a new object of this type for each execution, which
+	// must be a pointer to a slice, like &[]OrderDocument{}, and that pointer is output. Default is nil.
+	// If nil, the output is a []map[string]any. It is sent to the mongo.Cursor.All() method.
 	Results any
 }
 
 // MongoPipe executes the given pipeline of the in parameter on the given collection.
-// The *mongo.Database instance must be set in the context with the given ctxDatabaseName as the key.
 // in must be a valid pipeline for the mongo.Collection.Aggregate() method.
-func MongoPipe(ctxDatabaseName string, collectionName string, opts *MongoPipeOptions) *Stage {
-	return &Stage{
+func MongoPipe(db *Provider, collectionName string, opts *MongoPipeOptions) *Stage {
+
+	var alloc func() any
+	if opts != nil && opts.Results != nil {
+		if t := reflect.TypeOf(opts.Results); t.Kind() != reflect.Pointer || t.Elem().Kind() != reflect.Slice {
+			panic(fmt.Sprintf("rpmongo.MongoPipe: Results must be a pointer to a slice, got %T", opts.Results))
+		}
+		alloc = newResult("MongoPipe", opts.Results, nil)
+	}
+
+	return declare(&Stage{
 
 		P: func() string {
 			return "  => MongoPipe(\"" + collectionName + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
-			db, ok := c.MustGet(ctxDatabaseName).(*mongo.Database)
-			if !ok {
-				return nil, errors.New("mongo database not found in context")
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
 			}
-			coll := db.Collection(collectionName)
 
-			cur, err := coll.Aggregate(context.Background(), in)
+			cur, err := coll.Aggregate(c.Context(), in)
 			if err != nil {
 				return nil, err
 			}
-			defer cur.Close(context.Background())
+			defer cur.Close(c.Context())
 
-			var results any
-			if opts != nil && opts.Results != nil {
-				results = opts.Results
-			} else {
-				results = make([]map[string]any, 0)
+			if alloc != nil {
+				results := alloc()
+				if err = cur.All(c.Context(), results); err != nil {
+					return nil, err
+				}
+				return results, nil
 			}
 
-			if err = cur.All(context.Background(), &results); err != nil {
+			results := make([]map[string]any, 0)
+			if err = cur.All(c.Context(), &results); err != nil {
 				return nil, err
 			}
-
 			return results, nil
 		},
 
-		E: func(err error) *StageError {
-			return &StageError{
-				Code: ISR,
-				Obj:  H{"error": err.Error()},
-			}
-		},
-	}
+		E: mongoError("MongoPipe"),
+	}, collectionName, true)
 }
 
-// MongoInsert inserts in as a document
-func MongoInsert(ctxDatabaseName string, collectionName string) *Stage {
-	return &Stage{
+// MongoInsert inserts in as a document and outputs its _id, which is a primitive.ObjectID unless in has an
+// _id of another type.
+func MongoInsert(db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
 
 		P: func() string {
 			return "  => MongoInsert(\"" + collectionName + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
-			db := c.MustGet(ctxDatabaseName).(*mongo.Database)
-			coll := db.Collection(collectionName)
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
 
-			insertResult, err := coll.InsertOne(context.Background(), in)
+			insertResult, err := coll.InsertOne(c.Context(), in)
 			if err != nil {
 				return nil, err
 			}
 
-			out := insertResult.InsertedID.(primitive.ObjectID)
+			return insertResult.InsertedID, nil
+		},
+
+		E: mongoError("MongoInsert"),
+	}, collectionName, false)
+}
+
+// MongoFindOneT is like MongoFindOne, but decodes the document into a new *T for each execution.
+func MongoFindOneT[T any](db *Provider, collectionName string) *Stage {
+	s := MongoFindOne(db, collectionName, MongoFindOneOptions{Result: new(T)})
+	s.P = func() string {
+		return "  => MongoFindOne(\"" + collectionName + "\").(*" + reflect.TypeOf((*T)(nil)).Elem().String() + ") =>"
+	}
+	return s
+}
+
+// MongoPipeT is like MongoPipe, but decodes the results into a new []T for each execution.
+func MongoPipeT[T any](db *Provider, collectionName string) *Stage {
+	return declare(&Stage{
 
-			return out, nil
+		P: func() string {
+			return "  => MongoPipe(\"" + collectionName + "\").([]" + reflect.TypeOf((*T)(nil)).Elem().String() + ") =>"
 		},
 
-		E: func(err error) *StageError {
-			return &StageError{
-				Code: ISR,
-				Obj:  H{"error": err.Error()},
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+
+			cur, err := coll.Aggregate(c.Context(), in)
+			if err != nil {
+				return nil, err
+			}
+			defer cur.Close(c.Context())
+
+			results := make([]T, 0)
+			if err = cur.All(c.Context(), &results); err != nil {
+				return nil, err
 			}
+			return results, nil
 		},
-	}
+
+		E: mongoError("MongoPipe"),
+	}, collectionName, true)
 }
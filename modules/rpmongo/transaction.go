@@ -0,0 +1,70 @@
+package rpmongo
+
+import (
+	"errors"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MongoTransaction runs ch in a MongoDB transaction, with in as its first stage's input, and outputs the
+// chain's output. The rpmongo stages in ch, including nested chains, run their operations in the transaction.
+// It is committed when ch succeeds and aborted when any stage fails, in which case the stage's StageError is
+// passed through as it is. The whole chain is retried when MongoDB reports a transient transaction error, so
+// stages in ch should not have side effects outside of the database.
+// The session is started on the client of the database that db provides. A MongoTransaction inside another one
+// joins the outer transaction, and with a Database that isn't backed by the driver, such as a *MemoryDatabase,
+// ch runs without a transaction.
+func MongoTransaction(db *Provider, ch *Chain) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => MongoTransaction =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			run := func(c Context) (any, error) {
+				out, e := ExecuteWith(ch, in, c, lgr)
+				if e != nil {
+					return nil, ChainExecutionError{StageError: e}
+				}
+				return out, nil
+			}
+
+			if mongo.SessionFromContext(c.Context()) != nil {
+				return run(c)
+			}
+
+			d, err := db.Database(c)
+			if err != nil {
+				return nil, err
+			}
+			cl := client(d)
+			if cl == nil {
+				return run(c)
+			}
+
+			session, err := cl.StartSession()
+			if err != nil {
+				return nil, err
+			}
+			defer session.EndSession(c.Context())
+
+			return session.WithTransaction(c.Context(), func(sc mongo.SessionContext) (any, error) {
+				// The rpmongo stages use c.Context(), so this puts their operations in the transaction
+				return run(WithContext(c, sc))
+			})
+		},
+
+		E: func(err error) *StageError {
+			var ce ChainExecutionError
+			if errors.As(err, &ce) {
+				return ce.StageError
+			}
+			return mongoError("MongoTransaction")(err)
+		},
+
+		Nested: []*Chain{ch},
+	}
+}
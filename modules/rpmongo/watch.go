@@ -0,0 +1,137 @@
+package rpmongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Watcher is implemented by collections that support change streams, such as *mongo.Collection. The
+// in-memory MemoryCollection does not.
+type Watcher interface {
+	Watch(ctx context.Context, pipeline any, opts ...*options.ChangeStreamOptions) (*mongo.ChangeStream, error)
+}
+
+// eventStream is the part of *mongo.ChangeStream that MongoWatch reads
+type eventStream interface {
+	Next(ctx context.Context) bool
+	Decode(val any) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
+// streamWatcher is implemented by collections that provide change streams without the driver, which tests use
+// to fake one
+type streamWatcher interface {
+	watchStream(ctx context.Context, pipeline any, opts ...*options.ChangeStreamOptions) (eventStream, error)
+}
+
+// watch opens a change stream on coll
+func watch(ctx context.Context, coll Collection, pipeline any, opts *options.ChangeStreamOptions) (eventStream, error) {
+	switch w := coll.(type) {
+	case Watcher:
+		return w.Watch(ctx, pipeline, opts)
+	case streamWatcher:
+		return w.watchStream(ctx, pipeline, opts)
+	}
+	return nil, fmt.Errorf("%T does not support change streams", coll)
+}
+
+type MongoWatchOptions struct {
+	// If true, update events include the current version of the whole document as fullDocument. Default is
+	// false, where they only include the changed fields.
+	FullDocument bool
+	// If non-nil, each change event is unmarshalled into a new object of this type, which must be a pointer,
+	// like &OrderChangeEvent{}, and that pointer is sent. Default is nil, which sends a *map[string]any.
+	Event any
+	// Number of events buffered ahead of the consumer. Default is 0, unbuffered.
+	Buffer int
+}
+
+// MongoWatch opens a change stream on the given collection and outputs a <-chan any of its change events,
+// which SSE or Stream can send to the client, like First(MongoWatch(db, "orders")).Then(SSE("order")).
+// in is the pipeline that filters and shapes the events, like
+// mongo.Pipeline{{{"$match", bson.M{"fullDocument.customer_id": id}}}}, and nil watches every change.
+// The stream is opened before the stage completes, so that failing to open it is a 500 error rather than an
+// empty response. It is closed, along with the channel, when the execution's context is done, which is when
+// the client disconnects.
+func MongoWatch(db *Provider, collectionName string, opts ...MongoWatchOptions) *Stage {
+
+	opt := MongoWatchOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	alloc := newResult("MongoWatch", opt.Event, func() any { return &map[string]any{} })
+
+	watchOpts := options.ChangeStream()
+	if opt.FullDocument {
+		watchOpts.SetFullDocument(options.UpdateLookup)
+	}
+
+	return declare(&Stage{
+
+		P: func() string {
+			return "  => MongoWatch(\"" + collectionName + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			coll, err := db.collection(c, collectionName)
+			if err != nil {
+				return nil, err
+			}
+
+			pipeline := in
+			if pipeline == nil {
+				pipeline = mongo.Pipeline{}
+			} else if k := reflect.TypeOf(pipeline).Kind(); k != reflect.Slice && k != reflect.Array {
+				return nil, fmt.Errorf("expected a pipeline, got %T", in)
+			}
+
+			ctx := c.Context()
+			cs, err := watch(ctx, coll, pipeline, watchOpts)
+			if err != nil {
+				return nil, err
+			}
+
+			events := make(chan any, opt.Buffer)
+			go pumpEvents(ctx, cs, events, alloc, func(err error) {
+				if lgr != nil {
+					lgr.LogMessage("MongoWatch(\"" + collectionName + "\"): " + err.Error())
+				}
+			})
+
+			return (<-chan any)(events), nil
+		},
+
+		E: mongoError("MongoWatch"),
+	}, collectionName, false)
+}
+
+// pumpEvents sends each event of cs to events, decoded into a new value from alloc, until cs ends or ctx is
+// done. It then closes both. Errors that end the stream are passed to logErr, since the stage has completed
+// and they can no longer become a StageError.
+func pumpEvents(ctx context.Context, cs eventStream, events chan<- any, alloc func() any, logErr func(error)) {
+	defer close(events)
+	defer cs.Close(context.Background())
+
+	for cs.Next(ctx) {
+		ev := alloc()
+		if err := cs.Decode(ev); err != nil {
+			logErr(err)
+			return
+		}
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+			return
+		}
+	}
+	if err := cs.Err(); err != nil && ctx.Err() == nil {
+		logErr(err)
+	}
+}
@@ -0,0 +1,268 @@
+package rpmongo
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	. "github.com/jeremywhuff/rp"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeStream is a change stream whose events are sent by the test
+type fakeStream struct {
+	events  chan bson.Raw
+	current bson.Raw
+	err     error
+	once    sync.Once
+	closed  chan struct{}
+}
+
+func newFakeStream(buffer int) *fakeStream {
+	return &fakeStream{events: make(chan bson.Raw, buffer), closed: make(chan struct{})}
+}
+
+func (s *fakeStream) send(t *testing.T, ev any) {
+	t.Helper()
+	raw, err := bson.Marshal(ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.events <- raw
+}
+
+func (s *fakeStream) Next(ctx context.Context) bool {
+	select {
+	case ev, ok := <-s.events:
+		s.current = ev
+		return ok
+	case <-ctx.Done():
+		s.err = ctx.Err()
+		return false
+	}
+}
+
+func (s *fakeStream) Decode(val any) error {
+	return bson.Unmarshal(s.current, val)
+}
+
+func (s *fakeStream) Err() error {
+	return s.err
+}
+
+func (s *fakeStream) Close(ctx context.Context) error {
+	s.once.Do(func() { close(s.closed) })
+	return nil
+}
+
+// watchCollection is a MemoryCollection with a fake change stream
+type watchCollection struct {
+	Collection
+	stream   *fakeStream
+	pipeline any
+	opts     *options.ChangeStreamOptions
+}
+
+func (coll *watchCollection) watchStream(ctx context.Context, pipeline any, opts ...*options.ChangeStreamOptions) (eventStream, error) {
+	coll.pipeline = pipeline
+	coll.opts = opts[0]
+	return coll.stream, nil
+}
+
+// watchDatabase provides the same collection for every name
+type watchDatabase struct {
+	coll Collection
+}
+
+func (db watchDatabase) Collection(name string) Collection {
+	return db.coll
+}
+
+type orderChange struct {
+	OperationType string `bson:"operationType" json:"op"`
+	Document      struct {
+		Number int `bson:"number" json:"number"`
+	} `bson:"fullDocument" json:"doc"`
+}
+
+func orderEvent(op string, number int) bson.M {
+	return bson.M{"operationType": op, "fullDocument": bson.M{"number": number}}
+}
+
+// messageLogger records the messages that are logged
+type messageLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *messageLogger) LogMessage(msg string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, msg)
+}
+
+func (l *messageLogger) LogStageStart(print string, in any)                                      {}
+func (l *messageLogger) LogStageComplete(success bool, elapsed time.Duration, p string, out any) {}
+func (l *messageLogger) LogStageError(e *StageError)                                             {}
+
+func (l *messageLogger) logged() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string{}, l.messages...)
+}
+
+// waitClosed fails the test if ch isn't closed within a few seconds
+func waitClosed(t *testing.T, ch <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal(what)
+	}
+}
+
+func TestMongoWatch(t *testing.T) {
+
+	stream := newFakeStream(2)
+	coll := &watchCollection{Collection: NewMemoryDatabase().Collection("orders"), stream: stream}
+	db := Static(watchDatabase{coll})
+
+	stream.send(t, orderEvent("insert", 1))
+	stream.send(t, orderEvent("update", 2))
+	close(stream.events)
+
+	ch := First(MongoWatch(db, "orders", MongoWatchOptions{Event: &orderChange{}, FullDocument: true})).Then(SSE("order"))
+	rec := httptest.NewRecorder()
+	HTTPHandler(ch, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	want := "event:order\ndata:{\"op\":\"insert\",\"doc\":{\"number\":1}}\n\n" +
+		"event:order\ndata:{\"op\":\"update\",\"doc\":{\"number\":2}}\n\n"
+	if rec.Code != http.StatusOK || rec.Body.String() != want {
+		t.Errorf("response = %d %q, want %q", rec.Code, rec.Body.String(), want)
+	}
+	waitClosed(t, stream.closed, "the stream was not closed after its last event")
+
+	// With no input, every change is watched, and the options reach the stream
+	if !reflect.DeepEqual(coll.pipeline, mongo.Pipeline{}) {
+		t.Errorf("pipeline = %#v", coll.pipeline)
+	}
+	if coll.opts.FullDocument == nil || *coll.opts.FullDocument != options.UpdateLookup {
+		t.Errorf("FullDocument = %v", coll.opts.FullDocument)
+	}
+}
+
+// TestMongoWatchClientDisconnect checks that the change stream and the channel are closed when the client goes
+// away in the middle of the stream
+func TestMongoWatchClientDisconnect(t *testing.T) {
+
+	stream := newFakeStream(1)
+	db := Static(watchDatabase{&watchCollection{Collection: NewMemoryDatabase().Collection("orders"), stream: stream}})
+
+	// Relay the channel to the client through a stage that reports when the channel is closed
+	channelClosed := make(chan struct{})
+	relay := S("relay =>", func(in any, c Context, lgr Logger) (any, error) {
+		out := make(chan any)
+		go func() {
+			defer close(out)
+			for ev := range in.(<-chan any) {
+				select {
+				case out <- ev:
+				case <-c.Context().Done():
+				}
+			}
+			close(channelClosed)
+		}()
+		return (<-chan any)(out), nil
+	})
+	ch := First(MongoWatch(db, "orders", MongoWatchOptions{Event: &orderChange{}})).Then(relay).Then(Stream())
+
+	srv := httptest.NewServer(HTTPHandler(ch, nil, nil))
+	defer srv.Close()
+
+	// The response starts with the first event
+	stream.send(t, orderEvent("insert", 1))
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(res.Body)
+	for i := 1; i <= 2; i++ {
+		if i > 1 {
+			stream.send(t, orderEvent("insert", i))
+		}
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.Contains(line, `"number":`) {
+			t.Fatalf("event %d = %q, %v", i, line, err)
+		}
+	}
+
+	cancel()
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	waitClosed(t, stream.closed, "the change stream was not closed after the client disconnected")
+	waitClosed(t, channelClosed, "the event channel was not closed after the client disconnected")
+}
+
+func TestMongoWatchDecodeError(t *testing.T) {
+
+	stream := newFakeStream(1)
+	db := Static(watchDatabase{&watchCollection{Collection: NewMemoryDatabase().Collection("orders"), stream: stream}})
+	stream.send(t, bson.M{"operationType": 7})
+
+	lgr := &messageLogger{}
+	out, e := ExecuteStandalone(context.Background(), First(MongoWatch(db, "orders", MongoWatchOptions{Event: &orderChange{}})), nil, lgr)
+	if e != nil {
+		t.Fatal(e.Err)
+	}
+
+	// The channel closes without sending the event, and the error is logged
+	if ev, ok := <-out.(<-chan any); ok {
+		t.Errorf("sent %v", ev)
+	}
+	waitClosed(t, stream.closed, "the stream was not closed after a decode error")
+	logged := lgr.logged()
+	if last := logged[len(logged)-1]; !strings.HasPrefix(last, `MongoWatch("orders"): error decoding key operationType`) {
+		t.Errorf("logged %q", last)
+	}
+}
+
+func TestMongoWatchErrors(t *testing.T) {
+
+	tests := []struct {
+		name string
+		db   Database
+		in   any
+		body string
+	}{
+		{"no change streams", NewMemoryDatabase(), nil,
+			`{"error":"MongoWatch: *rpmongo.MemoryCollection does not support change streams"}`},
+		{"not a pipeline", watchDatabase{&watchCollection{Collection: NewMemoryDatabase().Collection("orders"), stream: newFakeStream(0)}}, "orders",
+			`{"error":"MongoWatch: expected a pipeline, got string"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := First(S("in =>", func(any, Context, Logger) (any, error) {
+				return tt.in, nil
+			})).Then(MongoWatch(Static(tt.db), "orders")).Then(Stream())
+
+			rec := httptest.NewRecorder()
+			HTTPHandler(ch, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Code != ISR || rec.Body.String() != tt.body {
+				t.Errorf("response = %d %s, want %s", rec.Code, rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
@@ -1,17 +1,13 @@
 package rp
 
-import (
-	"fmt"
-
-	"github.com/gin-gonic/gin"
-)
+import "fmt"
 
 type pipeResult struct {
 	Out   any
 	Error *StageError
 }
 
-func runInParallel(ch *Chain, c *gin.Context, lgr Logger, r chan pipeResult) {
+func runInParallel(ch *Chain, c Context, lgr Logger, r chan pipeResult) {
 	o, e := Execute(ch, c, lgr)
 	r <- pipeResult{
 		Out:   o,
@@ -20,12 +16,21 @@ func runInParallel(ch *Chain, c *gin.Context, lgr Logger, r chan pipeResult) {
 }
 
 type parallelError struct {
-	error
 	StageError *StageError
 }
 
 func (e parallelError) Error() string {
-	return "parallel error"
+	if e.StageError == nil {
+		return "parallel error"
+	}
+	return "parallel error: " + e.StageError.Error()
+}
+
+func (e parallelError) Unwrap() error {
+	if e.StageError == nil {
+		return nil
+	}
+	return e.StageError
 }
 
 func InParallel(chains ...*Chain) *Chain {
@@ -35,7 +40,7 @@ func InParallel(chains ...*Chain) *Chain {
 			return fmt.Sprintf("InParallel: %d chains", len(chains))
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 
 			resultChans := make([](chan pipeResult), len(chains))
 
@@ -67,5 +72,7 @@ func InParallel(chains ...*Chain) *Chain {
 		E: func(err error) *StageError {
 			return err.(parallelError).StageError
 		},
+
+		Nested: chains,
 	})
 }
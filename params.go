@@ -0,0 +1,286 @@
+package rp
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamError is returned by the typed query parameter stages. It becomes a 400 response that names the
+// offending parameter, like {"error": "Invalid query parameter \"page\": must be an integer", "param": "page"}.
+type ParamError struct {
+	Param  string
+	Reason string
+}
+
+func (e ParamError) Error() string {
+	return "Invalid query parameter \"" + e.Param + "\": " + e.Reason
+}
+
+func paramError(err error) *StageError {
+	obj := H{"error": err.Error()}
+	if pe, ok := err.(ParamError); ok {
+		obj["param"] = pe.Param
+	}
+	return &StageError{
+		Code: BR,
+		Obj:  obj,
+	}
+}
+
+// queryValues returns the non-empty values of the query parameter.
+func queryValues(c Context, key string) ([]string, error) {
+	if c.Request() == nil {
+		return nil, ErrNoRequest
+	}
+	vals := []string{}
+	for _, val := range c.Request().URL.Query()[key] {
+		if val != "" {
+			vals = append(vals, val)
+		}
+	}
+	return vals, nil
+}
+
+// queryValue returns the first non-empty value of the query parameter. It is a ParamError if the parameter
+// is missing and required.
+func queryValue(c Context, key string, required bool) (string, bool, error) {
+	vals, err := queryValues(c, key)
+	if err != nil {
+		return "", false, err
+	}
+	if len(vals) == 0 {
+		if required {
+			return "", false, ParamError{Param: key, Reason: "is required"}
+		}
+		return "", false, nil
+	}
+	return vals[0], true, nil
+}
+
+type IntOptions struct {
+	Required bool // If true, a missing parameter is an error. Otherwise Default is output.
+	Default  int
+	Min      *int // Optional inclusive bounds
+	Max      *int
+}
+
+// QueryInt outputs the query parameter as an int.
+func QueryInt(key string, opts ...IntOptions) *Stage {
+	opt := IntOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query(\"" + key + "\").(int) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			val, ok, err := queryValue(c, key, opt.Required)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return opt.Default, nil
+			}
+
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return nil, ParamError{Param: key, Reason: "must be an integer"}
+			}
+			if opt.Min != nil && n < *opt.Min {
+				return nil, ParamError{Param: key, Reason: "must be at least " + strconv.Itoa(*opt.Min)}
+			}
+			if opt.Max != nil && n > *opt.Max {
+				return nil, ParamError{Param: key, Reason: "must be at most " + strconv.Itoa(*opt.Max)}
+			}
+			return n, nil
+		},
+
+		E: paramError,
+	}
+}
+
+type BoolOptions struct {
+	Required bool // If true, a missing parameter is an error. Otherwise Default is output.
+	Default  bool
+}
+
+// QueryBool outputs the query parameter as a bool. It accepts the values understood by strconv.ParseBool.
+func QueryBool(key string, opts ...BoolOptions) *Stage {
+	opt := BoolOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query(\"" + key + "\").(bool) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			val, ok, err := queryValue(c, key, opt.Required)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return opt.Default, nil
+			}
+
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return nil, ParamError{Param: key, Reason: "must be true or false"}
+			}
+			return b, nil
+		},
+
+		E: paramError,
+	}
+}
+
+type TimeOptions struct {
+	Required bool // If true, a missing parameter is an error. Otherwise Default is output.
+	Default  time.Time
+	Min      time.Time // Optional inclusive bounds. Zero means no bound.
+	Max      time.Time
+}
+
+// QueryTime outputs the query parameter as a time.Time, parsed in UTC with the given layout.
+func QueryTime(key string, layout string, opts ...TimeOptions) *Stage {
+	opt := TimeOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query(\"" + key + "\").(time.Time) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			val, ok, err := queryValue(c, key, opt.Required)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return opt.Default, nil
+			}
+
+			t, err := time.Parse(layout, val)
+			if err != nil {
+				return nil, ParamError{Param: key, Reason: "must be a time formatted as " + layout}
+			}
+			if !opt.Min.IsZero() && t.Before(opt.Min) {
+				return nil, ParamError{Param: key, Reason: "must not be before " + opt.Min.Format(layout)}
+			}
+			if !opt.Max.IsZero() && t.After(opt.Max) {
+				return nil, ParamError{Param: key, Reason: "must not be after " + opt.Max.Format(layout)}
+			}
+			return t, nil
+		},
+
+		E: paramError,
+	}
+}
+
+type EnumOptions struct {
+	Required bool // If true, a missing parameter is an error. Otherwise Default is output.
+	Default  string
+}
+
+// QueryEnum outputs the query parameter as a string, which must be one of values.
+func QueryEnum(key string, values []string, opts ...EnumOptions) *Stage {
+	opt := EnumOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query(\"" + key + "\").(" + strings.Join(values, "|") + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			val, ok, err := queryValue(c, key, opt.Required)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return opt.Default, nil
+			}
+
+			for _, v := range values {
+				if val == v {
+					return val, nil
+				}
+			}
+			return nil, ParamError{Param: key, Reason: "must be one of " + strings.Join(values, ", ")}
+		},
+
+		E: paramError,
+	}
+}
+
+type ListOptions struct {
+	Required  bool // If true, a missing parameter is an error. Otherwise Default is output.
+	Default   []string
+	Separator string // Default is ",". Repeated parameters (?tag=a&tag=b) are also accepted.
+	MinItems  int    // Optional bounds on the number of items. 0 means no bound.
+	MaxItems  int
+}
+
+// QueryList outputs the query parameter as a []string, split on the separator with empty items removed.
+func QueryList(key string, opts ...ListOptions) *Stage {
+	opt := ListOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.Separator == "" {
+		opt.Separator = ","
+	}
+	return &Stage{
+
+		P: func() string {
+			return "Req.Query(\"" + key + "\").([]string) =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			vals, err := queryValues(c, key)
+			if err != nil {
+				return nil, err
+			}
+
+			items := []string{}
+			for _, val := range vals {
+				for _, item := range strings.Split(val, opt.Separator) {
+					if item = strings.TrimSpace(item); item != "" {
+						items = append(items, item)
+					}
+				}
+			}
+
+			if len(items) == 0 {
+				if opt.Required {
+					return nil, ParamError{Param: key, Reason: "is required"}
+				}
+				return opt.Default, nil
+			}
+			if opt.MinItems > 0 && len(items) < opt.MinItems {
+				return nil, ParamError{Param: key, Reason: "must have at least " + strconv.Itoa(opt.MinItems) + " items"}
+			}
+			if opt.MaxItems > 0 && len(items) > opt.MaxItems {
+				return nil, ParamError{Param: key, Reason: "must have at most " + strconv.Itoa(opt.MaxItems) + " items"}
+			}
+			return items, nil
+		},
+
+		E: paramError,
+	}
+}
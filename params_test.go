@@ -0,0 +1,133 @@
+package rp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// paramCase is a request to a route that runs a single parameter stage and responds with its output
+type paramCase struct {
+	name  string
+	stage *Stage
+	query string
+	want  string // JSON of the output, or of the error body for a 400
+	code  int    // Default is 200
+}
+
+func runParamCases(t *testing.T, tests []paramCase, prepare func(*http.Request)) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodGet, "/p?"+tt.query, nil)
+			if prepare != nil {
+				prepare(req)
+			}
+			rec := serve("/p", echoRoute(tt.stage), req)
+
+			code := tt.code
+			if code == 0 {
+				code = http.StatusOK
+			}
+			if rec.Code != code || rec.Body.String() != tt.want {
+				t.Errorf("got %d %s, want %d %s", rec.Code, rec.Body.String(), code, tt.want)
+			}
+		})
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func TestQueryStages(t *testing.T) {
+
+	day := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	dayJSON, _ := json.Marshal(day)
+	layout := "2006-01-02"
+	bounds := TimeOptions{Min: day, Max: day.AddDate(0, 1, 0)}
+
+	runParamCases(t, []paramCase{
+		{"QueryInt", QueryInt("page"), "page=3", `3`, 0},
+		{"QueryInt default", QueryInt("page", IntOptions{Default: 1}), "", `1`, 0},
+		{"QueryInt empty uses default", QueryInt("page", IntOptions{Default: 1}), "page=", `1`, 0},
+		{"QueryInt required", QueryInt("page", IntOptions{Required: true}), "", `{"error":"Invalid query parameter \"page\": is required","param":"page"}`, BR},
+		{"QueryInt not an integer", QueryInt("page"), "page=two", `{"error":"Invalid query parameter \"page\": must be an integer","param":"page"}`, BR},
+		{"QueryInt min", QueryInt("page", IntOptions{Min: ptr(1)}), "page=0", `{"error":"Invalid query parameter \"page\": must be at least 1","param":"page"}`, BR},
+		{"QueryInt max", QueryInt("limit", IntOptions{Max: ptr(100)}), "limit=101", `{"error":"Invalid query parameter \"limit\": must be at most 100","param":"limit"}`, BR},
+		{"QueryInt bounds inclusive", QueryInt("limit", IntOptions{Min: ptr(1), Max: ptr(100)}), "limit=100", `100`, 0},
+		{"QueryInt first non-empty value", QueryInt("page"), "page=&page=4&page=5", `4`, 0},
+
+		{"QueryBool", QueryBool("paid"), "paid=1", `true`, 0},
+		{"QueryBool default", QueryBool("paid", BoolOptions{Default: true}), "", `true`, 0},
+		{"QueryBool required", QueryBool("paid", BoolOptions{Required: true}), "", `{"error":"Invalid query parameter \"paid\": is required","param":"paid"}`, BR},
+		{"QueryBool invalid", QueryBool("paid"), "paid=yes", `{"error":"Invalid query parameter \"paid\": must be true or false","param":"paid"}`, BR},
+
+		{"QueryTime", QueryTime("from", layout), "from=2024-05-01", string(dayJSON), 0},
+		{"QueryTime default", QueryTime("from", layout, TimeOptions{Default: day}), "", string(dayJSON), 0},
+		{"QueryTime required", QueryTime("from", layout, TimeOptions{Required: true}), "", `{"error":"Invalid query parameter \"from\": is required","param":"from"}`, BR},
+		{"QueryTime invalid", QueryTime("from", layout), "from=May", `{"error":"Invalid query parameter \"from\": must be a time formatted as 2006-01-02","param":"from"}`, BR},
+		{"QueryTime min", QueryTime("from", layout, bounds), "from=2024-04-30", `{"error":"Invalid query parameter \"from\": must not be before 2024-05-01","param":"from"}`, BR},
+		{"QueryTime max", QueryTime("from", layout, bounds), "from=2024-06-02", `{"error":"Invalid query parameter \"from\": must not be after 2024-06-01","param":"from"}`, BR},
+		{"QueryTime bounds inclusive", QueryTime("from", layout, bounds), "from=2024-05-01", string(dayJSON), 0},
+
+		{"QueryEnum", QueryEnum("order", []string{"asc", "desc"}), "order=desc", `"desc"`, 0},
+		{"QueryEnum default", QueryEnum("order", []string{"asc", "desc"}, EnumOptions{Default: "asc"}), "", `"asc"`, 0},
+		{"QueryEnum required", QueryEnum("order", []string{"asc", "desc"}, EnumOptions{Required: true}), "", `{"error":"Invalid query parameter \"order\": is required","param":"order"}`, BR},
+		{"QueryEnum invalid", QueryEnum("order", []string{"asc", "desc"}), "order=up", `{"error":"Invalid query parameter \"order\": must be one of asc, desc","param":"order"}`, BR},
+
+		{"QueryList", QueryList("tag"), "tag=a,%20b,,c", `["a","b","c"]`, 0},
+		{"QueryList repeated", QueryList("tag"), "tag=a&tag=b,c", `["a","b","c"]`, 0},
+		{"QueryList separator", QueryList("tag", ListOptions{Separator: "|"}), "tag=a,b|c", `["a,b","c"]`, 0},
+		{"QueryList default", QueryList("tag", ListOptions{Default: []string{"x"}}), "tag=,", `["x"]`, 0},
+		{"QueryList required", QueryList("tag", ListOptions{Required: true}), "", `{"error":"Invalid query parameter \"tag\": is required","param":"tag"}`, BR},
+		{"QueryList min", QueryList("tag", ListOptions{MinItems: 2}), "tag=a", `{"error":"Invalid query parameter \"tag\": must have at least 2 items","param":"tag"}`, BR},
+		{"QueryList max", QueryList("tag", ListOptions{MaxItems: 2}), "tag=a,b,c", `{"error":"Invalid query parameter \"tag\": must have at most 2 items","param":"tag"}`, BR},
+
+		{"QueryParam", QueryParam("q"), "q=shoes", `"shoes"`, 0},
+		{"QueryParam missing", QueryParam("q"), "", `""`, 0},
+	}, nil)
+}
+
+func TestHeaderAndCookie(t *testing.T) {
+
+	runParamCases(t, []paramCase{
+		{"Header", Header("X-Api-Key"), "", `"secret"`, 0},
+		{"Header case-insensitive", Header("x-api-key"), "", `"secret"`, 0},
+		{"Header missing", Header("X-Tenant"), "", `{"error":"Invalid request: missing header X-Tenant"}`, BR},
+		{"Cookie", Cookie("session"), "", `"abc123"`, 0},
+		{"Cookie missing", Cookie("theme"), "", `{"error":"Invalid request: missing cookie theme"}`, BR},
+	}, func(req *http.Request) {
+		req.Header.Set("X-Api-Key", "secret")
+		req.AddCookie(&http.Cookie{Name: "session", Value: "abc123"})
+	})
+}
+
+func TestParamStagePrints(t *testing.T) {
+
+	tests := []struct {
+		stage *Stage
+		want  string
+	}{
+		{QueryInt("page"), "Req.Query(\"page\").(int) =>"},
+		{QueryBool("paid"), "Req.Query(\"paid\").(bool) =>"},
+		{QueryTime("from", time.RFC3339), "Req.Query(\"from\").(time.Time) =>"},
+		{QueryEnum("order", []string{"asc", "desc"}), "Req.Query(\"order\").(asc|desc) =>"},
+		{QueryList("tag"), "Req.Query(\"tag\").([]string) =>"},
+		{Header("X-Api-Key"), "Req.Header(\"X-Api-Key\") =>"},
+		{Cookie("session"), "Req.Cookie(\"session\") =>"},
+		{MultipartFile("doc"), "Req.File(\"doc\") =>"},
+		{BindQuery(&echoBody{}), "Req.Query =>"},
+		{BindForm(&echoBody{}), "Req.Form =>"},
+		{BindHeader(&echoBody{}), "Req.Header =>"},
+		{BindURI(&echoBody{}), "Req.URL =>"},
+	}
+	for _, tt := range tests {
+		if got := tt.stage.P(); got != tt.want {
+			t.Errorf("P() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -1,31 +1,346 @@
 package rp
 
-import "github.com/gin-gonic/gin"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
 
-func Bind(obj any) *Stage {
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+var ErrNoRequest = errors.New("no HTTP request in context")
+
+// invalidRequest is the E function shared by the request parsing stages
+func invalidRequest(err error) *StageError {
+	var ve ValidationError
+	if errors.As(err, &ve) {
+		return &StageError{
+			Code: BR,
+			Obj:  validationErrorObj(ve),
+		}
+	}
+	return &StageError{
+		Code: BR,
+		Obj:  H{"error": "Invalid request: " + err.Error()},
+	}
+}
+
+// newInstance returns a func that allocates a new value of the type that obj points to, holding a copy of the
+// value that obj points to. The binding stages decode into a new value on every execution so that concurrent
+// requests never share one, while values pre-filled in obj act as defaults. It panics if obj is not a pointer.
+func newInstance(obj any) func() any {
+	v := reflect.ValueOf(obj)
+	if v.Kind() != reflect.Pointer {
+		panic(fmt.Sprintf("rp: binding target must be a pointer, like &T{}, got %T", obj))
+	}
+	t := v.Type().Elem()
+	return func() any {
+		n := reflect.New(t)
+		if !v.IsNil() {
+			n.Elem().Set(copyValue(v.Elem()))
+		}
+		return n.Interface()
+	}
+}
+
+// copyValue returns a copy of v that shares no pointers, slices or maps with it, so that decoding into the copy
+// never writes to v. Unexported struct fields are copied shallowly.
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(copyValue(v.Elem()))
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			c.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return c
+	}
+	return v
+}
+
+// bindStage creates a stage that decodes part of the request with the given gin binding, which also validates
+// the result per its `binding` struct tags. Validation failures are reported per field.
+// Each execution decodes into, and outputs, a new copy of the value that obj points to.
+func bindStage(print string, obj any, bind func(*http.Request, any) error) *Stage {
+	alloc := newInstance(obj)
 	return &Stage{
 
 		P: func() string {
-			return "Req.Body =>"
+			return print
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
-			err := c.ShouldBindJSON(obj)
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			if c.Request() == nil {
+				return nil, ErrNoRequest
+			}
+			target := alloc()
+			err := bind(c.Request(), target)
 			if err != nil {
+				return nil, validationError(err, reflect.TypeOf(target), DefaultTranslator)
+			}
+			return target, nil
+		},
+
+		E: invalidRequest,
+	}
+}
+
+var (
+	ErrBodyTooLarge         = errors.New("request body too large")
+	ErrUnsupportedMediaType = errors.New("request body must be JSON")
+)
+
+type BindOptions struct {
+	// If true, fields in the body that obj doesn't have are an error. Default is false.
+	DisallowUnknownFields bool
+	// Maximum body size in bytes. Larger bodies are a 413 error. Default is 0, meaning no limit.
+	MaxBodyBytes int64
+	// If true, a Content-Type other than application/json (or a +json type) is a 415 error. Default is false.
+	RequireJSON bool
+	// If true, anything but whitespace after the JSON value is an error. Default is false, which ignores it
+	// like gin's ShouldBindJSON does.
+	DisallowTrailingData bool
+	// Custom rules for this stage only, by the name used in the `binding` struct tags. When set, the body is
+	// validated by a validator of this stage's own, like Validate does, rather than by gin's binding.Validator.
+	Rules map[string]validator.Func
+	// Creates the messages of the FieldErrors. Default is DefaultTranslator.
+	Translator Translator
+}
+
+// Bind decodes the JSON request body and validates it per its `binding` struct tags. obj must be a pointer,
+// like &PurchaseRequestBody{}, and Bind panics when the route is built if it isn't. obj is never written to:
+// every execution decodes into, and outputs, a new copy of the value that obj points to, so that fields
+// pre-filled in obj are defaults for the ones missing from the body. Without options, the body is decoded like gin's ShouldBindJSON, including its
+// binding.EnableDecoderUseNumber and binding.EnableDecoderDisallowUnknownFields settings.
+func Bind(obj any, opts ...BindOptions) *Stage {
+
+	opt := BindOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	alloc := newInstance(obj)
+
+	validate := func(obj any) error {
+		return binding.Validator.ValidateStruct(obj)
+	}
+	if len(opt.Rules) > 0 {
+		v := stageValidator("rp.Bind", "binding", opt.Rules)
+		validate = func(obj any) error {
+			if reflect.Indirect(reflect.ValueOf(obj)).Kind() != reflect.Struct {
+				return nil
+			}
+			return v.Struct(obj)
+		}
+	}
+
+	return &Stage{
+
+		P: func() string {
+			return "Req.Body =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			req := c.Request()
+			if req == nil {
+				return nil, ErrNoRequest
+			}
+
+			if opt.RequireJSON && !isJSONContentType(req.Header.Get("Content-Type")) {
+				return nil, ErrUnsupportedMediaType
+			}
+
+			target := alloc()
+
+			if err := decodeJSON(c, target, opt); err != nil {
 				return nil, err
 			}
-			return obj, nil
+
+			if err := validate(target); err != nil {
+				return nil, validationError(err, reflect.TypeOf(target), translator(opt.Translator))
+			}
+			return target, nil
 		},
 
 		E: func(err error) *StageError {
-			return &StageError{
-				Code: BR,
-				Obj:  H{"error": "Invalid request: " + err.Error()},
+			if errors.Is(err, ErrBodyTooLarge) {
+				return &StageError{
+					Code: http.StatusRequestEntityTooLarge,
+					Obj:  H{"error": "Request body too large"},
+				}
 			}
+			if errors.Is(err, ErrUnsupportedMediaType) {
+				return &StageError{
+					Code: http.StatusUnsupportedMediaType,
+					Obj:  H{"error": "Request body must be JSON"},
+				}
+			}
+			return invalidRequest(err)
 		},
 	}
 }
 
+func decodeJSON(c Context, obj any, opt BindOptions) error {
+
+	req := c.Request()
+	if req.Body == nil {
+		return errors.New("missing request body")
+	}
+
+	body := req.Body
+	if opt.MaxBodyBytes > 0 {
+		body = http.MaxBytesReader(c.Writer(), body, opt.MaxBodyBytes)
+	}
+
+	dec := json.NewDecoder(body)
+	if binding.EnableDecoderUseNumber {
+		dec.UseNumber()
+	}
+	if opt.DisallowUnknownFields || binding.EnableDecoderDisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(obj)
+	if err == nil && opt.DisallowTrailingData {
+		// Make sure there's nothing but whitespace after the value
+		if _, err = dec.Token(); err == io.EOF {
+			return nil
+		}
+		if !errors.As(err, new(*http.MaxBytesError)) {
+			err = errors.New("unexpected data after JSON body")
+		}
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return ErrBodyTooLarge
+	}
+	if err == io.EOF {
+		return errors.New("missing request body")
+	}
+	return err
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// BindNew is like Bind, with the type given as a type parameter. It outputs a *T.
+func BindNew[T any](opts ...BindOptions) *Stage {
+	return Bind(new(T), opts...)
+}
+
+// BindQuery decodes the URL query per obj's `form` struct tags. Like Bind, obj holds the defaults.
+func BindQuery(obj any) *Stage {
+	return bindStage("Req.Query =>", obj, binding.Query.Bind)
+}
+
+// BindForm decodes a URL-encoded or multipart form body per obj's `form` struct tags. Like Bind, obj
+// holds the defaults.
+func BindForm(obj any) *Stage {
+	return bindStage("Req.Form =>", obj, binding.Form.Bind)
+}
+
+// BindHeader decodes the request headers per obj's `header` struct tags. Like Bind, obj holds the defaults.
+func BindHeader(obj any) *Stage {
+	return bindStage("Req.Header =>", obj, binding.Header.Bind)
+}
+
+// BindURI decodes the path parameters per obj's `uri` struct tags. Like Bind, obj holds the defaults.
+func BindURI(obj any) *Stage {
+	alloc := newInstance(obj)
+	return &Stage{
+
+		P: func() string {
+			return "Req.URL =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			params := map[string][]string{}
+			uriParams(reflect.TypeOf(obj), c, params)
+			target := alloc()
+			err := binding.Uri.BindUri(params, target)
+			if err != nil {
+				return nil, validationError(err, reflect.TypeOf(target), DefaultTranslator)
+			}
+			return target, nil
+		},
+
+		E: invalidRequest,
+	}
+}
+
+// uriParams looks up the path parameter named by each `uri` struct tag of t, since Context has no way
+// of listing them.
+func uriParams(t reflect.Type, c Context, params map[string][]string) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			uriParams(f.Type, c, params)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("uri"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if val := c.Param(name); val != "" {
+			params[name] = []string{val}
+		}
+	}
+}
+
 func URLParam(key string) *Stage {
 	return &Stage{
 
@@ -33,7 +348,7 @@ func URLParam(key string) *Stage {
 			return "Req.URL(\"" + key + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
+		F: func(in any, c Context, lgr Logger) (any, error) {
 			return c.Param(key), nil
 		},
 	}
@@ -46,8 +361,164 @@ func QueryParam(key string) *Stage {
 			return "Req.Query(\"" + key + "\") =>"
 		},
 
-		F: func(in any, c *gin.Context, lgr Logger) (any, error) {
-			return c.Query(key), nil
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			if c.Request() == nil {
+				return "", nil
+			}
+			return c.Request().URL.Query().Get(key), nil
+		},
+	}
+}
+
+// Header outputs the value of the request header with the given name. A missing header is a 400 error.
+func Header(key string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "Req.Header(\"" + key + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			if c.Request() == nil {
+				return nil, ErrNoRequest
+			}
+			val := c.Request().Header.Get(key)
+			if val == "" {
+				return nil, errors.New("missing header " + key)
+			}
+			return val, nil
+		},
+
+		E: invalidRequest,
+	}
+}
+
+// Cookie outputs the value of the request cookie with the given name. A missing cookie is a 400 error.
+func Cookie(key string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "Req.Cookie(\"" + key + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			if c.Request() == nil {
+				return nil, ErrNoRequest
+			}
+			cookie, err := c.Request().Cookie(key)
+			if err != nil {
+				return nil, errors.New("missing cookie " + key)
+			}
+			return cookie.Value, nil
 		},
+
+		E: invalidRequest,
+	}
+}
+
+type MultipartFileOptions struct {
+	// Maximum file size in bytes. Default is 0, meaning no limit.
+	MaxSize int64
+	// Allowed MIME types, such as "application/pdf" or "image/*". Default is nil, meaning any type.
+	// The type is detected from the file's content with http.DetectContentType rather than trusting the client.
+	Types []string
+}
+
+const (
+	// multipartMaxMemory is how much of a multipart body is kept in memory, like http.Request.FormFile does.
+	// The rest is stored in temporary files.
+	multipartMaxMemory = 32 << 20
+	// multipartOverhead is the room left for boundaries, part headers and other fields on top of MaxSize
+	multipartOverhead = 1 << 20
+)
+
+// MultipartFile outputs the *multipart.FileHeader of the uploaded file in the given form field.
+// Call its Open method to read the file. With MaxSize set, the request body is limited to MaxSize plus a
+// small allowance for the rest of the form before it is parsed.
+func MultipartFile(field string, opts ...MultipartFileOptions) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "Req.File(\"" + field + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			if c.Request() == nil {
+				return nil, ErrNoRequest
+			}
+
+			opt := MultipartFileOptions{}
+			if len(opts) > 0 {
+				opt = opts[0]
+			}
+			tooLarge := errors.New("file " + field + " is larger than " + strconv.FormatInt(opt.MaxSize, 10) + " bytes")
+
+			// Limit the body before it is read, so that an oversized upload is rejected without being stored
+			r := c.Request()
+			if opt.MaxSize > 0 && r.MultipartForm == nil {
+				r.Body = http.MaxBytesReader(c.Writer(), r.Body, opt.MaxSize+multipartOverhead)
+			}
+
+			if err := r.ParseMultipartForm(multipartMaxMemory); err != nil {
+				var mbe *http.MaxBytesError
+				if errors.As(err, &mbe) {
+					return nil, tooLarge
+				}
+				return nil, errors.New("missing file " + field)
+			}
+			files := r.MultipartForm.File[field]
+			if len(files) == 0 {
+				return nil, errors.New("missing file " + field)
+			}
+			fh := files[0]
+
+			if opt.MaxSize > 0 && fh.Size > opt.MaxSize {
+				return nil, tooLarge
+			}
+
+			if len(opt.Types) > 0 {
+				mimeType, err := detectContentType(fh)
+				if err != nil {
+					return nil, err
+				}
+				if !mimeTypeAllowed(mimeType, opt.Types) {
+					return nil, errors.New("file " + field + " has unsupported type " + mimeType)
+				}
+			}
+
+			return fh, nil
+		},
+
+		E: invalidRequest,
+	}
+}
+
+func detectContentType(fh *multipart.FileHeader) (string, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 512)
+	n, err := f.Read(buf)
+	if err != nil && n == 0 && fh.Size > 0 {
+		return "", err
+	}
+
+	mimeType, _, _ := strings.Cut(http.DetectContentType(buf[:n]), ";")
+	return mimeType, nil
+}
+
+func mimeTypeAllowed(mimeType string, allowed []string) bool {
+	for _, t := range allowed {
+		if t == mimeType || t == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(t, "/*") && strings.HasPrefix(mimeType, strings.TrimSuffix(t, "*")) {
+			return true
+		}
 	}
+	return false
 }
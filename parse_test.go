@@ -0,0 +1,426 @@
+package rp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+)
+
+type echoBody struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Items []string `json:"items"`
+}
+
+// echoRoute binds the body with bind, yields so that concurrent requests interleave, and responds with the
+// bound value
+func echoRoute(bind *Stage) *Chain {
+	return First(
+		bind).Then(
+		S("yield =>", func(in any, c Context, lgr Logger) (any, error) {
+			runtime.Gosched()
+			return in, nil
+		})).Then(
+		S("echo", func(in any, c Context, lgr Logger) (any, error) {
+			return &Response{Code: http.StatusOK, Obj: in}, nil
+		}))
+}
+
+// TestBindConcurrentIsolation fires concurrent requests with different bodies at routes that bind with
+// Bind(&T{}) and BindNew[T](), and checks that each response echoes its own body. Run with -race.
+func TestBindConcurrentIsolation(t *testing.T) {
+
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.POST("/bind", MakeGinHandlerFunc(echoRoute(Bind(&echoBody{})), nil))
+	engine.POST("/bind-new", MakeGinHandlerFunc(echoRoute(BindNew[echoBody]()), nil))
+
+	const n = 200
+
+	for _, path := range []string{"/bind", "/bind-new"} {
+		t.Run(strings.TrimPrefix(path, "/"), func(t *testing.T) {
+
+			var wg sync.WaitGroup
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+
+					sent := echoBody{ID: i, Name: fmt.Sprintf("name-%d", i)}
+					// Only some bodies have items, so a shared target would leak them into other responses
+					if i%2 == 0 {
+						sent.Items = []string{fmt.Sprintf("item-%d", i)}
+					}
+					body, _ := json.Marshal(sent)
+
+					req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(string(body)))
+					req.Header.Set("Content-Type", "application/json")
+					rec := httptest.NewRecorder()
+					engine.ServeHTTP(rec, req)
+
+					if rec.Code != http.StatusOK {
+						t.Errorf("request %d: status %d, body %s", i, rec.Code, rec.Body.String())
+						return
+					}
+					var got echoBody
+					if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+						t.Errorf("request %d: %v", i, err)
+						return
+					}
+					if got.ID != sent.ID || got.Name != sent.Name || fmt.Sprint(got.Items) != fmt.Sprint(sent.Items) {
+						t.Errorf("request %d: sent %+v, got %+v", i, sent, got)
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+// serve handles req with ch on a gin engine that routes pattern to it
+func serve(pattern string, ch *Chain, req *http.Request) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Handle(req.Method, pattern, MakeGinHandlerFunc(ch, nil))
+	rec := httptest.NewRecorder()
+	engine.ServeHTTP(rec, req)
+	return rec
+}
+
+// jsonRequest is a POST to /bind with the given body and content type
+func jsonRequest(body, contentType string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/bind", strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return req
+}
+
+func TestBindOptions(t *testing.T) {
+
+	strict := BindOptions{DisallowUnknownFields: true, MaxBodyBytes: 32, RequireJSON: true, DisallowTrailingData: true}
+
+	tests := []struct {
+		name        string
+		opts        []BindOptions
+		body        string
+		contentType string
+		code        int
+		error       string
+	}{
+		// Without options, the body is decoded like ShouldBindJSON
+		{"default", nil, `{"id": 1, "name": "a"}`, "application/json", http.StatusOK, ""},
+		{"default unknown field", nil, `{"id": 1, "color": "red"}`, "application/json", http.StatusOK, ""},
+		{"default trailing data", nil, `{"id": 1} {"id": 2}`, "application/json", http.StatusOK, ""},
+		{"default content type", nil, `{"id": 1}`, "text/plain", http.StatusOK, ""},
+		{"default large body", nil, `{"id": 1, "name": "` + strings.Repeat("a", 100) + `"}`, "application/json", http.StatusOK, ""},
+		{"default empty body", nil, ``, "application/json", http.StatusBadRequest, "Invalid request: missing request body"},
+		{"default malformed", nil, `{"id": `, "application/json", http.StatusBadRequest, "Invalid request: unexpected EOF"},
+
+		{"strict", []BindOptions{strict}, `{"id": 1}`, "application/json", http.StatusOK, ""},
+		{"strict +json", []BindOptions{strict}, `{"id": 1}`, "application/vnd.api+json; charset=utf-8", http.StatusOK, ""},
+		{"strict trailing whitespace", []BindOptions{strict}, "{\"id\": 1}\n\t ", "application/json", http.StatusOK, ""},
+		{"unknown field", []BindOptions{strict}, `{"id": 1, "color": "red"}`, "application/json", http.StatusBadRequest,
+			`Invalid request: json: unknown field "color"`},
+		{"trailing data", []BindOptions{strict}, `{"id": 1} {"id": 2}`, "application/json", http.StatusBadRequest,
+			"Invalid request: unexpected data after JSON body"},
+		{"trailing garbage", []BindOptions{strict}, `{"id": 1}x`, "application/json", http.StatusBadRequest,
+			"Invalid request: unexpected data after JSON body"},
+		{"too large", []BindOptions{strict}, `{"id": 1, "name": "` + strings.Repeat("a", 100) + `"}`, "application/json",
+			http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"too large in trailing data", []BindOptions{strict}, `{"id": 1}` + strings.Repeat(" ", 100) + "x", "application/json",
+			http.StatusRequestEntityTooLarge, "Request body too large"},
+		{"not JSON", []BindOptions{strict}, `{"id": 1}`, "text/plain", http.StatusUnsupportedMediaType, "Request body must be JSON"},
+		{"no content type", []BindOptions{strict}, `{"id": 1}`, "", http.StatusUnsupportedMediaType, "Request body must be JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			rec := serve("/bind", echoRoute(Bind(&echoBody{}, tt.opts...)), jsonRequest(tt.body, tt.contentType))
+
+			if rec.Code != tt.code {
+				t.Fatalf("status = %d, want %d, body %s", rec.Code, tt.code, rec.Body.String())
+			}
+			if tt.error != "" {
+				var res map[string]any
+				json.Unmarshal(rec.Body.Bytes(), &res)
+				if res["error"] != tt.error {
+					t.Errorf("error = %v, want %q", res["error"], tt.error)
+				}
+			}
+		})
+	}
+}
+
+// TestBindDecoderSettings checks that Bind follows gin's global decoder settings, like ShouldBindJSON does
+func TestBindDecoderSettings(t *testing.T) {
+
+	defer func(useNumber, disallow bool) {
+		binding.EnableDecoderUseNumber = useNumber
+		binding.EnableDecoderDisallowUnknownFields = disallow
+	}(binding.EnableDecoderUseNumber, binding.EnableDecoderDisallowUnknownFields)
+	binding.EnableDecoderUseNumber = true
+	binding.EnableDecoderDisallowUnknownFields = true
+
+	var decoded any
+	ch := First(Bind(&map[string]any{})).Then(
+		S("capture", func(in any, c Context, lgr Logger) (any, error) {
+			decoded = (*in.(*map[string]any))["n"]
+			return &Response{Code: http.StatusOK, Obj: in}, nil
+		}))
+	if rec := serve("/bind", ch, jsonRequest(`{"n": 12345678901234567890}`, "application/json")); rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+	}
+	if n, ok := decoded.(json.Number); !ok || n.String() != "12345678901234567890" {
+		t.Errorf("decoded %T %v, want a json.Number", decoded, decoded)
+	}
+
+	rec := serve("/bind", echoRoute(Bind(&echoBody{})), jsonRequest(`{"id": 1, "color": "red"}`, "application/json"))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown field status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+type defaultsBody struct {
+	ID     int            `json:"id" form:"id"`
+	Name   string         `json:"name" form:"name"`
+	Tags   []string       `json:"tags" form:"tags"`
+	Limits map[string]int `json:"limits"`
+	Note   *string        `json:"note"`
+}
+
+// TestBindDefaults checks that values pre-filled in Bind's target are defaults for every request, and that
+// decoding never writes to the target
+func TestBindDefaults(t *testing.T) {
+
+	note := "none"
+	defaults := &defaultsBody{Name: "anon", Tags: []string{"a"}, Limits: map[string]int{"x": 1}, Note: &note}
+
+	bind := func(body string) defaultsBody {
+		t.Helper()
+		rec := serve("/bind", echoRoute(Bind(defaults)), jsonRequest(body, "application/json"))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", rec.Code, rec.Body.String())
+		}
+		var got defaultsBody
+		json.Unmarshal(rec.Body.Bytes(), &got)
+		return got
+	}
+
+	got := bind(`{"id": 1}`)
+	if got.ID != 1 || got.Name != "anon" || fmt.Sprint(got.Tags) != "[a]" || fmt.Sprint(got.Limits) != "map[x:1]" ||
+		got.Note == nil || *got.Note != "none" {
+		t.Errorf("with defaults = %+v", got)
+	}
+
+	got = bind(`{"name": "b", "tags": ["b", "c"], "limits": {"y": 2}, "note": "set"}`)
+	if got.Name != "b" || fmt.Sprint(got.Tags) != "[b c]" || fmt.Sprint(got.Limits) != "map[x:1 y:2]" || *got.Note != "set" {
+		t.Errorf("overriding defaults = %+v", got)
+	}
+
+	// Neither the target nor the next request see the previous body
+	if defaults.Name != "anon" || fmt.Sprint(defaults.Tags) != "[a]" || fmt.Sprint(defaults.Limits) != "map[x:1]" ||
+		note != "none" || defaults.Note != &note {
+		t.Errorf("target was written to: %+v", defaults)
+	}
+	got = bind(`{}`)
+	if fmt.Sprint(got.Tags) != "[a]" || fmt.Sprint(got.Limits) != "map[x:1]" || *got.Note != "none" {
+		t.Errorf("after an override = %+v", got)
+	}
+
+	// The other binding stages keep defaults too
+	req := httptest.NewRequest(http.MethodGet, "/query?id=7", nil)
+	rec := serve("/query", echoRoute(BindQuery(&defaultsBody{Name: "anon"})), req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"id":7,"name":"anon"`) {
+		t.Errorf("BindQuery = %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestBindTargetMustBePointer(t *testing.T) {
+
+	defer func() {
+		r := recover()
+		if want := "rp: binding target must be a pointer, like &T{}, got rp.echoBody"; r != want {
+			t.Errorf("panic = %v, want %q", r, want)
+		}
+	}()
+	Bind(echoBody{})
+}
+
+type searchQuery struct {
+	Term  string   `form:"q" binding:"required"`
+	Page  int      `form:"page" binding:"min=1"`
+	Tags  []string `form:"tag"`
+	Limit int      `form:"limit"`
+}
+
+type tenantHeader struct {
+	Tenant string `header:"X-Tenant" binding:"required"`
+	Trace  string `header:"X-Trace"`
+}
+
+type orderURI struct {
+	ID   int    `uri:"id" binding:"required,min=1"`
+	Part string `uri:"part"`
+}
+
+// TestBindVariants binds the query, a form body, the headers and the path parameters, with defaults pre-filled
+// in the target, and checks the 400 bodies that name the invalid field
+func TestBindVariants(t *testing.T) {
+
+	form := func(body string) func(*http.Request) {
+		return func(req *http.Request) {
+			req.Method = http.MethodPost
+			req.Body = io.NopCloser(strings.NewReader(body))
+			req.ContentLength = int64(len(body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	headers := func(kv ...string) func(*http.Request) {
+		return func(req *http.Request) {
+			for i := 0; i < len(kv); i += 2 {
+				req.Header.Set(kv[i], kv[i+1])
+			}
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pattern string
+		target  string
+		stage   *Stage
+		prepare func(*http.Request)
+		code    int
+		body    string
+	}{
+		{"query", "/s", "/s?q=shoes&page=2&tag=a&tag=b", BindQuery(&searchQuery{Limit: 20}), nil,
+			http.StatusOK, `{"Term":"shoes","Page":2,"Tags":["a","b"],"Limit":20}`},
+		{"query default", "/s", "/s?q=shoes", BindQuery(&searchQuery{Page: 1, Limit: 20}), nil,
+			http.StatusOK, `{"Term":"shoes","Page":1,"Tags":null,"Limit":20}`},
+		{"query required", "/s", "/s?page=2", BindQuery(&searchQuery{}), nil,
+			BR, `{"error":"Invalid request","fields":[{"field":"q","rule":"required","message":"q is required"}]}`},
+		{"query min", "/s", "/s?q=shoes&page=0", BindQuery(&searchQuery{}), nil,
+			BR, `{"error":"Invalid request","fields":[{"field":"page","rule":"min","message":"page must be at least 1"}]}`},
+		{"query not a number", "/s", "/s?q=shoes&page=two", BindQuery(&searchQuery{}), nil,
+			BR, ""},
+
+		{"form", "/s", "/s", BindForm(&searchQuery{Limit: 20}), form("q=boots&page=3&tag=x"),
+			http.StatusOK, `{"Term":"boots","Page":3,"Tags":["x"],"Limit":20}`},
+		{"form required", "/s", "/s", BindForm(&searchQuery{}), form("page=3"),
+			BR, `{"error":"Invalid request","fields":[{"field":"q","rule":"required","message":"q is required"}]}`},
+
+		{"header", "/s", "/s", BindHeader(&tenantHeader{Trace: "none"}), headers("X-Tenant", "acme"),
+			http.StatusOK, `{"Tenant":"acme","Trace":"none"}`},
+		{"header required", "/s", "/s", BindHeader(&tenantHeader{}), headers("X-Trace", "t1"),
+			BR, `{"error":"Invalid request","fields":[{"field":"X-Tenant","rule":"required","message":"X-Tenant is required"}]}`},
+
+		{"uri", "/orders/:id/:part", "/orders/17/lines", BindURI(&orderURI{}), nil,
+			http.StatusOK, `{"ID":17,"Part":"lines"}`},
+		{"uri default", "/orders/:id", "/orders/17", BindURI(&orderURI{Part: "all"}), nil,
+			http.StatusOK, `{"ID":17,"Part":"all"}`},
+		{"uri zero", "/orders/:id", "/orders/0", BindURI(&orderURI{}), nil,
+			BR, `{"error":"Invalid request","fields":[{"field":"id","rule":"required","message":"id is required"}]}`},
+		{"uri not a number", "/orders/:id", "/orders/abc", BindURI(&orderURI{}), nil,
+			BR, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.prepare != nil {
+				tt.prepare(req)
+			}
+			rec := serve(tt.pattern, echoRoute(tt.stage), req)
+
+			if rec.Code != tt.code {
+				t.Errorf("status %d, want %d, body %s", rec.Code, tt.code, rec.Body.String())
+			}
+			// Errors from decoding rather than validation come from the binding package, so only their prefix is checked
+			if tt.body == "" {
+				if !strings.HasPrefix(rec.Body.String(), `{"error":"Invalid request: `) {
+					t.Errorf("body = %s", rec.Body.String())
+				}
+			} else if rec.Body.String() != tt.body {
+				t.Errorf("body = %s\nwant %s", rec.Body.String(), tt.body)
+			}
+		})
+	}
+}
+
+// multipartRequest is a POST to /upload with a file named name holding content in the given field, and a
+// text field note
+func multipartRequest(field, name string, content []byte) *http.Request {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	w.WriteField("note", "hello")
+	if field != "" {
+		fw, _ := w.CreateFormFile(field, name)
+		fw.Write(content)
+	}
+	w.Close()
+	req := httptest.NewRequest(http.MethodPost, "/upload", &buf)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	return req
+}
+
+func TestMultipartFile(t *testing.T) {
+
+	png := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, 100)...)
+	text := []byte("just some text")
+	images := MultipartFileOptions{Types: []string{"image/*"}}
+
+	// respond with the name and size of the file, instead of the whole header
+	upload := func(s *Stage) *Chain {
+		return First(s).Then(S("respond", func(in any, c Context, lgr Logger) (any, error) {
+			fh := in.(*multipart.FileHeader)
+			return &Response{Code: http.StatusOK, Obj: H{"name": fh.Filename, "size": fh.Size}}, nil
+		}))
+	}
+
+	tests := []struct {
+		name  string
+		stage *Stage
+		req   *http.Request
+		code  int
+		body  string
+	}{
+		{"upload", MultipartFile("doc"), multipartRequest("doc", "a.txt", text),
+			http.StatusOK, `{"name":"a.txt","size":14}`},
+		{"missing file", MultipartFile("doc"), multipartRequest("other", "a.txt", text),
+			BR, `{"error":"Invalid request: missing file doc"}`},
+		{"not multipart", MultipartFile("doc"), jsonRequest(`{}`, "application/json"),
+			BR, `{"error":"Invalid request: missing file doc"}`},
+		{"allowed type", MultipartFile("doc", images), multipartRequest("doc", "a.png", png),
+			http.StatusOK, `{"name":"a.png","size":108}`},
+		{"exact type", MultipartFile("doc", MultipartFileOptions{Types: []string{"text/plain"}}), multipartRequest("doc", "a.txt", text),
+			http.StatusOK, `{"name":"a.txt","size":14}`},
+		{"unsupported type", MultipartFile("doc", images), multipartRequest("doc", "a.png", text),
+			BR, `{"error":"Invalid request: file doc has unsupported type text/plain"}`},
+		{"within size", MultipartFile("doc", MultipartFileOptions{MaxSize: 14}), multipartRequest("doc", "a.txt", text),
+			http.StatusOK, `{"name":"a.txt","size":14}`},
+		{"over size", MultipartFile("doc", MultipartFileOptions{MaxSize: 10}), multipartRequest("doc", "a.txt", text),
+			BR, `{"error":"Invalid request: file doc is larger than 10 bytes"}`},
+		// A body past the allowance is cut off while it is read, which must still be reported as too large
+		{"body over limit", MultipartFile("doc", MultipartFileOptions{MaxSize: 10}), multipartRequest("doc", "big.bin", make([]byte, multipartOverhead+100)),
+			BR, `{"error":"Invalid request: file doc is larger than 10 bytes"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serve(tt.req.URL.Path, upload(tt.stage), tt.req)
+			if rec.Code != tt.code || rec.Body.String() != tt.body {
+				t.Errorf("got %d %s, want %d %s", rec.Code, rec.Body.String(), tt.code, tt.body)
+			}
+		})
+	}
+}
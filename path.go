@@ -0,0 +1,273 @@
+package rp
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// pathSegment is one step of a path: a field name, an array index, or a wildcard.
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+func (s pathSegment) String() string {
+	switch {
+	case s.wildcard:
+		return "*"
+	case s.isIndex:
+		return "[" + strconv.Itoa(s.index) + "]"
+	}
+	return s.key
+}
+
+// parsePath splits a path like "items[0].tags.*" into its segments.
+func parsePath(path string) ([]pathSegment, error) {
+
+	segs := []pathSegment{}
+	for _, part := range strings.Split(path, ".") {
+
+		key, rest, bracket := strings.Cut(part, "[")
+		if key == "" && !bracket {
+			return nil, errors.New("empty field name in path \"" + path + "\"")
+		}
+		if bracket && rest == "" {
+			return nil, errors.New("malformed index in path \"" + path + "\"")
+		}
+		if key == "*" {
+			segs = append(segs, pathSegment{wildcard: true})
+		} else if key != "" {
+			segs = append(segs, pathSegment{key: key})
+		}
+
+		// Indices, like the "[0][1]" of "matrix[0][1]"
+		for rest != "" {
+			index, after, ok := strings.Cut(rest, "]")
+			if !ok || (after != "" && after[0] != '[') {
+				return nil, errors.New("malformed index in path \"" + path + "\"")
+			}
+			if index == "*" {
+				segs = append(segs, pathSegment{wildcard: true})
+			} else {
+				n, err := strconv.Atoi(index)
+				if err != nil || n < 0 {
+					return nil, errors.New("invalid index [" + index + "] in path \"" + path + "\"")
+				}
+				segs = append(segs, pathSegment{index: n, isIndex: true})
+			}
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return segs, nil
+}
+
+func hasWildcard(segs []pathSegment) bool {
+	for _, s := range segs {
+		if s.wildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// walkPath returns the values at the path in v. Without wildcards, there is exactly one value or an error
+// naming the part of the path that is missing. With wildcards, branches where the rest of the path is missing
+// are skipped.
+func walkPath(v any, segs []pathSegment, at string) ([]any, error) {
+
+	if len(segs) == 0 {
+		return []any{v}, nil
+	}
+	seg := segs[0]
+
+	next := at
+	if seg.isIndex {
+		next += seg.String()
+	} else if at == "" {
+		next = seg.String()
+	} else {
+		next += "." + seg.String()
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, errors.New(orRoot(at) + " is null")
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, errors.New(orRoot(at) + " is null")
+	}
+
+	if seg.wildcard {
+		children := []any{}
+		switch rv.Kind() {
+		case reflect.Map:
+			keys := rv.MapKeys()
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i].String() < keys[j].String()
+			})
+			for _, k := range keys {
+				children = append(children, rv.MapIndex(k).Interface())
+			}
+		case reflect.Slice, reflect.Array:
+			if d, ok := rv.Interface().(primitive.D); ok {
+				for _, e := range d {
+					children = append(children, e.Value)
+				}
+				break
+			}
+			for i := 0; i < rv.Len(); i++ {
+				children = append(children, rv.Index(i).Interface())
+			}
+		case reflect.Struct:
+			for _, f := range reflect.VisibleFields(rv.Type()) {
+				if f.IsExported() && !f.Anonymous && len(fieldKeys(f)) > 0 {
+					if fv, err := rv.FieldByIndexErr(f.Index); err == nil {
+						children = append(children, fv.Interface())
+					}
+				}
+			}
+		default:
+			return nil, errors.New(orRoot(at) + " has no fields or items")
+		}
+
+		results := []any{}
+		for _, child := range children {
+			if found, err := walkPath(child, segs[1:], next); err == nil {
+				results = append(results, found...)
+			}
+		}
+		return results, nil
+	}
+
+	if seg.isIndex {
+		if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+			return nil, errors.New(orRoot(at) + " is not an array")
+		}
+		if seg.index >= rv.Len() {
+			return nil, errors.New(next + " is out of range, the array has " + strconv.Itoa(rv.Len()) + " items")
+		}
+		return walkPath(rv.Index(seg.index).Interface(), segs[1:], next)
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() == reflect.String {
+			if val := rv.MapIndex(reflect.ValueOf(seg.key).Convert(rv.Type().Key())); val.IsValid() {
+				return walkPath(val.Interface(), segs[1:], next)
+			}
+			return nil, errors.New(next + " not found")
+		}
+	case reflect.Slice:
+		if d, ok := rv.Interface().(primitive.D); ok {
+			for _, e := range d {
+				if e.Key == seg.key {
+					return walkPath(e.Value, segs[1:], next)
+				}
+			}
+			return nil, errors.New(next + " not found")
+		}
+	case reflect.Struct:
+		for _, f := range reflect.VisibleFields(rv.Type()) {
+			if f.IsExported() && !f.Anonymous && matchesField(f, seg.key) {
+				fv, err := rv.FieldByIndexErr(f.Index)
+				if err != nil {
+					return nil, errors.New(next + " not found")
+				}
+				return walkPath(fv.Interface(), segs[1:], next)
+			}
+		}
+		return nil, errors.New(next + " not found")
+	}
+
+	return nil, errors.New(orRoot(at) + " is not an object")
+}
+
+// fieldKeys returns the keys that a struct field is decoded from: its json and bson tag names, and its name
+// unless a tag hides the field with "-"
+func fieldKeys(f reflect.StructField) []string {
+	keys := []string{}
+	hidden := false
+	for _, tag := range []string{"json", "bson"} {
+		val := f.Tag.Get(tag)
+		if val == "-" {
+			hidden = true
+			continue
+		}
+		if name, _, _ := strings.Cut(val, ","); name != "" {
+			keys = append(keys, name)
+		}
+	}
+	if !hidden {
+		keys = append(keys, f.Name)
+	}
+	return keys
+}
+
+// matchesField reports whether a struct field is decoded from the given key
+func matchesField(f reflect.StructField, key string) bool {
+	for _, k := range fieldKeys(f) {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+func orRoot(at string) string {
+	if at == "" {
+		return "the input"
+	}
+	return at
+}
+
+// Path outputs the value at the given path in in, such as "customer.address.zip" or "items[0].sku". It walks
+// maps, bson.D documents, slices and structs, matching struct fields by their json or bson tag or their name,
+// except that a field tagged "-" is only matched by the other tag.
+// A "*" segment, as in "items.*.sku" or "items[*].sku", matches every item of a slice or every value of a
+// map or struct, and makes the output a []any of the values found, skipping items that don't have the rest
+// of the path. Without wildcards, a missing path is an error that names the part that's missing.
+// Path panics if the path is malformed.
+func Path(path string) *Stage {
+
+	segs, err := parsePath(path)
+	if err != nil {
+		panic("rp.Path: " + err.Error())
+	}
+	wildcard := hasWildcard(segs)
+
+	return &Stage{
+
+		P: func() string {
+			return "  => Path(\"" + path + "\") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			found, err := walkPath(in, segs, "")
+			if err != nil {
+				return nil, errors.New("Path(\"" + path + "\"): " + err.Error())
+			}
+			if wildcard {
+				return found, nil
+			}
+			return found[0], nil
+		},
+
+		E: func(err error) *StageError {
+			return &StageError{
+				Code: ISR,
+				Obj:  H{"error": err.Error()},
+			}
+		},
+	}
+}
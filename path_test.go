@@ -0,0 +1,149 @@
+package rp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type pathAddress struct {
+	Zip    string `json:"zip"`
+	Secret string `json:"-"`
+	Hidden string `json:"-" bson:"shown"`
+}
+
+type pathCustomer struct {
+	Name    string         `json:"name" bson:"full_name"`
+	Address pathAddress    `json:"address"`
+	Orders  []pathOrder    `json:"orders"`
+	Tags    []string       `json:"tags"`
+	Note    *string        `json:"note"`
+	Extra   map[string]any `json:"extra"`
+}
+
+type pathOrder struct {
+	SKU string `json:"sku"`
+	Qty int    `json:"qty"`
+}
+
+// runPath runs Path(path) on in
+func runPath(path string, in any) (any, *StageError) {
+	return ExecuteStandalone(context.Background(), First(Path(path)), in, nil)
+}
+
+func TestPath(t *testing.T) {
+
+	customer := &pathCustomer{
+		Name:    "Sandra",
+		Address: pathAddress{Zip: "10001", Secret: "s3cret", Hidden: "h"},
+		Orders:  []pathOrder{{SKU: "A", Qty: 1}, {SKU: "B", Qty: 2}},
+		Tags:    []string{"vip"},
+		Extra:   map[string]any{"matrix": []any{[]any{1, 2}, []any{3, 4}}},
+	}
+	doc := map[string]any{
+		"items": []any{
+			map[string]any{"sku": "A", "tags": []any{"x", "y"}},
+			map[string]any{"sku": "B"},
+			bson.D{{Key: "sku", Value: "C"}},
+		},
+		"prices": map[string]any{"b": 2, "a": 1},
+	}
+
+	tests := []struct {
+		path string
+		in   any
+		want any
+	}{
+		// Fields by json tag, bson tag and Go name
+		{"name", customer, "Sandra"},
+		{"full_name", customer, "Sandra"},
+		{"Name", customer, "Sandra"},
+		{"address.zip", customer, "10001"},
+
+		// A field tagged json:"-" is still found by its bson tag
+		{"address.shown", customer, "h"},
+
+		// Indices
+		{"orders[1].sku", customer, "B"},
+		{"tags[0]", customer, "vip"},
+		{"extra.matrix[1][0]", customer, 3},
+		{"items[2].sku", doc, "C"},
+
+		// Wildcards
+		{"orders.*.sku", customer, []any{"A", "B"}},
+		{"orders[*].qty", customer, []any{1, 2}},
+		{"items.*.sku", doc, []any{"A", "B", "C"}},
+		{"items.*.tags[1]", doc, []any{"y"}},
+		{"prices.*", doc, []any{1, 2}},
+		{"address.*", customer, []any{"10001", "h"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			out, e := runPath(tt.path, tt.in)
+			if e != nil {
+				t.Fatalf("error: %v", e.Obj)
+			}
+			if fmt.Sprint(out) != fmt.Sprint(tt.want) {
+				t.Errorf("got %v, want %v", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestPathMissing(t *testing.T) {
+
+	customer := pathCustomer{Address: pathAddress{Secret: "s3cret"}, Orders: []pathOrder{{SKU: "A"}}}
+
+	tests := []struct {
+		path string
+		in   any
+		want string
+	}{
+		{"email", customer, "email not found"},
+		{"address.city", customer, "address.city not found"},
+		{"orders[3].sku", customer, "orders[3] is out of range, the array has 1 items"},
+		{"name[0]", customer, "name is not an array"},
+		{"name.first", customer, "name is not an object"},
+		{"note.text", customer, "note is null"},
+		{"sku", nil, "the input is null"},
+
+		// A field tagged json:"-" is not found by its Go name
+		{"address.Secret", customer, "address.Secret not found"},
+		{"address.Hidden", customer, "address.Hidden not found"},
+		{"address.-", customer, "address.- not found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			out, e := runPath(tt.path, tt.in)
+			if e == nil {
+				t.Fatalf("got %v, want an error", out)
+			}
+			want := "Path(\"" + tt.path + "\"): " + tt.want
+			if e.Code != ISR || e.Obj.(H)["error"] != want {
+				t.Errorf("got %d %v, want %q", e.Code, e.Obj, want)
+			}
+		})
+	}
+
+	// Wildcards skip the branches that don't have the rest of the path
+	out, e := runPath("orders.*.price", customer)
+	if e != nil || len(out.([]any)) != 0 {
+		t.Errorf("wildcard with missing path = %v, %v", out, e)
+	}
+}
+
+func TestPathMalformed(t *testing.T) {
+	for _, path := range []string{"a..b", "items[", "items[x]", "items[-1]", "items[0]x"} {
+		t.Run(path, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil || !strings.HasPrefix(fmt.Sprint(r), "rp.Path: ") {
+					t.Errorf("panic = %v", r)
+				}
+			}()
+			Path(path)
+		})
+	}
+}
@@ -1,9 +1,5 @@
 package rp
 
-import (
-	"github.com/gin-gonic/gin"
-)
-
 // Stage is a step in a request pipeline. Stages are connected together as double-linked lists by n and l.
 // When a pipeline is run, it executes each Stage's F function. The input to F is the output of the last Stage
 // plus the request's context. The output of F is, in turn, passed into the next Stage.
@@ -12,11 +8,13 @@ import (
 // The last Stage of a pipeline should return a *Response as the output of F.
 // When a stage completes, P() will be logged to the console with the results of the stage.
 type Stage struct {
-	P func() string                                // Printed name of the stage, for logging
-	F func(any, *gin.Context, Logger) (any, error) // Function to execute. Optional logger for stages that nest chains.
-	E func(error) *StageError                      // Network error to return for F's error
-	n *Stage                                       // Next stage
-	l *Stage                                       // Last stage
+	P      func() string                           // Printed name of the stage, for logging
+	F      func(any, Context, Logger) (any, error) // Function to execute. Optional logger for stages that nest chains.
+	E      func(error) *StageError                 // Network error to return for F's error
+	Nested []*Chain                                // Chains that F runs, like If's branches. Optional, for Walk.
+	Info   any                                     // Optional description for tools that Walk pipelines
+	n      *Stage                                  // Next stage
+	l      *Stage                                  // Last stage
 }
 
 func (s *Stage) Chain() *Chain {
@@ -90,6 +88,24 @@ func (ch *Chain) CatchError(E func(err error) *StageError) *Chain {
 	return ch
 }
 
+// Walk calls fn for each stage of ch in order, including the stages of the chains nested in them, which are
+// visited right after the stage that runs them. Tools that inspect pipelines at startup use it, like
+// rpmongo.EnsureIndexes.
+func Walk(ch *Chain, fn func(s *Stage)) {
+	if ch == nil {
+		return
+	}
+	for s := ch.First; s != nil; s = s.n {
+		fn(s)
+		for _, nested := range s.Nested {
+			Walk(nested, fn)
+		}
+		if s == ch.Last {
+			break
+		}
+	}
+}
+
 // InSequence concatenates together multiple chains defined by the above First+Then method.
 func InSequence(chains ...*Chain) *Chain {
 
@@ -0,0 +1,58 @@
+package rp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+
+	step := func(name string) *Stage {
+		return S(name, func(in any, c Context, lgr Logger) (any, error) {
+			return in, nil
+		})
+	}
+	always := func(in any, c Context) bool { return true }
+
+	ch := InSequence(
+		First(step("a")).Then(
+			If(always,
+				First(step("then-1")).Then(step("then-2")),
+				First(step("else")))),
+		InParallel(
+			First(step("p1")),
+			First(step("p2")).Then(If(always, First(step("deep")), nil))),
+		First(step("z")))
+
+	// The If and InParallel stages are listed as "*", since they print a summary of their chains
+	got := []string{}
+	Walk(ch, func(s *Stage) {
+		if len(s.Nested) > 0 {
+			got = append(got, "*")
+			return
+		}
+		got = append(got, strings.TrimSpace(s.P()))
+	})
+
+	// Nested chains are visited right after the stage that runs them, in the order they are listed
+	want := []string{"a", "*", "then-1", "then-2", "else", "*", "p1", "p2", "*", "deep", "z"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("visited %q, want %q", got, want)
+	}
+
+	// A chain linked after another is walked from its own First stage
+	tail := First(step("x")).Then(step("y"))
+	InSequence(First(step("before")), tail)
+	got = got[:0]
+	Walk(tail, func(s *Stage) {
+		got = append(got, s.P())
+	})
+	if !reflect.DeepEqual(got, []string{"x", "y"}) {
+		t.Errorf("linked chain visited %q", got)
+	}
+
+	Walk(nil, func(s *Stage) {
+		t.Error("visited a stage of a nil chain")
+	})
+}
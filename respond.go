@@ -0,0 +1,209 @@
+package rp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// CtxRef is a placeholder in a RespondWith template or a Created location that is replaced by a value from
+// the context. Create one with Ctx.
+type CtxRef struct {
+	Path string
+}
+
+// Ctx refers to the context value at path, such as "total" or "order.id". The path is first looked up as a
+// key as it is. Otherwise, the longest prefix that is a key, such as "order", is looked up, and the rest of the
+// path is applied to its value as with the Path stage.
+func Ctx(path string) CtxRef {
+	return CtxRef{Path: path}
+}
+
+// ctxRefKey is one way to split a CtxRef's path into a context key and a path within its value
+type ctxRefKey struct {
+	key  string
+	segs []pathSegment
+}
+
+// ctxRefKeys lists the ways to split path, from the longest key to the shortest
+func ctxRefKeys(path string) []ctxRefKey {
+	keys := []ctxRefKey{{key: path}}
+	for i := len(path) - 1; i > 0; i-- {
+		if path[i] != '.' && path[i] != '[' {
+			continue
+		}
+		segs, err := parsePath(strings.TrimPrefix(path[i:], "."))
+		if err == nil {
+			keys = append(keys, ctxRefKey{key: path[:i], segs: segs})
+		}
+	}
+	return keys
+}
+
+func (r CtxRef) resolve(c Context) (any, error) {
+	for _, k := range ctxRefKeys(r.Path) {
+		val, ok := c.Get(k.key)
+		if !ok {
+			continue
+		}
+		if len(k.segs) == 0 {
+			return val, nil
+		}
+		found, err := walkPath(val, k.segs, k.key)
+		if err != nil {
+			return nil, errors.New("Ctx(\"" + r.Path + "\"): " + err.Error())
+		}
+		if hasWildcard(k.segs) {
+			return found, nil
+		}
+		return found[0], nil
+	}
+	return nil, errors.New("Ctx(\"" + r.Path + "\"): key not found")
+}
+
+// fillTemplate returns a copy of v with every CtxRef replaced by its value
+func fillTemplate(v any, c Context) (any, error) {
+	switch v := v.(type) {
+	case CtxRef:
+		return v.resolve(c)
+	case H:
+		out := make(H, len(v))
+		for k, item := range v {
+			filled, err := fillTemplate(item, c)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = filled
+		}
+		return out, nil
+	case map[string]any:
+		filled, err := fillTemplate(H(v), c)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any(filled.(H)), nil
+	case []any:
+		out := make([]any, len(v))
+		for i, item := range v {
+			filled, err := fillTemplate(item, c)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = filled
+		}
+		return out, nil
+	}
+	return v, nil
+}
+
+// stringValue formats v for a URL, with ObjectIDs as plain hex
+func stringValue(v any) string {
+	if id, ok := v.(primitive.ObjectID); ok {
+		return id.Hex()
+	}
+	return fmt.Sprint(v)
+}
+
+// Respond outputs a *Response with the given status code and the previous stage's output as the body.
+func Respond(code int) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Respond(" + http.StatusText(code) + ")"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return &Response{
+				Code: code,
+				Obj:  in,
+			}, nil
+		},
+	}
+}
+
+// RespondWith outputs a *Response with the given status code and a body built from template, where each
+// Ctx placeholder, including those in nested H, map[string]any and []any values, is replaced by its value
+// from the context. For example:
+//
+//	RespondWith(http.StatusOK, H{"message": "Purchase successful", "order_id": Ctx("order.id")})
+//
+// A placeholder that can't be resolved is a 500 error.
+func RespondWith(code int, template H) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => RespondWith(" + http.StatusText(code) + ")"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			obj, err := fillTemplate(template, c)
+			if err != nil {
+				return nil, err
+			}
+			return &Response{
+				Code: code,
+				Obj:  obj,
+			}, nil
+		},
+
+		E: func(err error) *StageError {
+			return &StageError{
+				Code: ISR,
+				Obj:  H{"error": "RespondWith: " + err.Error()},
+			}
+		},
+	}
+}
+
+// Created outputs a 201 *Response with the previous stage's output as the body and a Location header built
+// from locationFmt, where each {path} is replaced by the URL path escaped value of Ctx(path). For example:
+//
+//	Created("/orders/{order.id}")
+func Created(locationFmt string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Created(\"" + locationFmt + "\")"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			location := ""
+			rest := locationFmt
+			for {
+				before, after, found := strings.Cut(rest, "{")
+				location += before
+				if !found {
+					break
+				}
+				path, after, found := strings.Cut(after, "}")
+				if !found {
+					return nil, errors.New("unclosed { in \"" + locationFmt + "\"")
+				}
+				val, err := Ctx(path).resolve(c)
+				if err != nil {
+					return nil, err
+				}
+				location += url.PathEscape(stringValue(val))
+				rest = after
+			}
+
+			return &Response{
+				Code:   http.StatusCreated,
+				Obj:    in,
+				Header: http.Header{"Location": {location}},
+			}, nil
+		},
+
+		E: func(err error) *StageError {
+			return &StageError{
+				Code: ISR,
+				Obj:  H{"error": "Created: " + err.Error()},
+			}
+		},
+	}
+}
@@ -22,20 +22,37 @@ var (
 // | CORE FUNCTIONALITY                                                                      |
 // | rp.go              | This file; Some helpers and documentation                          |
 // | naming.go          | Naming helper functions											 |
+// | context.go         | Context interface that stages receive; Keys store                  |
+// | gin.go             | GinContext adapter; Registering routes on a gin.Engine             |
+// | http.go            | HTTPContext adapter; Serving chains as a net/http http.Handler     |
 // | route.go           | Route type, the top-level object that contains the pipeline        |
+// | group.go           | RouteGroup type; Shared base path, prefix/suffix chains and logger |
+// | websocket.go       | WSRoute type; Runs chains on connect and for every inbound frame   |
 // | pipeline.go        | Stage & Chain types; Basic building blocks for defining pipelines  |
 // | execute.go         | Execute func that runs pipelines; Logging via the Logger interface |
 // | conditional.go     | Stage that wraps chains into an if/else control flow               |
 // | parallel.go        | Stage that runs multiple chains in parallel                        |
+// | standalone.go      | Running chains outside of HTTP requests                            |
+// | schedule.go        | Scheduler that runs chains on cron-like schedules                  |
+// | async.go           | Async stage; Background WorkQueue with retries and a TaskStore     |
+// | stream.go          | Streaming responses; chunked JSON and Server-Sent Events           |
 // | ------------------ | ------------------------------------------------------------------ |
 // | STAGE GENERATOR FUNCTIONS                                                               |
 // | basic.go           | Generic stage generator, context get/set stages                    |
 // | parse.go           | Request parsing stages                                             |
+// | validate.go        | Struct validation stage; Field-level validation errors             |
+// | params.go          | Typed query parameter stages with defaults and bounds              |
+// | list.go            | List endpoint query parsing; Pagination, sorting and filtering     |
 // | conversion.go      | Type conversion stages                                             |
+// | path.go            | Path stage; Nested field access with indices and wildcards         |
+// | transform.go       | Map, Filter, Pick, Omit, Rename and Merge transformation stages    |
+// | respond.go         | Response stages; Respond, RespondWith templates and Created        |
 // | ------------------ | ------------------------------------------------------------------ |
 // | INTEGRATIONS																	    	 |
 // | modules/rpmongo    | Stages that use the MongoDB Go driver                              |
 // |                    | "go.mongodb.org/mongo-driver/mongo"								 |
+// | modules/rpchi      | Serving routes from a chi router                                   |
+// | modules/rpecho     | EchoContext adapter; Serving routes from an echo instance          |
 // | ------------------ | ------------------------------------------------------------------ |
 // | EXAMPLES																			     |
 // | examples/ecommerce | A thorough example of how rp works                                 |
@@ -0,0 +1,318 @@
+package rp
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule determines when a scheduled Job runs next.
+type Schedule interface {
+	// Next returns the first run time that is strictly after the given time.
+	Next(after time.Time) time.Time
+}
+
+type everySchedule struct {
+	d time.Duration
+}
+
+func (s everySchedule) Next(after time.Time) time.Time {
+	return after.Add(s.d)
+}
+
+// Every creates a Schedule that waits for a fixed interval before each run. Since Scheduler asks for the next
+// run time when a run finishes, the interval is counted from the end of the previous run.
+func Every(d time.Duration) Schedule {
+	if d <= 0 {
+		panic("rp.Every: interval must be positive")
+	}
+	return everySchedule{d: d}
+}
+
+// cronSchedule holds one bit per allowed value of each field
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar, hourStar    bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Cron parses a standard five-field cron spec, "minute hour day-of-month month day-of-week", into a Schedule.
+// Each field accepts *, single values, ranges (1-5), lists (1,15) and steps (*/10 or 0-30/5). Day-of-week runs
+// from 0 (Sunday) to 6, with 7 also meaning Sunday. The macros @yearly, @monthly, @weekly, @daily and @hourly
+// are supported too. Times are evaluated in the location of the time passed to Next.
+func Cron(spec string) (Schedule, error) {
+
+	if macro, ok := cronMacros[strings.TrimSpace(spec)]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron: expected 5 fields, got " + strconv.Itoa(len(fields)))
+	}
+
+	s := &cronSchedule{}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domStar = strings.HasPrefix(fields[2], "*")
+	s.dowStar = strings.HasPrefix(fields[4], "*")
+	s.hourStar = strings.HasPrefix(fields[1], "*")
+
+	return s, nil
+}
+
+// MustCron is like Cron but panics if the spec is invalid.
+func MustCron(spec string) Schedule {
+	s, err := Cron(spec)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+func parseCronField(field string, min int, max int) (uint64, error) {
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rng = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step <= 0 {
+				return 0, errors.New("cron: invalid step in \"" + part + "\"")
+			}
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("cron: invalid value in \"" + part + "\"")
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("cron: invalid value in \"" + part + "\"")
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New("cron: \"" + part + "\" is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+func (s *cronSchedule) Next(after time.Time) time.Time {
+
+	t := after.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 || s.repeated(t, after) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	// No matching time, e.g. "0 0 31 2 *"
+	return time.Time{}
+}
+
+// repeated reports whether t shows a wall clock time that after already reached, which happens when the clock
+// is set back for daylight saving time. Like cron, a job with specific hours runs once in the repeated hour,
+// while a job that runs every hour keeps running by elapsed time.
+func (s *cronSchedule) repeated(t time.Time, after time.Time) bool {
+	if s.hourStar {
+		return false
+	}
+	after = after.In(t.Location())
+	wall := func(t time.Time) time.Time {
+		return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+	}
+	return !wall(t).After(wall(after))
+}
+
+// dayMatches follows cron's rule that when both day fields are restricted, either one can match.
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Job is a chain that a Scheduler runs on a Schedule, using ExecuteStandalone.
+type Job struct {
+	Name     string
+	Schedule Schedule
+	Pipe     *Chain
+	Input    func() any        // Optional. Creates the first stage's input for each run.
+	Logger   Logger            // Optional
+	OnError  func(*StageError) // Optional. Called when a run fails or panics.
+}
+
+// Scheduler runs Jobs in the background. Each job runs in its own goroutine, and a job's runs never overlap:
+// if a run takes longer than the interval, the runs that were missed are skipped. Its methods are safe to call
+// concurrently, and a stopped scheduler can be started again.
+type Scheduler struct {
+	mu      sync.Mutex
+	jobs    []*Job
+	ctx     context.Context
+	cancel  context.CancelFunc
+	running *sync.WaitGroup // The job goroutines of the current Start, replaced on each Start
+}
+
+func NewScheduler(jobs ...*Job) *Scheduler {
+	return &Scheduler{
+		jobs: jobs,
+	}
+}
+
+// Add adds a job. If the scheduler has already started, the job starts right away.
+func (s *Scheduler) Add(job *Job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, job)
+	if s.ctx != nil {
+		s.startJob(job)
+	}
+}
+
+// Start starts running the jobs. It returns immediately. Jobs stop when ctx is canceled or Stop is called.
+// Calling Start on a scheduler that is already running does nothing.
+func (s *Scheduler) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ctx != nil {
+		return
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.running = &sync.WaitGroup{}
+	for _, job := range s.jobs {
+		s.startJob(job)
+	}
+}
+
+// Stop stops the scheduler and waits for any runs in progress to finish.
+func (s *Scheduler) Stop() {
+	s.mu.Lock()
+	running := s.running
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.ctx, s.cancel, s.running = nil, nil, nil
+	s.mu.Unlock()
+
+	// Jobs added or started from here on belong to a new WaitGroup, so this Wait never races with their Add
+	if running != nil {
+		running.Wait()
+	}
+}
+
+// startJob must be called with s.mu held and the scheduler started
+func (s *Scheduler) startJob(job *Job) {
+	running := s.running
+	running.Add(1)
+	go func(ctx context.Context) {
+		defer running.Done()
+		for {
+			next := job.Schedule.Next(time.Now())
+			if next.IsZero() {
+				return
+			}
+			timer := time.NewTimer(time.Until(next))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			s.runJob(ctx, job)
+		}
+	}(s.ctx)
+}
+
+func (s *Scheduler) runJob(ctx context.Context, job *Job) {
+
+	// A panic in the chain or in Input fails this run only
+	defer func() {
+		if r := recover(); r != nil {
+			e := panicError(r)
+			if job.Logger != nil {
+				job.Logger.LogMessage("Scheduled job \"" + job.Name + "\" panicked: " + e.Err.Error())
+			}
+			if job.OnError != nil {
+				job.OnError(e)
+			}
+		}
+	}()
+
+	if job.Logger != nil {
+		job.Logger.LogMessage("Running scheduled job \"" + job.Name + "\"...")
+	}
+
+	var in any
+	if job.Input != nil {
+		in = job.Input()
+	}
+
+	_, e := ExecuteStandalone(ctx, job.Pipe, in, job.Logger)
+	if e != nil && job.OnError != nil {
+		job.OnError(e)
+	}
+}
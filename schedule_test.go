@@ -0,0 +1,278 @@
+package rp
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCronParse(t *testing.T) {
+
+	tests := []struct {
+		spec string
+		err  string
+	}{
+		{"* * * * *", ""},
+		{"*/15 0-6/2 1,15 1-12 1-5", ""},
+		{"0 0 * * 7", ""},
+		{"@weekly", ""},
+		{" @daily ", ""},
+		{"* * * *", "cron: expected 5 fields, got 4"},
+		{"60 * * * *", "cron: \"60\" is out of range 0-59"},
+		{"* 5-2 * * *", "cron: \"5-2\" is out of range 0-23"},
+		{"* * 0 * *", "cron: \"0\" is out of range 1-31"},
+		{"* * * * 8", "cron: \"8\" is out of range 0-7"},
+		{"*/0 * * * *", "cron: invalid step in \"*/0\""},
+		{"a * * * *", "cron: invalid value in \"a\""},
+		{"1-b * * * *", "cron: invalid value in \"1-b\""},
+	}
+	for _, tt := range tests {
+		_, err := Cron(tt.spec)
+		if got := ""; err != nil {
+			got = err.Error()
+			if got != tt.err {
+				t.Errorf("Cron(%q) = %q, want %q", tt.spec, got, tt.err)
+			}
+		} else if tt.err != "" {
+			t.Errorf("Cron(%q) = nil, want %q", tt.spec, tt.err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+
+	// 2024-05-01 is a Wednesday
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name  string
+		spec  string
+		after string
+		want  []string // The next runs, each one after the previous
+	}{
+		{"every minute", "* * * * *", "2024-05-01 10:00", []string{"2024-05-01 10:01", "2024-05-01 10:02"}},
+		{"strictly after", "30 10 * * *", "2024-05-01 10:30", []string{"2024-05-02 10:30"}},
+		{"step", "*/20 * * * *", "2024-05-01 10:05", []string{"2024-05-01 10:20", "2024-05-01 10:40", "2024-05-01 11:00"}},
+		{"step from a value", "10/20 * * * *", "2024-05-01 10:05", []string{"2024-05-01 10:10", "2024-05-01 10:30", "2024-05-01 10:50"}},
+		{"range step", "0 9-17/4 * * *", "2024-05-01 10:00", []string{"2024-05-01 13:00", "2024-05-01 17:00", "2024-05-02 09:00"}},
+		{"month rollover", "0 0 1 * *", "2024-05-01 00:00", []string{"2024-06-01 00:00", "2024-07-01 00:00"}},
+		{"leap day", "0 0 29 2 *", "2024-05-01 00:00", []string{"2028-02-29 00:00"}},
+		{"never", "0 0 31 2 *", "2024-05-01 00:00", []string{"0001-01-01 00:00"}},
+		{"yearly", "@yearly", "2024-05-01 00:00", []string{"2025-01-01 00:00"}},
+
+		// Day-of-week 7 is Sunday, like 0
+		{"sunday as 0", "0 8 * * 0", "2024-05-01 00:00", []string{"2024-05-05 08:00", "2024-05-12 08:00"}},
+		{"sunday as 7", "0 8 * * 7", "2024-05-01 00:00", []string{"2024-05-05 08:00", "2024-05-12 08:00"}},
+		{"range to 7", "0 8 * * 6-7", "2024-05-01 00:00", []string{"2024-05-04 08:00", "2024-05-05 08:00", "2024-05-11 08:00"}},
+
+		// With both day fields restricted, either one matches
+		{"dom or dow", "0 0 13 * 5", "2024-05-01 00:00", []string{"2024-05-03 00:00", "2024-05-10 00:00", "2024-05-13 00:00", "2024-05-17 00:00"}},
+		// With one day field *, only the other one counts
+		{"dow only", "0 0 * * 5", "2024-05-01 00:00", []string{"2024-05-03 00:00", "2024-05-10 00:00"}},
+		{"dom only", "0 0 13 * *", "2024-05-01 00:00", []string{"2024-05-13 00:00", "2024-06-13 00:00"}},
+		// A day field starting with * counts as *, even with a step, so both fields have to match
+		{"dom star step and dow", "0 0 */2 * 1", "2024-05-01 00:00", []string{"2024-05-13 00:00", "2024-05-27 00:00", "2024-06-03 00:00"}},
+		{"dom and dow star step", "0 0 13 * */7", "2024-05-01 00:00", []string{"2024-10-13 00:00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := MustCron(tt.spec)
+			after := at(tt.after)
+			for _, w := range tt.want {
+				want := at(w)
+				if w == "0001-01-01 00:00" {
+					want = time.Time{}
+				}
+				got := s.Next(after)
+				if !got.Equal(want) {
+					t.Fatalf("Next(%v) = %v, want %v", after, got, want)
+				}
+				after = got
+			}
+		})
+	}
+}
+
+// TestCronNextDST checks the runs around the days that New York's clocks are set back, when 1:00 to 1:59
+// happens twice, and forward, when 2:00 to 2:59 is skipped
+func TestCronNextDST(t *testing.T) {
+
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("time zone data not available:", err)
+	}
+	edt := time.FixedZone("EDT", -4*3600)
+	est := time.FixedZone("EST", -5*3600)
+
+	runs := func(spec string, from time.Time, n int) []time.Time {
+		s := MustCron(spec)
+		out := []time.Time{}
+		for t := from; len(out) < n; {
+			t = s.Next(t)
+			out = append(out, t)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want []time.Time
+	}{
+		{"specific time in the repeated hour runs once", "30 1 * * *", time.Date(2024, 11, 2, 12, 0, 0, 0, ny), []time.Time{
+			time.Date(2024, 11, 3, 1, 30, 0, 0, edt),
+			time.Date(2024, 11, 4, 1, 30, 0, 0, est),
+		}},
+		{"minutes in the repeated hour run once", "0,45 1 * * *", time.Date(2024, 11, 3, 0, 50, 0, 0, ny), []time.Time{
+			time.Date(2024, 11, 3, 1, 0, 0, 0, edt),
+			time.Date(2024, 11, 3, 1, 45, 0, 0, edt),
+			time.Date(2024, 11, 4, 1, 0, 0, 0, est),
+		}},
+		{"every hour keeps running by elapsed time", "30 * * * *", time.Date(2024, 11, 3, 0, 50, 0, 0, ny), []time.Time{
+			time.Date(2024, 11, 3, 1, 30, 0, 0, edt),
+			time.Date(2024, 11, 3, 1, 30, 0, 0, est),
+			time.Date(2024, 11, 3, 2, 30, 0, 0, est),
+		}},
+		{"after the second 1:00 starts", "30 1 * * *", time.Date(2024, 11, 3, 1, 10, 0, 0, est), []time.Time{
+			time.Date(2024, 11, 3, 1, 30, 0, 0, est),
+			time.Date(2024, 11, 4, 1, 30, 0, 0, est),
+		}},
+		{"spring forward", "30 * * * *", time.Date(2024, 3, 10, 0, 50, 0, 0, ny), []time.Time{
+			time.Date(2024, 3, 10, 1, 30, 0, 0, est),
+			time.Date(2024, 3, 10, 3, 30, 0, 0, edt),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := runs(tt.spec, tt.from, len(tt.want))
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Errorf("run %d = %v, want %v", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+// countJob is a job that runs every millisecond and counts its runs
+func countJob(runs *int64) *Job {
+	return &Job{
+		Name:     "count",
+		Schedule: Every(time.Millisecond),
+		Pipe: First(S("count", func(in any, c Context, lgr Logger) (any, error) {
+			atomic.AddInt64(runs, 1)
+			return nil, nil
+		})),
+	}
+}
+
+// waitFor polls cond until it holds, or fails the test after a few seconds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for " + what)
+		}
+	}
+}
+
+func TestSchedulerRestart(t *testing.T) {
+
+	var runs int64
+	s := NewScheduler(countJob(&runs))
+
+	s.Start(context.Background())
+	waitFor(t, "the first runs", func() bool { return atomic.LoadInt64(&runs) > 0 })
+	s.Stop()
+
+	stopped := atomic.LoadInt64(&runs)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt64(&runs); got != stopped {
+		t.Fatalf("%d runs after Stop", got-stopped)
+	}
+
+	s.Start(context.Background())
+	waitFor(t, "runs after a restart", func() bool { return atomic.LoadInt64(&runs) > stopped })
+	s.Stop()
+}
+
+func TestSchedulerErrors(t *testing.T) {
+
+	var mu sync.Mutex
+	errs := []string{}
+	onError := func(e *StageError) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, e.Err.Error())
+	}
+
+	s := NewScheduler(&Job{
+		Name:     "fails",
+		Schedule: Every(time.Millisecond),
+		Pipe: First(S("fail", func(in any, c Context, lgr Logger) (any, error) {
+			panic("boom")
+		})),
+		OnError: onError,
+	})
+	s.Start(context.Background())
+	defer s.Stop()
+
+	// A panicking run is reported, and the job keeps running
+	waitFor(t, "two failed runs", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(errs) >= 2
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if !strings.HasPrefix(errs[0], "panic: boom\n") {
+		t.Errorf("error = %q", errs[0])
+	}
+}
+
+// TestSchedulerConcurrent calls Start, Stop and Add from many goroutines at once. Run with -race.
+func TestSchedulerConcurrent(t *testing.T) {
+
+	var runs int64
+	s := NewScheduler(countJob(&runs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			s.Start(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			s.Add(countJob(&runs))
+		}()
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
+	s.Stop()
+
+	stopped := atomic.LoadInt64(&runs)
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt64(&runs); got != stopped {
+		t.Errorf("%d runs after the final Stop", got-stopped)
+	}
+
+	// Every job added along the way runs after the next Start
+	s.Start(context.Background())
+	defer s.Stop()
+	waitFor(t, "runs of all 21 jobs", func() bool { return atomic.LoadInt64(&runs) >= stopped+21 })
+}
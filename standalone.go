@@ -0,0 +1,52 @@
+package rp
+
+import (
+	"context"
+	"net/http"
+)
+
+// StandaloneContext is the Context used to run chains outside of HTTP requests, like in background jobs,
+// queue consumers and CLI commands. It has a key/value store but no request or response writer, so stages
+// that parse requests will fail with ErrNoRequest.
+type StandaloneContext struct {
+	Keys
+	ctx context.Context
+}
+
+// NewStandaloneContext creates a Context that is canceled along with ctx.
+func NewStandaloneContext(ctx context.Context) *StandaloneContext {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return &StandaloneContext{
+		ctx: ctx,
+	}
+}
+
+func (s *StandaloneContext) Request() *http.Request {
+	return nil
+}
+
+func (s *StandaloneContext) Writer() http.ResponseWriter {
+	return nil
+}
+
+func (s *StandaloneContext) Param(key string) string {
+	return ""
+}
+
+func (s *StandaloneContext) Context() context.Context {
+	return s.ctx
+}
+
+// ExecuteStandalone runs the chain outside of an HTTP request, with in as the first stage's input.
+// Logging and errors work just like Execute, except that the output is returned rather than written
+// to the network.
+func ExecuteStandalone(ctx context.Context, ch *Chain, in any, lgr Logger) (any, *StageError) {
+
+	if lgr != nil {
+		lgr.LogMessage("Starting execution chain...")
+	}
+
+	return execute(ch, in, NewStandaloneContext(ctx), lgr)
+}
@@ -0,0 +1,161 @@
+package rp
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/gin-contrib/sse"
+)
+
+// StreamKind selects how a StreamResponse is written to the network.
+type StreamKind int
+
+const (
+	StreamChunked StreamKind = iota // Newline-delimited JSON sent with chunked transfer encoding
+	StreamSSE                       // Server-Sent Events
+)
+
+// StreamResponse can be returned by the last stage of a pipeline in place of a *Response. Each value received
+// from Events is written as one event, and the response ends when Events is closed or the client disconnects.
+// The producer that sends to Events should stop when the request's context is done.
+type StreamResponse struct {
+	Code   int        // HTTP status code
+	Kind   StreamKind // Chunked or SSE
+	Event  string     // SSE event name. Ignored for chunked streams.
+	Events <-chan any // Events to write, in order
+}
+
+// Stream wraps the producer channel passed in as in into a chunked *StreamResponse.
+// in can be any channel that can be received from, like a chan any or a <-chan *Order.
+func Stream() *Stage {
+	return streamStage(StreamChunked, "")
+}
+
+// SSE wraps the producer channel passed in as in into a Server-Sent Events *StreamResponse,
+// with every event named by the given event name. in can be any channel that can be received from.
+func SSE(event string) *Stage {
+	return streamStage(StreamSSE, event)
+}
+
+func streamStage(kind StreamKind, event string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			if kind == StreamSSE {
+				return "  => SSE(\"" + event + "\")"
+			}
+			return "  => Stream()"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			var events <-chan any
+			switch ch := in.(type) {
+			case chan any:
+				events = ch
+			case <-chan any:
+				events = ch
+			default:
+				rv := reflect.ValueOf(in)
+				if rv.Kind() != reflect.Chan || rv.Type().ChanDir()&reflect.RecvDir == 0 {
+					return nil, fmt.Errorf("expected a channel of events, got %T", in)
+				}
+				events = relay(rv, c.Context().Done())
+			}
+
+			return &StreamResponse{
+				Code:   http.StatusOK,
+				Kind:   kind,
+				Event:  event,
+				Events: events,
+			}, nil
+		},
+
+		E: func(err error) *StageError {
+			return &StageError{
+				Code: ISR,
+				Obj:  H{"error": err.Error()},
+			}
+		},
+	}
+}
+
+// relay forwards the values received from a typed channel, like a chan *Order, to a <-chan any. It stops and
+// closes the returned channel when ch is closed or done is, so that it never outlives the request.
+func relay(ch reflect.Value, done <-chan struct{}) <-chan any {
+	out := make(chan any)
+	go func() {
+		defer close(out)
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: ch},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(done)},
+		}
+		for {
+			chosen, v, ok := reflect.Select(cases)
+			if chosen == 1 || !ok {
+				return
+			}
+			select {
+			case out <- v.Interface():
+			case <-done:
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// writeStream writes res to the network until its Events channel is closed or the client goes away.
+// The total duration and event count are logged as a stage of their own.
+func writeStream(c Context, res *StreamResponse, lgr Logger) {
+
+	t := time.Now()
+	count := 0
+	closed := false
+
+	w := c.Writer()
+	flusher, _ := w.(http.Flusher)
+
+	if res.Kind == StreamSSE {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.WriteHeader(res.Code)
+
+	done := c.Context().Done()
+loop:
+	for {
+		select {
+		case ev, ok := <-res.Events:
+			if !ok {
+				closed = true
+				break loop
+			}
+			var err error
+			if res.Kind == StreamSSE {
+				err = sse.Encode(w, sse.Event{Event: res.Event, Data: ev})
+			} else {
+				err = json.NewEncoder(w).Encode(ev)
+			}
+			if err != nil {
+				break loop
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			count++
+		case <-done:
+			break loop
+		}
+	}
+
+	if lgr != nil {
+		lgr.LogStageComplete(closed, time.Since(t), fmt.Sprintf("Stream: %d events", count), nil)
+	}
+}
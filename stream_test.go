@@ -0,0 +1,177 @@
+package rp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type streamEvent struct {
+	N int `json:"n"`
+}
+
+// produce is a stage that outputs a typed <-chan *streamEvent, and sends count events to it from a goroutine
+// before closing it. With count < 0, it sends until the request's context is done, then closes stopped.
+func produce(count int, stopped chan struct{}) *Stage {
+	return S("produce =>", func(in any, c Context, lgr Logger) (any, error) {
+		events := make(chan *streamEvent)
+		go func() {
+			defer close(events)
+			if stopped != nil {
+				defer close(stopped)
+			}
+			for i := 1; count < 0 || i <= count; i++ {
+				select {
+				case events <- &streamEvent{N: i}:
+				case <-c.Context().Done():
+					return
+				}
+			}
+		}()
+		return (<-chan *streamEvent)(events), nil
+	})
+}
+
+func TestStream(t *testing.T) {
+
+	tests := []struct {
+		name        string
+		producer    *Stage
+		stream      *Stage
+		contentType string
+		body        string
+	}{
+		{"chunked chan any", S("produce =>", func(in any, c Context, lgr Logger) (any, error) {
+			events := make(chan any, 3)
+			events <- H{"n": 1}
+			events <- "two"
+			events <- 3
+			close(events)
+			return events, nil
+		}), Stream(), "application/x-ndjson", "{\"n\":1}\n\"two\"\n3\n"},
+
+		{"chunked typed channel", produce(3, nil), Stream(), "application/x-ndjson",
+			"{\"n\":1}\n{\"n\":2}\n{\"n\":3}\n"},
+
+		{"SSE", produce(2, nil), SSE("tick"), "text/event-stream",
+			"event:tick\ndata:{\"n\":1}\n\nevent:tick\ndata:{\"n\":2}\n\n"},
+
+		{"SSE bidirectional typed channel", S("produce =>", func(in any, c Context, lgr Logger) (any, error) {
+			events := make(chan string, 1)
+			events <- "hello"
+			close(events)
+			return events, nil
+		}), SSE("msg"), "text/event-stream", "event:msg\ndata:hello\n\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			lgr := &recordLogger{}
+			rec := httptest.NewRecorder()
+			HTTPHandler(First(tt.producer).Then(tt.stream), lgr, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != tt.contentType {
+				t.Errorf("status %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			if rec.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", rec.Body.String(), tt.body)
+			}
+			if !rec.Flushed {
+				t.Error("events were not flushed")
+			}
+
+			n := strings.Count(tt.body, "\n")
+			if strings.HasPrefix(tt.contentType, "text/event-stream") {
+				n = strings.Count(tt.body, "\n\n")
+			}
+			logged := lgr.completed()
+			last := logged[len(logged)-1]
+			if want := fmt.Sprintf("Stream: %d events", n); last.print != want || !last.success {
+				t.Errorf("logged %+v, want %q", last, want)
+			}
+		})
+	}
+}
+
+func TestStreamNotAChannel(t *testing.T) {
+
+	for _, in := range []any{"events", []any{1}, make(chan<- any)} {
+
+		ch := First(S("produce =>", func(any, Context, Logger) (any, error) {
+			return in, nil
+		})).Then(Stream())
+
+		rec := httptest.NewRecorder()
+		HTTPHandler(ch, nil, nil).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != ISR || !strings.Contains(rec.Body.String(), "expected a channel of events") {
+			t.Errorf("%T: %d %s", in, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+// TestStreamClientDisconnect checks that the stream ends when the client goes away, logging the events that
+// were sent and the time the stream was open, and that the producer and relay stop.
+func TestStreamClientDisconnect(t *testing.T) {
+
+	lgr := &recordLogger{}
+	stopped := make(chan struct{})
+	ch := First(produce(-1, stopped)).Then(SSE("tick"))
+
+	srv := httptest.NewServer(HTTPHandler(ch, lgr, nil))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Read a few events, then disconnect
+	r := bufio.NewReader(res.Body)
+	for read := 0; read < 3; {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line == "\n" {
+			read++
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the producer did not stop after the client disconnected")
+	}
+
+	// The log is written after the handler sees the disconnect
+	var last loggedStage
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if logged := lgr.completed(); len(logged) > 0 && strings.HasPrefix(logged[len(logged)-1].print, "Stream: ") {
+			last = logged[len(logged)-1]
+			break
+		}
+	}
+
+	var n int
+	if _, err := fmt.Sscanf(last.print, "Stream: %d events", &n); err != nil || n < 3 {
+		t.Errorf("logged %q, want at least 3 events", last.print)
+	}
+	if last.success {
+		t.Error("a stream cut short by the client was logged as complete")
+	}
+	if last.elapsed < 20*time.Millisecond {
+		t.Errorf("logged duration %v, want the time the stream was open", last.elapsed)
+	}
+}
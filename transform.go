@@ -0,0 +1,334 @@
+package rp
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// The stages in this file reshape data without side effects, typically between a database stage and the
+// response. Pick, Omit, Rename and Merge accept a map with string keys, a bson.D, a struct (by its json
+// field names), or a pointer to one of them, and output a new map[string]any without changing the input.
+// Given a slice of these, they output a []map[string]any with each item transformed.
+
+func transformError(name string) func(error) *StageError {
+	return func(err error) *StageError {
+		return &StageError{
+			Code: ISR,
+			Obj:  H{"error": name + ": " + err.Error()},
+		}
+	}
+}
+
+// funcName returns a short name for fn, like "toSummary" or "PurchaseHandler.func1", for the stage log
+func funcName(fn any) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return "func"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	return name
+}
+
+// items returns the items of in if it is a slice or array (but not a bson.D), and false otherwise
+func items(in any) ([]any, bool) {
+	if _, ok := in.(primitive.D); ok {
+		return nil, false
+	}
+	rv := reflect.ValueOf(in)
+	for rv.Kind() == reflect.Pointer && !rv.IsNil() && (rv.Elem().Kind() == reflect.Slice || rv.Elem().Kind() == reflect.Array) {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+	list := make([]any, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list, true
+}
+
+// toMap copies the fields of a map, bson.D or struct into a new map[string]any
+func toMap(v any) (map[string]any, error) {
+
+	if d, ok := v.(primitive.D); ok {
+		m := make(map[string]any, len(d))
+		for _, e := range d {
+			m[e.Key] = e.Value
+		}
+		return m, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Pointer || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil, errors.New("input is nil")
+		}
+		rv = rv.Elem()
+	}
+
+	switch rv.Kind() {
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		m := make(map[string]any, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			m[iter.Key().String()] = iter.Value().Interface()
+		}
+		return m, nil
+	case reflect.Struct:
+		m := map[string]any{}
+		for _, f := range reflect.VisibleFields(rv.Type()) {
+			if !f.IsExported() || f.Anonymous || f.Tag.Get("json") == "-" {
+				continue
+			}
+			if fv, err := rv.FieldByIndexErr(f.Index); err == nil {
+				m[tagName(f)] = fv.Interface()
+			}
+		}
+		return m, nil
+	}
+
+	if !rv.IsValid() {
+		return nil, errors.New("input is nil")
+	}
+	return nil, fmt.Errorf("expected an object, got %s", rv.Type())
+}
+
+// eachMap applies f to in, or to each of its items if it is a slice
+func eachMap(in any, f func(map[string]any) (map[string]any, error)) (any, error) {
+
+	if list, ok := items(in); ok {
+		out := make([]map[string]any, len(list))
+		for i, item := range list {
+			m, err := toMap(item)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+			if out[i], err = f(m); err != nil {
+				return nil, fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+		return out, nil
+	}
+
+	m, err := toMap(in)
+	if err != nil {
+		return nil, err
+	}
+	return f(m)
+}
+
+func quoted(values []string) string {
+	q := make([]string, len(values))
+	for i, v := range values {
+		q[i] = "\"" + v + "\""
+	}
+	return strings.Join(q, ", ")
+}
+
+// Map applies fn to each item of in, which must be a slice, and outputs a []U of the results. If in is not a
+// slice, fn is applied to in itself and its result is output. It is an error if an item is not a T.
+func Map[T, U any](fn func(T) U) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Map(" + funcName(fn) + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			list, ok := items(in)
+			if !ok {
+				item, ok := in.(T)
+				if !ok {
+					return nil, fmt.Errorf("expected %s, got %T", reflect.TypeOf((*T)(nil)).Elem(), in)
+				}
+				return fn(item), nil
+			}
+
+			out := make([]U, len(list))
+			for i, v := range list {
+				item, ok := v.(T)
+				if !ok {
+					return nil, fmt.Errorf("item %d: expected %s, got %T", i, reflect.TypeOf((*T)(nil)).Elem(), v)
+				}
+				out[i] = fn(item)
+			}
+			return out, nil
+		},
+
+		E: transformError("Map"),
+	}
+}
+
+// Filter outputs a []T of the items of in, which must be a slice, for which pred returns true.
+// It is an error if an item is not a T.
+func Filter[T any](pred func(T) bool) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Filter(" + funcName(pred) + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			list, ok := items(in)
+			if !ok {
+				return nil, fmt.Errorf("expected a slice, got %T", in)
+			}
+
+			out := []T{}
+			for i, v := range list {
+				item, ok := v.(T)
+				if !ok {
+					return nil, fmt.Errorf("item %d: expected %s, got %T", i, reflect.TypeOf((*T)(nil)).Elem(), v)
+				}
+				if pred(item) {
+					out = append(out, item)
+				}
+			}
+			return out, nil
+		},
+
+		E: transformError("Filter"),
+	}
+}
+
+// Pick outputs only the given top-level fields. Fields that are missing in the input are left out.
+func Pick(fields ...string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Pick(" + quoted(fields) + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return eachMap(in, func(m map[string]any) (map[string]any, error) {
+				out := make(map[string]any, len(fields))
+				for _, f := range fields {
+					if v, ok := m[f]; ok {
+						out[f] = v
+					}
+				}
+				return out, nil
+			})
+		},
+
+		E: transformError("Pick"),
+	}
+}
+
+// Omit outputs every top-level field except the given ones.
+func Omit(fields ...string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => Omit(" + quoted(fields) + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return eachMap(in, func(m map[string]any) (map[string]any, error) {
+				for _, f := range fields {
+					delete(m, f)
+				}
+				return m, nil
+			})
+		},
+
+		E: transformError("Omit"),
+	}
+}
+
+// Rename renames top-level fields, with names mapping old names to new ones, like {"_id": "id"}.
+// Fields that are missing in the input are skipped.
+func Rename(names map[string]string) *Stage {
+
+	old := make([]string, 0, len(names))
+	for o := range names {
+		old = append(old, o)
+	}
+	sort.Strings(old)
+
+	return &Stage{
+
+		P: func() string {
+			pairs := make([]string, len(old))
+			for i, o := range old {
+				pairs[i] = "\"" + o + "\": \"" + names[o] + "\""
+			}
+			return "  => Rename(" + strings.Join(pairs, ", ") + ") =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			return eachMap(in, func(m map[string]any) (map[string]any, error) {
+				out := make(map[string]any, len(m))
+				for k, v := range m {
+					if _, renamed := names[k]; !renamed {
+						out[k] = v
+					}
+				}
+				for _, o := range old {
+					if v, ok := m[o]; ok {
+						out[names[o]] = v
+					}
+				}
+				return out, nil
+			})
+		},
+
+		E: transformError("Rename"),
+	}
+}
+
+// Merge adds the fields of the objects stored in the context at ctxKeys to in, in order, so that later
+// keys override earlier ones and all of them override in's own fields.
+func Merge(ctxKeys ...string) *Stage {
+	return &Stage{
+
+		P: func() string {
+			return "  => " + FuncStr("Merge", ctxKeys...) + " =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+
+			objs := make([]map[string]any, len(ctxKeys))
+			for i, key := range ctxKeys {
+				val, ok := c.Get(key)
+				if !ok {
+					return nil, errors.New("key not found: " + key)
+				}
+				obj, err := toMap(val)
+				if err != nil {
+					return nil, fmt.Errorf("[\"%s\"]: %w", key, err)
+				}
+				objs[i] = obj
+			}
+
+			return eachMap(in, func(m map[string]any) (map[string]any, error) {
+				for _, obj := range objs {
+					for k, v := range obj {
+						m[k] = v
+					}
+				}
+				return m, nil
+			})
+		},
+
+		E: transformError("Merge"),
+	}
+}
@@ -0,0 +1,157 @@
+package rp
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type transformItem struct {
+	ID     string `json:"_id"`
+	Name   string `json:"name"`
+	Price  int    `json:"price"`
+	Secret string `json:"-"`
+}
+
+// transform runs s on in, after setting the given context values
+func transform(s *Stage, in any, keys H) (any, *StageError) {
+	ch := First(S("set keys =>", func(in any, c Context, lgr Logger) (any, error) {
+		for k, v := range keys {
+			c.Set(k, v)
+		}
+		return in, nil
+	})).Then(s)
+	return ExecuteStandalone(context.Background(), ch, in, nil)
+}
+
+func TestTransforms(t *testing.T) {
+
+	item := transformItem{ID: "1", Name: "widget", Price: 10, Secret: "s"}
+	m := map[string]any{"_id": "2", "name": "gadget", "price": 20}
+	d := bson.D{{Key: "_id", Value: "3"}, {Key: "name", Value: "gizmo"}, {Key: "price", Value: 30}}
+
+	keys := H{
+		"customer": map[string]any{"customer": "C1", "price": 99},
+		"extra":    &transformItem{ID: "x", Name: "extra"},
+	}
+
+	tests := []struct {
+		name  string
+		stage *Stage
+		in    any
+		want  any
+	}{
+		{"Pick struct", Pick("name", "price", "missing"), item, map[string]any{"name": "widget", "price": 10}},
+		{"Pick map", Pick("name"), m, map[string]any{"name": "gadget"}},
+		{"Pick bson.D", Pick("_id"), d, map[string]any{"_id": "3"}},
+		{"Pick pointer", Pick("_id"), &item, map[string]any{"_id": "1"}},
+		{"Pick slice of maps", Pick("name"), []map[string]any{m, m}, []map[string]any{{"name": "gadget"}, {"name": "gadget"}}},
+		{"Pick slice of structs", Pick("price"), []transformItem{item}, []map[string]any{{"price": 10}}},
+		{"Pick pointer to slice", Pick("price"), &[]any{m, d}, []map[string]any{{"price": 20}, {"price": 30}}},
+
+		{"Omit struct", Omit("price", "missing"), item, map[string]any{"_id": "1", "name": "widget"}},
+		{"Omit map", Omit("_id", "price"), m, map[string]any{"name": "gadget"}},
+		{"Omit slice", Omit("_id", "name"), []any{item, m, d}, []map[string]any{{"price": 10}, {"price": 20}, {"price": 30}}},
+
+		{"Rename struct", Rename(map[string]string{"_id": "id", "missing": "x"}), item,
+			map[string]any{"id": "1", "name": "widget", "price": 10}},
+		{"Rename swap", Rename(map[string]string{"name": "price", "price": "name"}), m,
+			map[string]any{"_id": "2", "name": 20, "price": "gadget"}},
+		{"Rename slice", Rename(map[string]string{"_id": "id"}), []bson.D{d},
+			[]map[string]any{{"id": "3", "name": "gizmo", "price": 30}}},
+
+		{"Merge map", Merge("customer"), m, map[string]any{"_id": "2", "name": "gadget", "price": 99, "customer": "C1"}},
+		{"Merge order", Merge("customer", "extra"), item,
+			map[string]any{"_id": "x", "name": "extra", "price": 0, "customer": "C1"}},
+		{"Merge slice", Merge("customer"), []any{d}, []map[string]any{{"_id": "3", "name": "gizmo", "price": 99, "customer": "C1"}}},
+
+		{"Map slice", Map(func(it transformItem) string { return it.Name }), []transformItem{item, item}, []string{"widget", "widget"}},
+		{"Map single", Map(func(it transformItem) int { return it.Price * 2 }), item, 20},
+		{"Map maps", Map(func(m map[string]any) any { return m["_id"] }), []map[string]any{m}, []any{"2"}},
+		{"Map empty", Map(func(it transformItem) string { return it.Name }), []transformItem{}, []string{}},
+
+		{"Filter structs", Filter(func(it transformItem) bool { return it.Price > 5 }), []transformItem{item, {Price: 1}}, []transformItem{item}},
+		{"Filter maps", Filter(func(m map[string]any) bool { return m["name"] == "gadget" }), []any{m, map[string]any{}},
+			[]map[string]any{m}},
+		{"Filter none", Filter(func(it transformItem) bool { return false }), []transformItem{item}, []transformItem{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, e := transform(tt.stage, tt.in, keys)
+			if e != nil {
+				t.Fatalf("error: %v", e.Obj)
+			}
+			if !reflect.DeepEqual(out, tt.want) {
+				t.Errorf("got %#v, want %#v", out, tt.want)
+			}
+		})
+	}
+
+	// The input is never changed
+	if len(m) != 3 || m["price"] != 20 || len(d) != 3 {
+		t.Errorf("input was changed: %v %v", m, d)
+	}
+}
+
+func TestTransformErrors(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		stage *Stage
+		in    any
+		want  string
+	}{
+		{"Pick scalar", Pick("a"), 5, "Pick: expected an object, got int"},
+		{"Pick nil", Pick("a"), nil, "Pick: input is nil"},
+		{"Omit bad item", Omit("a"), []any{map[string]any{}, "x"}, "Omit: item 1: expected an object, got string"},
+		{"Pick int keys", Pick("a"), map[int]any{1: "a"}, "Pick: expected an object, got map[int]interface {}"},
+		{"Merge missing key", Merge("nope"), map[string]any{}, "Merge: key not found: nope"},
+		{"Merge bad value", Merge("n"), map[string]any{}, "Merge: [\"n\"]: expected an object, got int"},
+		{"Map bad item", Map(func(s string) int { return len(s) }), []any{"a", 1}, "Map: item 1: expected string, got int"},
+		{"Map bad input", Map(func(s string) int { return len(s) }), 1, "Map: expected string, got int"},
+		{"Filter not a slice", Filter(func(s string) bool { return true }), "a", "Filter: expected a slice, got string"},
+		{"Filter bad item", Filter(func(s string) bool { return true }), []int{1}, "Filter: item 0: expected string, got int"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, e := transform(tt.stage, tt.in, H{"n": 1})
+			if e == nil {
+				t.Fatalf("got %v, want an error", out)
+			}
+			if e.Code != ISR || e.Obj.(H)["error"] != tt.want {
+				t.Errorf("got %d %v, want %q", e.Code, e.Obj, tt.want)
+			}
+		})
+	}
+}
+
+func toUpper(s string) string { return strings.ToUpper(s) }
+
+func TestTransformPrint(t *testing.T) {
+
+	tests := []struct {
+		stage *Stage
+		want  string
+	}{
+		{Map(toUpper), "  => Map(toUpper) =>"},
+		{Pick("a", "b"), "  => Pick(\"a\", \"b\") =>"},
+		{Omit("a"), "  => Omit(\"a\") =>"},
+		{Rename(map[string]string{"b": "c", "_id": "id"}), "  => Rename(\"_id\": \"id\", \"b\": \"c\") =>"},
+		{Merge("x", "y"), "  => " + FuncStr("Merge", "x", "y") + " =>"},
+	}
+	for _, tt := range tests {
+		if got := tt.stage.P(); got != tt.want {
+			t.Errorf("P() = %q, want %q", got, tt.want)
+		}
+	}
+
+	if got := Filter(func(string) bool { return true }).P(); !strings.HasPrefix(got, "  => Filter(TestTransformPrint.func") {
+		t.Errorf("P() = %q", got)
+	}
+	if got := Map(strings.TrimSpace).P(); got != "  => Map(TrimSpace) =>" {
+		t.Errorf("P() = %q", got)
+	}
+}
@@ -0,0 +1,238 @@
+package rp
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// FieldError describes one field that failed validation.
+type FieldError struct {
+	Field   string `json:"field"`   // Path of the field, by its json (or form, uri, header) name, like "items[0].sku"
+	Rule    string `json:"rule"`    // The rule that failed, like "required" or "min"
+	Message string `json:"message"` // Message for API clients, from a Translator
+}
+
+// ValidationError is returned when a struct fails validation. It becomes a 400 response like
+// {"error": "Invalid request", "fields": [{"field": "quantity", "rule": "min", "message": "..."}]}.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (e ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Translator creates the message for a failed rule. field is the field's path as it appears in FieldError.
+type Translator func(field string, fe validator.FieldError) string
+
+// DefaultTranslator creates English messages for the common rules. It is used by Bind and the other binding
+// stages, and by Validate unless its options set a Translator. Replace it to change the messages everywhere.
+var DefaultTranslator Translator = func(field string, fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return field + " is required"
+	case "min", "gte":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return field + " must have at least " + fe.Param() + " " + unit
+		}
+		return field + " must be at least " + fe.Param()
+	case "max", "lte":
+		if unit := lengthUnit(fe.Kind()); unit != "" {
+			return field + " must have at most " + fe.Param() + " " + unit
+		}
+		return field + " must be at most " + fe.Param()
+	case "gt":
+		return field + " must be greater than " + fe.Param()
+	case "lt":
+		return field + " must be less than " + fe.Param()
+	case "len":
+		return field + " must have a length of " + fe.Param()
+	case "oneof":
+		return field + " must be one of " + strings.ReplaceAll(fe.Param(), " ", ", ")
+	case "email":
+		return field + " must be a valid email address"
+	case "url":
+		return field + " must be a valid URL"
+	case "uuid":
+		return field + " must be a valid UUID"
+	case "numeric":
+		return field + " must be numeric"
+	case "alphanum":
+		return field + " must only contain letters and numbers"
+	}
+	return field + " failed the " + fe.Tag() + " rule"
+}
+
+// lengthUnit returns what min and max count for kinds that are limited by length rather than value
+func lengthUnit(k reflect.Kind) string {
+	switch k {
+	case reflect.String:
+		return "characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		return "items"
+	}
+	return ""
+}
+
+type ValidateOptions struct {
+	// Struct tag that holds the rules. Default is "binding", the same tag that Bind validates.
+	// Rules that only this stage knows about should use a separate tag, such as "validate", because Bind
+	// rejects rules that aren't in its BindOptions.Rules.
+	TagName string
+	// Custom rules for this stage only, by the name used in the struct tags.
+	Rules map[string]validator.Func
+	// Creates the messages of the FieldErrors. Default is DefaultTranslator.
+	Translator Translator
+}
+
+// Validate validates in, which must be a struct or a pointer to one, against the rules in its struct tags,
+// and outputs it unchanged. Failures become a 400 response listing every field that failed.
+func Validate(opts ...ValidateOptions) *Stage {
+
+	opt := ValidateOptions{}
+	if len(opts) > 0 {
+		opt = opts[0]
+	}
+	if opt.TagName == "" {
+		opt.TagName = "binding"
+	}
+
+	v := stageValidator("rp.Validate", opt.TagName, opt.Rules)
+
+	return &Stage{
+
+		P: func() string {
+			return "  => Validate() =>"
+		},
+
+		F: func(in any, c Context, lgr Logger) (any, error) {
+			if err := v.Struct(in); err != nil {
+				return nil, validationError(err, reflect.TypeOf(in), translator(opt.Translator))
+			}
+			return in, nil
+		},
+
+		E: invalidRequest,
+	}
+}
+
+// translator returns t, or DefaultTranslator if t is nil. It is resolved on every execution so that replacing
+// DefaultTranslator applies to stages that were already built.
+func translator(t Translator) Translator {
+	if t == nil {
+		return DefaultTranslator
+	}
+	return t
+}
+
+// stageValidator creates the validator of a single stage, with its own tag name and custom rules. It panics,
+// naming the stage, if a rule can't be registered.
+func stageValidator(stage string, tagName string, rules map[string]validator.Func) *validator.Validate {
+	v := validator.New()
+	v.SetTagName(tagName)
+	for name, rule := range rules {
+		if err := v.RegisterValidation(name, rule); err != nil {
+			panic(stage + ": " + err.Error())
+		}
+	}
+	return v
+}
+
+// validationError converts the validator's errors into a ValidationError, naming fields the way API clients
+// see them. Other errors are returned as they are.
+func validationError(err error, t reflect.Type, translate Translator) error {
+	var ve validator.ValidationErrors
+	if !errors.As(err, &ve) {
+		return err
+	}
+	fields := make([]FieldError, len(ve))
+	for i, fe := range ve {
+		path := fieldPath(t, fe.StructNamespace())
+		fields[i] = FieldError{
+			Field:   path,
+			Rule:    fe.Tag(),
+			Message: translate(path, fe),
+		}
+	}
+	return ValidationError{Fields: fields}
+}
+
+// fieldPath converts a validator namespace such as "PurchaseRequestBody.Items[0].SKU" into "items[0].sku"
+// by looking up each field's tag name in t.
+func fieldPath(t reflect.Type, namespace string) string {
+
+	segments := strings.Split(namespace, ".")
+	if len(segments) > 1 {
+		segments = segments[1:] // The root struct's name
+	}
+
+	path := ""
+	for _, seg := range segments {
+
+		name, index, _ := strings.Cut(seg, "[")
+		if index != "" {
+			index = "[" + index
+		}
+
+		for t != nil && t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		if t != nil && t.Kind() == reflect.Struct {
+			if f, ok := t.FieldByName(name); ok {
+				name = tagName(f)
+				t = f.Type
+				if f.Anonymous && name == f.Name && index == "" {
+					continue // Embedded fields are flattened when decoding
+				}
+			} else {
+				t = nil
+			}
+		}
+
+		// Step into the element type once for each index
+		for n := strings.Count(index, "["); n > 0 && t != nil; n-- {
+			for t.Kind() == reflect.Pointer {
+				t = t.Elem()
+			}
+			switch t.Kind() {
+			case reflect.Slice, reflect.Array, reflect.Map:
+				t = t.Elem()
+			default:
+				t = nil
+			}
+		}
+
+		if path != "" {
+			path += "."
+		}
+		path += name + index
+	}
+
+	return path
+}
+
+// tagName returns the name that a struct field is decoded from
+func tagName(f reflect.StructField) string {
+	for _, tag := range []string{"json", "form", "uri", "header", "bson"} {
+		name, _, _ := strings.Cut(f.Tag.Get(tag), ",")
+		if name != "" && name != "-" {
+			return name
+		}
+	}
+	return f.Name
+}
+
+// validationErrorObj is the response body for a ValidationError
+func validationErrorObj(ve ValidationError) H {
+	return H{
+		"error":  "Invalid request",
+		"fields": ve.Fields,
+	}
+}
@@ -0,0 +1,186 @@
+package rp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-playground/validator/v10"
+)
+
+type validateItem struct {
+	SKU      string `json:"sku" binding:"required"`
+	Quantity int    `json:"quantity" binding:"min=1,max=10"`
+}
+
+type validateOrder struct {
+	Email    string         `json:"email" binding:"required,email"`
+	Name     string         `json:"name" binding:"min=2"`
+	Size     string         `json:"size" binding:"oneof=S M L"`
+	Items    []validateItem `json:"items" binding:"min=1,dive"`
+	Coupon   string         `json:"coupon" binding:"omitempty,coupon"`
+	Internal string         `binding:"max=3"`
+}
+
+// fieldErrors runs the chain on a JSON POST of body and returns the status and the "fields" of the response
+func fieldErrors(t *testing.T, ch *Chain, body string) (int, []FieldError) {
+	t.Helper()
+	rec := serve("/bind", ch, jsonRequest(body, "application/json"))
+	var res struct {
+		Error  string       `json:"error"`
+		Fields []FieldError `json:"fields"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if rec.Code == http.StatusBadRequest && res.Error != "Invalid request" {
+		t.Errorf("error = %q, want \"Invalid request\"", res.Error)
+	}
+	return rec.Code, res.Fields
+}
+
+var isCoupon validator.Func = func(fl validator.FieldLevel) bool {
+	return strings.HasPrefix(fl.Field().String(), "SAVE")
+}
+
+func TestBindFieldErrors(t *testing.T) {
+
+	ch := echoRoute(Bind(&validateOrder{}, BindOptions{Rules: map[string]validator.Func{"coupon": isCoupon}}))
+
+	code, fields := fieldErrors(t, ch, `{"email": "nope", "name": "a", "size": "XL", "items": [{"quantity": 11}],
+		"coupon": "FREE", "Internal": "long"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", code, http.StatusBadRequest)
+	}
+
+	want := []FieldError{
+		{"email", "email", "email must be a valid email address"},
+		{"name", "min", "name must have at least 2 characters"},
+		{"size", "oneof", "size must be one of S, M, L"},
+		{"items[0].sku", "required", "items[0].sku is required"},
+		{"items[0].quantity", "max", "items[0].quantity must be at most 10"},
+		{"coupon", "coupon", "coupon failed the coupon rule"},
+		{"Internal", "max", "Internal must have at most 3 characters"},
+	}
+	if !reflect.DeepEqual(fields, want) {
+		t.Errorf("fields =\n%v\nwant\n%v", fields, want)
+	}
+
+	code, fields = fieldErrors(t, ch, `{"email": "a@example.com", "name": "ab", "size": "M", "items": []}`)
+	if code != http.StatusBadRequest || len(fields) != 1 || fields[0].Message != "items must have at least 1 items" {
+		t.Errorf("empty items = %d %v", code, fields)
+	}
+
+	code, _ = fieldErrors(t, ch, `{"email": "a@example.com", "name": "ab", "size": "M", "items": [{"sku": "A", "quantity": 1}],
+		"coupon": "SAVE10"}`)
+	if code != http.StatusOK {
+		t.Errorf("valid body = %d", code)
+	}
+}
+
+func TestBindRulesArePerStage(t *testing.T) {
+
+	type body struct {
+		Coupon string `json:"coupon" binding:"coupon"`
+	}
+
+	// The rule is only known to the stage that registered it
+	func() {
+		defer func() {
+			if r := recover(); r == nil || !strings.Contains(r.(string), "coupon") {
+				t.Errorf("panic = %v, want an undefined rule", r)
+			}
+		}()
+		serve("/bind", echoRoute(Bind(&body{})), jsonRequest(`{"coupon": "SAVE10"}`, "application/json"))
+	}()
+
+	// A rule name that the validator can't register
+	defer func() {
+		if r := recover(); r == nil || !strings.HasPrefix(r.(string), "rp.Bind: ") {
+			t.Errorf("panic = %v", r)
+		}
+	}()
+	Bind(&body{}, BindOptions{Rules: map[string]validator.Func{"": isCoupon}})
+}
+
+func TestTranslators(t *testing.T) {
+
+	upper := func(field string, fe validator.FieldError) string {
+		return strings.ToUpper(field + " " + fe.Tag())
+	}
+
+	// Per stage
+	_, fields := fieldErrors(t, echoRoute(Bind(&validateItem{}, BindOptions{Translator: upper})), `{"quantity": 0}`)
+	if len(fields) != 2 || fields[0].Message != "SKU REQUIRED" || fields[1].Message != "QUANTITY MIN" {
+		t.Errorf("Bind with Translator = %v", fields)
+	}
+
+	_, e := ExecuteStandalone(context.Background(), First(Validate(ValidateOptions{Translator: upper})), &validateItem{}, nil)
+	if e == nil || e.Err.(ValidationError).Fields[0].Message != "SKU REQUIRED" {
+		t.Errorf("Validate with Translator = %v", e)
+	}
+
+	// Replacing DefaultTranslator applies to stages that were already built
+	bind := echoRoute(Bind(&validateItem{}))
+	defer func(t Translator) { DefaultTranslator = t }(DefaultTranslator)
+	DefaultTranslator = upper
+	_, fields = fieldErrors(t, bind, `{"sku": "A"}`)
+	if len(fields) != 1 || fields[0].Message != "QUANTITY MIN" {
+		t.Errorf("Bind with a replaced DefaultTranslator = %v", fields)
+	}
+}
+
+func TestDefaultTranslator(t *testing.T) {
+
+	type limits struct {
+		Count int      `json:"count" binding:"gt=0,lt=5"`
+		Tags  []string `json:"tags" binding:"max=1"`
+		Code  string   `json:"code" binding:"len=3,alphanum"`
+		Site  string   `json:"site" binding:"omitempty,url"`
+		ID    string   `json:"id" binding:"omitempty,uuid"`
+		Zip   string   `json:"zip" binding:"omitempty,numeric"`
+		Age   int      `json:"age" binding:"gte=18"`
+		Other string   `json:"other" binding:"omitempty,lowercase"`
+	}
+
+	in := &limits{Count: 5, Tags: []string{"a", "b"}, Code: "a-", Site: "x", ID: "x", Zip: "x", Age: 1, Other: "X"}
+	_, e := ExecuteStandalone(context.Background(), First(Validate()), in, nil)
+	if e == nil {
+		t.Fatal("no error")
+	}
+
+	got := []string{}
+	for _, f := range e.Err.(ValidationError).Fields {
+		got = append(got, f.Message)
+	}
+	want := []string{
+		"count must be less than 5",
+		"tags must have at most 1 items",
+		"code must have a length of 3",
+		"site must be a valid URL",
+		"id must be a valid UUID",
+		"zip must be numeric",
+		"age must be at least 18",
+		"other failed the lowercase rule",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestValidateTagName(t *testing.T) {
+
+	type body struct {
+		Coupon string `json:"coupon" validate:"coupon"`
+	}
+	s := Validate(ValidateOptions{TagName: "validate", Rules: map[string]validator.Func{"coupon": isCoupon}})
+
+	_, e := ExecuteStandalone(context.Background(), First(s), &body{Coupon: "FREE"}, nil)
+	if e == nil || e.Code != BR || e.Obj.(H)["fields"].([]FieldError)[0].Field != "coupon" {
+		t.Errorf("invalid = %v", e)
+	}
+	if _, e := ExecuteStandalone(context.Background(), First(s), &body{Coupon: "SAVE1"}, nil); e != nil {
+		t.Errorf("valid = %v", e.Obj)
+	}
+}
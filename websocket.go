@@ -0,0 +1,98 @@
+package rp
+
+import (
+	"fmt"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSRoute is a WebSocket endpoint, the counterpart of Route. After the connection is upgraded, Connect runs once
+// and then Message runs for every inbound frame, with the frame's payload as the first stage's input: a string
+// for text frames and []byte for binary frames. Both chains share the connection's context, so values set
+// during Connect can be read while handling messages.
+// When a chain returns a *Response, its Obj is written back as a JSON message. A nil output sends nothing.
+// When a chain fails, the StageError's Obj is written back instead. A failed Connect also closes the connection.
+type WSRoute struct {
+	RelativePath string
+	Connect      *Chain              // Optional. Runs once per connection.
+	Message      *Chain              // Runs once per inbound frame.
+	Logger       Logger              // Optional
+	Upgrader     *websocket.Upgrader // Optional. The zero Upgrader, which only accepts same-origin requests, is used if nil.
+}
+
+// Run upgrades the connection and serves it until the client closes it or a read fails.
+func (r *WSRoute) Run(c Context) {
+
+	upgrader := r.Upgrader
+	if upgrader == nil {
+		upgrader = &websocket.Upgrader{}
+	}
+
+	// Upgrade writes its own HTTP error response on failure
+	conn, err := upgrader.Upgrade(c.Writer(), c.Request(), nil)
+	if err != nil {
+		if r.Logger != nil {
+			r.Logger.LogMessage("WebSocket upgrade failed: " + err.Error())
+		}
+		return
+	}
+	defer conn.Close()
+
+	if r.Connect != nil {
+		if r.Logger != nil {
+			r.Logger.LogMessage("Starting connect chain...")
+		}
+		o, e := execute(r.Connect, nil, c, r.Logger)
+		if e != nil {
+			conn.WriteJSON(e.Obj)
+			conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, ""))
+			return
+		}
+		if err := writeWSResponse(conn, o); err != nil {
+			return
+		}
+	}
+
+	if r.Message == nil {
+		return
+	}
+
+	for {
+		mt, data, err := conn.ReadMessage()
+		if err != nil {
+			if r.Logger != nil && websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				r.Logger.LogMessage("WebSocket read failed: " + err.Error())
+			}
+			return
+		}
+
+		var in any = data
+		if mt == websocket.TextMessage {
+			in = string(data)
+		}
+
+		if r.Logger != nil {
+			r.Logger.LogMessage("Starting message chain...")
+		}
+		o, e := execute(r.Message, in, c, r.Logger)
+		if e != nil {
+			err = conn.WriteJSON(e.Obj)
+		} else {
+			err = writeWSResponse(conn, o)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func writeWSResponse(conn *websocket.Conn, o any) error {
+	switch res := o.(type) {
+	case nil:
+		return nil
+	case *Response:
+		return conn.WriteJSON(res.Obj)
+	default:
+		return conn.WriteJSON(H{"error": fmt.Sprintf("pipeline returned %T instead of a response", o)})
+	}
+}
@@ -0,0 +1,132 @@
+package rp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialWS starts a server for route and connects a local client to it
+func dialWS(t *testing.T, route *WSRoute) *websocket.Conn {
+	t.Helper()
+
+	srv := httptest.NewServer(route)
+	t.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + route.RelativePath
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func readJSON(t *testing.T, conn *websocket.Conn) map[string]any {
+	t.Helper()
+	var msg map[string]any
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return msg
+}
+
+func TestWSRoute(t *testing.T) {
+
+	var connects atomic.Int32
+
+	route := &WSRoute{
+		RelativePath: "/ws",
+		Connect: First(S("connect", func(in any, c Context, lgr Logger) (any, error) {
+			n := connects.Add(1)
+			c.Set("conn.id", n)
+			return &Response{Code: http.StatusOK, Obj: H{"connected": n}}, nil
+		})),
+		Message: First(S("message", func(in any, c Context, lgr Logger) (any, error) {
+			if s, ok := in.(string); ok && s == "fail" {
+				return nil, errors.New("bad message")
+			}
+			return &Response{Code: http.StatusOK, Obj: H{
+				"type":    fmt.Sprintf("%T", in),
+				"payload": fmt.Sprintf("%s", in),
+				"conn":    c.MustGet("conn.id"),
+			}}, nil
+		})).Catch(http.StatusBadRequest, "Bad message"),
+	}
+
+	conn := dialWS(t, route)
+
+	if msg := readJSON(t, conn); msg["connected"] != float64(1) {
+		t.Fatalf("connect response = %v", msg)
+	}
+
+	// Text frames are strings
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	msg := readJSON(t, conn)
+	if msg["type"] != "string" || msg["payload"] != "hello" || msg["conn"] != float64(1) {
+		t.Errorf("text frame response = %v", msg)
+	}
+
+	// Binary frames are []byte
+	if err := conn.WriteMessage(websocket.BinaryMessage, []byte{'h', 'i'}); err != nil {
+		t.Fatal(err)
+	}
+	msg = readJSON(t, conn)
+	if msg["type"] != "[]uint8" || msg["payload"] != "hi" {
+		t.Errorf("binary frame response = %v", msg)
+	}
+
+	// A failed message writes the StageError's Obj and keeps the connection open
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("fail")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn); msg["error"] != "Bad message" {
+		t.Errorf("error response = %v", msg)
+	}
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("again")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readJSON(t, conn); msg["payload"] != "again" {
+		t.Errorf("response after error = %v", msg)
+	}
+
+	// Connect ran once for the connection, not per message
+	if n := connects.Load(); n != 1 {
+		t.Errorf("Connect ran %d times, want 1", n)
+	}
+}
+
+func TestWSRouteConnectFailure(t *testing.T) {
+
+	route := &WSRoute{
+		RelativePath: "/ws",
+		Connect: First(S("connect", func(in any, c Context, lgr Logger) (any, error) {
+			return nil, errors.New("unauthorized")
+		})).Catch(http.StatusUnauthorized, "Unauthorized"),
+		Message: First(S("message", func(in any, c Context, lgr Logger) (any, error) {
+			t.Error("Message ran after a failed Connect")
+			return nil, nil
+		})),
+	}
+
+	conn := dialWS(t, route)
+
+	if msg := readJSON(t, conn); msg["error"] != "Unauthorized" {
+		t.Errorf("connect error = %v", msg)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Errorf("read after failed connect = %v, want close %d", err, websocket.ClosePolicyViolation)
+	}
+}